@@ -0,0 +1,186 @@
+package dnsutils
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bepass-org/dnsutils/internal/config"
+	"github.com/bepass-org/dnsutils/internal/statute"
+)
+
+// LoadConfig builds a Resolver from the YAML or JSON configuration file at
+// path. The given options are applied before the ones from the file, so they
+// can provide what the file cannot express, such as a logger or a dialer.
+func LoadConfig(path string, options ...Option) (*Resolver, error) {
+	cfg, err := config.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	return newResolverFromConfig(cfg, options)
+}
+
+// ParseConfig is like LoadConfig but reads the configuration from data.
+func ParseConfig(data []byte, options ...Option) (*Resolver, error) {
+	cfg, err := config.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	return newResolverFromConfig(cfg, options)
+}
+
+// newResolverFromConfig creates a fully configured Resolver from cfg.
+func newResolverFromConfig(cfg *config.Config, options []Option) (*Resolver, error) {
+	opts := append([]Option{}, options...)
+	opts = append(opts,
+		WithUseIPv4(cfg.UseIPv4),
+		WithUseIPv6(cfg.UseIPv6),
+		WithPrefer(cfg.Prefer),
+		WithNdots(cfg.Ndots),
+		WithSearchList(cfg.SearchList),
+		WithTLSHostname(cfg.TLS.Hostname),
+		WithInsecureSkipVerify(cfg.TLS.InsecureSkipVerify),
+		WithCacheDisabled(cfg.Cache.Disabled),
+		WithCacheTTL(cfg.Cache.TTL),
+	)
+	if cfg.Timeout > 0 {
+		opts = append(opts, WithTimeout(cfg.Timeout))
+	}
+	if cfg.Proxy != "" {
+		opts = append(opts, WithProxy(cfg.Proxy))
+	}
+	if len(cfg.Bootstrap.Servers) > 0 {
+		opts = append(opts, WithBootstrap(cfg.Bootstrap.Servers...))
+	}
+	for host, ips := range cfg.Bootstrap.Hosts {
+		opts = append(opts, WithBootstrapHost(host, ips))
+	}
+	for host, ips := range cfg.Hosts {
+		opts = append(opts, WithHost(host, ips))
+	}
+
+	r := NewResolver(opts...)
+	if err := r.SetDNSServers(cfg.Upstreams...); err != nil {
+		return nil, err
+	}
+	for _, route := range cfg.Routes {
+		for _, domain := range route.Domains {
+			if err := r.AddRoute(domain, route.Upstream); err != nil {
+				_ = r.Close()
+				return nil, err
+			}
+		}
+	}
+	return r, nil
+}
+
+// ConfigWatcher keeps a Resolver in sync with a configuration file. When the
+// file changes, a new Resolver is built and atomically swapped in; lookups
+// already running on the previous one complete undisturbed. An invalid file
+// is logged and the previous configuration is kept.
+type ConfigWatcher struct {
+	path     string
+	options  []Option
+	interval time.Duration
+	logger   statute.Logger
+
+	current atomic.Pointer[Resolver]
+	mu      sync.Mutex
+	modTime time.Time
+	stop    chan struct{}
+	once    sync.Once
+}
+
+// WatchConfig loads the configuration file at path and checks it for changes
+// every interval. See LoadConfig for the meaning of options.
+func WatchConfig(path string, interval time.Duration, options ...Option) (*ConfigWatcher, error) {
+	w := &ConfigWatcher{
+		path:     path,
+		options:  options,
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+	if err := w.Reload(); err != nil {
+		return nil, err
+	}
+	w.logger = w.Resolver().logger
+
+	go w.run()
+	return w, nil
+}
+
+// Resolver returns the Resolver built from the current configuration.
+func (w *ConfigWatcher) Resolver() *Resolver {
+	return w.current.Load()
+}
+
+// LookupIP resolves fqdn with the current configuration.
+func (w *ConfigWatcher) LookupIP(fqdn string) ([]string, error) {
+	return w.Resolver().LookupIP(fqdn)
+}
+
+// Reload unconditionally re-reads the configuration file.
+func (w *ConfigWatcher) Reload() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	info, err := os.Stat(w.path)
+	if err != nil {
+		return err
+	}
+	// Don't retry the same broken file on every check.
+	w.modTime = info.ModTime()
+
+	r, err := LoadConfig(w.path, w.options...)
+	if err != nil {
+		return err
+	}
+	if old := w.current.Swap(r); old != nil {
+		_ = old.Close()
+	}
+	return nil
+}
+
+// Close stops watching the configuration file.
+func (w *ConfigWatcher) Close() {
+	w.once.Do(func() { close(w.stop) })
+}
+
+// changed reports whether the configuration file was modified since it was
+// last loaded.
+func (w *ConfigWatcher) changed() (bool, error) {
+	info, err := os.Stat(w.path)
+	if err != nil {
+		return false, err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return !info.ModTime().Equal(w.modTime), nil
+}
+
+// run polls the configuration file until the watcher is closed.
+func (w *ConfigWatcher) run() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			changed, err := w.changed()
+			if err != nil {
+				w.logger.Error("checking config %s: %s", w.path, err)
+				continue
+			}
+			if !changed {
+				continue
+			}
+			if err := w.Reload(); err != nil {
+				w.logger.Error("reloading config %s: %s", w.path, err)
+				continue
+			}
+			w.logger.Debug("reloaded config %s", w.path)
+		case <-w.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package dnsutils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatchConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnsutils.yaml")
+	write := func(ip string, modTime time.Time) {
+		data := "upstreams: [udp://127.0.0.1:53]\nhosts:\n  router.lan: [" + ip + "]\n"
+		assert.Nil(t, os.WriteFile(path, []byte(data), 0o600))
+		assert.Nil(t, os.Chtimes(path, modTime, modTime))
+	}
+
+	now := time.Now()
+	write("192.168.1.1", now)
+
+	w, err := WatchConfig(path, 5*time.Millisecond)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer w.Close()
+
+	ips, err := w.LookupIP("router.lan")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"192.168.1.1"}, ips)
+	previous := w.Resolver()
+
+	// An invalid file keeps the current configuration.
+	assert.Nil(t, os.WriteFile(path, []byte("upstreams: [ftp://x]\n"), 0o600))
+	assert.Nil(t, os.Chtimes(path, now.Add(time.Second), now.Add(time.Second)))
+	time.Sleep(50 * time.Millisecond)
+	assert.Same(t, previous, w.Resolver())
+
+	write("192.168.1.2", now.Add(2*time.Second))
+	assert.Eventually(t, func() bool {
+		ips, err := w.LookupIP("router.lan")
+		return err == nil && len(ips) == 1 && ips[0] == "192.168.1.2"
+	}, time.Second, 5*time.Millisecond)
+
+	// Lookups through the previous Resolver keep working.
+	ips, err = previous.LookupIP("router.lan")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"192.168.1.1"}, ips)
+}
@@ -0,0 +1,194 @@
+package dnsutils
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/bepass-org/dnsutils/internal/statute"
+	"github.com/miekg/dns"
+)
+
+// Response settings of Exchange.
+const (
+	// exchangeTTL is the TTL of answers synthesized from the hosts and the
+	// cache, which don't keep the TTLs of the upstreams.
+	exchangeTTL = 60
+	// exchangeUDPSize is the EDNS buffer size advertised in responses.
+	exchangeUDPSize = 1232
+)
+
+// Exchange answers the DNS query req, such as one received by a server,
+// through the hosts, the cache and the upstreams, for any question type.
+// The response always matches req: failures are reported by its rcode, and
+// the error is returned along with it.
+func (r *Resolver) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.RecursionAvailable = true
+	if opt := req.IsEdns0(); opt != nil {
+		resp.SetEdns0(exchangeUDPSize, opt.Do())
+	}
+
+	switch {
+	case req.Opcode != dns.OpcodeQuery:
+		resp.Rcode = dns.RcodeNotImplemented
+		return resp, nil
+	case len(req.Question) != 1:
+		resp.Rcode = dns.RcodeFormatError
+		return resp, nil
+	case req.Question[0].Qclass != dns.ClassINET:
+		resp.Rcode = dns.RcodeNotImplemented
+		return resp, nil
+	}
+	q := req.Question[0]
+
+	if ips, ok := r.hostIPs(q.Name); ok {
+		resp.Answer = addressRecords(q, ips)
+		return resp, nil
+	}
+	if ips, ok := r.cachedAnswer(q); ok {
+		resp.Answer = addressRecords(q, ips)
+		return resp, nil
+	}
+
+	rsp, err := r.Lookup(q.Name, q.Qtype)
+	switch {
+	case rsp.Msg != nil:
+		resp.Answer = rsp.Msg.Answer
+		resp.Ns = rsp.Msg.Ns
+		resp.Rcode = rsp.Msg.Rcode
+		for _, rr := range rsp.Msg.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				resp.Extra = append(resp.Extra, rr)
+			}
+		}
+		resp.AuthenticatedData = rsp.Security == statute.Secure && (req.AuthenticatedData || isDO(req))
+	case err == nil:
+		// Such as answers of the system resolver, which come without records.
+		for _, a := range rsp.Answers {
+			if rr, rrErr := dns.NewRR(a.Name + " " + a.Class + " " + a.Type + " " + a.Address); rrErr == nil {
+				rr.Header().Ttl = exchangeTTL
+				resp.Answer = append(resp.Answer, rr)
+			}
+		}
+	}
+	if err != nil {
+		resp.Rcode = errorRcode(err)
+		return resp, err
+	}
+
+	if !isDO(req) {
+		stripDNSSEC(resp, q.Qtype)
+	}
+	if q.Qtype == dns.TypeA && !rsp.Blocked {
+		if ips := addresses(resp.Answer); len(ips) > 0 {
+			r.cache.Set(cacheKey(q.Name, rsp.Msg), ips)
+		}
+	}
+	return resp, nil
+}
+
+// hostIPs returns the addresses of name in the hosts.
+func (r *Resolver) hostIPs(name string) ([]string, bool) {
+	hosts := *r.hosts.Load()
+	if ips, ok := hosts[name]; ok {
+		return ips, true
+	}
+	ips, ok := hosts[strings.TrimSuffix(name, ".")]
+	return ips, ok
+}
+
+// cachedAnswer returns the cached addresses for an A question, unless the
+// rewrites or the blocklist have a say on its name.
+func (r *Resolver) cachedAnswer(q dns.Question) ([]string, bool) {
+	if q.Qtype != dns.TypeA {
+		return nil, false
+	}
+	if r.rewrites != nil {
+		if rw, err := r.rewrites.Rewrite(q); rw != nil || err != nil {
+			return nil, false
+		}
+	}
+	if r.blocklist != nil && r.blocklist.Match(q.Name) {
+		return nil, false
+	}
+	ips, ok := r.cachedIPs(dns.Fqdn(q.Name))
+	if ok && r.rebinding != nil {
+		var err error
+		if ips, err = r.rebinding.FilterIPs(q.Name, ips); err != nil || len(ips) == 0 {
+			return nil, false
+		}
+	}
+	return ips, ok
+}
+
+// addressRecords returns the records of ips answering q, of its family.
+func addressRecords(q dns.Question, ips []string) []dns.RR {
+	var rrs []dns.RR
+	for _, s := range ips {
+		ip := net.ParseIP(s)
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: exchangeTTL}
+		switch {
+		case ip == nil:
+		case q.Qtype == dns.TypeA && ip.To4() != nil:
+			rrs = append(rrs, &dns.A{Hdr: hdr, A: ip.To4()})
+		case q.Qtype == dns.TypeAAAA && ip.To4() == nil:
+			rrs = append(rrs, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return rrs
+}
+
+// addresses returns the addresses of the A and AAAA records of rrs.
+func addresses(rrs []dns.RR) []string {
+	var ips []string
+	for _, rr := range rrs {
+		switch v := rr.(type) {
+		case *dns.A:
+			ips = append(ips, v.A.String())
+		case *dns.AAAA:
+			ips = append(ips, v.AAAA.String())
+		}
+	}
+	return ips
+}
+
+// errorRcode maps a lookup error to the rcode reporting it.
+func errorRcode(err error) int {
+	switch {
+	case errors.Is(err, ErrNXDomain):
+		return dns.RcodeNameError
+	case errors.Is(err, ErrRefused):
+		return dns.RcodeRefused
+	}
+	return dns.RcodeServerFailure
+}
+
+// isDO reports whether req asks for DNSSEC records.
+func isDO(req *dns.Msg) bool {
+	opt := req.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
+// stripDNSSEC removes the DNSSEC records from resp, requested from the
+// upstreams for validation but not by the client. The sections are copied,
+// as they may be shared with the upstream response.
+func stripDNSSEC(resp *dns.Msg, qtype uint16) {
+	strip := func(rrs []dns.RR) []dns.RR {
+		var kept []dns.RR
+		for _, rr := range rrs {
+			switch t := rr.Header().Rrtype; t {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				if t != qtype {
+					continue
+				}
+			}
+			kept = append(kept, rr)
+		}
+		return kept
+	}
+	resp.Answer = strip(resp.Answer)
+	resp.Ns = strip(resp.Ns)
+	resp.Extra = strip(resp.Extra)
+}
@@ -8,7 +8,9 @@ require (
 	github.com/ameshkov/dnsstamps v1.0.3
 	github.com/c-bata/go-prompt v0.2.6
 	github.com/miekg/dns v1.1.50
+	github.com/stretchr/testify v1.8.4
 	golang.org/x/crypto v0.13.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 replace github.com/miekg/dns => github.com/bepass-org/dns v1.0.2
@@ -23,12 +25,10 @@ require (
 	github.com/mattn/go-tty v0.0.3 // indirect
 	github.com/pkg/term v1.2.0-beta.2 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/stretchr/testify v1.8.4 // indirect
 	golang.org/x/exp v0.0.0-20230807204917-050eac23e9de // indirect
 	golang.org/x/mod v0.12.0 // indirect
 	golang.org/x/net v0.15.0 // indirect
 	golang.org/x/sys v0.12.0 // indirect
 	golang.org/x/text v0.13.0 // indirect
 	golang.org/x/tools v0.13.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -96,6 +96,8 @@ func (c *cache) DeleteExpired() {
 
 // OnExpired sets an (optional) function that is called when the cache expires.
 func (c *cache) OnExpired(f func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.onExpired = f
 }
 
@@ -111,7 +113,10 @@ func (c *cache) ItemCount() int {
 
 // Flush deletes all items from the cache.
 func (c *cache) Flush() {
-	c.items = sync.Map{}
+	c.items.Range(func(k, _ interface{}) bool {
+		c.items.Delete(k)
+		return true
+	})
 }
 
 // janitor periodically cleans up expired items.
@@ -122,8 +127,11 @@ type janitor struct {
 
 // handleExpired is fired by the ticker and executes the onExpired function.
 func (c *cache) handleExpired() {
-	if c.onExpired != nil {
-		c.onExpired()
+	c.mu.RLock()
+	onExpired := c.onExpired
+	c.mu.RUnlock()
+	if onExpired != nil {
+		onExpired()
 	}
 }
 
@@ -156,21 +164,20 @@ func runJanitor(c *cache, ex time.Duration) {
 	go j.Run(c)
 }
 
-// newCache creates a new cache with the given expiration duration and initial map.
-func newCache(ex time.Duration, m sync.Map) *cache {
+// newCache creates a new empty cache with the given expiration duration.
+func newCache(ex time.Duration) *cache {
 	if ex <= 0 {
 		ex = -1
 	}
 	c := &cache{
 		expiration: ex,
-		items:      m,
 	}
 	return c
 }
 
 // newCacheWithJanitor creates a new cache with the janitor and sets up the finalizer.
-func newCacheWithJanitor(ex time.Duration, m sync.Map) *Cache {
-	c := newCache(ex, m)
+func newCacheWithJanitor(ex time.Duration) *Cache {
+	c := newCache(ex)
 	C := &Cache{c}
 	if ex > 0 {
 		runJanitor(c, ex)
@@ -183,5 +190,5 @@ func newCacheWithJanitor(ex time.Duration, m sync.Map) *Cache {
 // the items in the cache never expire (by default), and must be deleted manually.
 // The OnExpired callback method is ignored, too.
 func NewCache(expiration time.Duration) *Cache {
-	return newCacheWithJanitor(expiration, sync.Map{})
+	return newCacheWithJanitor(expiration)
 }
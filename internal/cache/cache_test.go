@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -208,11 +209,11 @@ func TestCacheOnExpired(t *testing.T) {
 	for k, v := range initialItems {
 		cache.Set(k, v)
 	}
-	count := 0
-	cache.OnExpired(func() { count++ })
+	var count int32
+	cache.OnExpired(func() { atomic.AddInt32(&count, 1) })
 
 	cache.handleExpired()
-	assert.Equal(t, 1, count)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&count))
 }
 
 func TestCacheItemCount(t *testing.T) {
@@ -255,20 +256,20 @@ func TestCacheFlush(t *testing.T) {
 func TestJanitor(t *testing.T) {
 	expiration := time.Millisecond * 3
 	cache := NewCache(expiration)
-	count := 0
-	cache.OnExpired(func() { count++ })
+	var count int32
+	cache.OnExpired(func() { atomic.AddInt32(&count, 1) })
 
 	time.Sleep(expiration)
-	assert.Equal(t, 1, count)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&count))
 }
 
 func TestJanitorStop(t *testing.T) {
 	expiration := time.Millisecond * 3
 	cache := NewCache(expiration)
-	count := 0
-	cache.OnExpired(func() { count++ })
+	var count int32
+	cache.OnExpired(func() { atomic.AddInt32(&count, 1) })
 	stopJanitor(cache)
 
 	time.Sleep(expiration)
-	assert.Equal(t, 0, count)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&count))
 }
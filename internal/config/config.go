@@ -0,0 +1,319 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bepass-org/dnsutils/internal/proxy"
+	"github.com/bepass-org/dnsutils/internal/statute"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is a validated resolver configuration.
+type Config struct {
+	Upstreams  []string
+	Bootstrap  Bootstrap
+	Routes     []Route
+	Hosts      map[string][]string
+	Cache      Cache
+	Timeout    time.Duration
+	UseIPv4    bool
+	UseIPv6    bool
+	Prefer     string
+	Ndots      int
+	SearchList []string
+	TLS        TLS
+	Proxy      string
+}
+
+// Bootstrap holds the sources used to resolve upstream server hostnames.
+type Bootstrap struct {
+	Servers []string
+	Hosts   map[string][]string
+}
+
+// Route sends the queries for Domains, and their subdomains, to Upstream.
+type Route struct {
+	Domains  []string
+	Upstream string
+}
+
+// Cache holds the answer cache settings.
+type Cache struct {
+	Disabled bool
+	TTL      time.Duration
+}
+
+// TLS holds the settings for TLS based upstreams.
+type TLS struct {
+	Hostname           string
+	InsecureSkipVerify bool
+}
+
+// Error is a configuration error, pointing at the offending line if known.
+type Error struct {
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("config: line %d: %s", e.Line, e.Msg)
+	}
+	return "config: " + e.Msg
+}
+
+// value is a scalar remembering the line it was defined at, so that
+// validation errors can point at it.
+type value struct {
+	Value string
+	Line  int
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (v *value) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.ScalarNode {
+		return &Error{Line: node.Line, Msg: "expected a scalar value"}
+	}
+	v.Value, v.Line = node.Value, node.Line
+	return nil
+}
+
+// rawConfig mirrors the file layout.
+type rawConfig struct {
+	Upstreams  []value            `yaml:"upstreams"`
+	Bootstrap  rawBootstrap       `yaml:"bootstrap"`
+	Routes     []rawRoute         `yaml:"routes"`
+	Hosts      map[string][]value `yaml:"hosts"`
+	Cache      rawCache           `yaml:"cache"`
+	Timeout    value              `yaml:"timeout"`
+	UseIPv4    bool               `yaml:"ipv4"`
+	UseIPv6    bool               `yaml:"ipv6"`
+	Prefer     value              `yaml:"prefer"`
+	Ndots      value              `yaml:"ndots"`
+	SearchList []string           `yaml:"search_list"`
+	TLS        rawTLS             `yaml:"tls"`
+	Proxy      value              `yaml:"proxy"`
+}
+
+type rawBootstrap struct {
+	Servers []value            `yaml:"servers"`
+	Hosts   map[string][]value `yaml:"hosts"`
+}
+
+type rawRoute struct {
+	Domains  []value `yaml:"domains"`
+	Upstream value   `yaml:"upstream"`
+}
+
+type rawCache struct {
+	Disabled bool  `yaml:"disabled"`
+	TTL      value `yaml:"ttl"`
+}
+
+type rawTLS struct {
+	Hostname           string `yaml:"hostname"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// lineMessage splits a yaml decoder error into its line number and message.
+var lineMessage = regexp.MustCompile(`^line (\d+): (.*?)(?: in type \S+)?$`)
+
+// Load reads and parses the configuration file at path.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse parses a YAML or JSON configuration. Unknown fields are rejected, and
+// all validation errors are reported together with their line numbers.
+func Parse(data []byte) (*Config, error) {
+	var raw rawConfig
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&raw); err != nil {
+		return nil, decodeError(err)
+	}
+
+	v := &validator{}
+	cfg := v.validate(&raw)
+	if len(v.errs) > 0 {
+		return nil, errors.Join(v.errs...)
+	}
+	return cfg, nil
+}
+
+// decodeError converts a yaml decoding error into configuration errors.
+func decodeError(err error) error {
+	if errors.Is(err, io.EOF) {
+		return &Error{Msg: "configuration is empty"}
+	}
+	var cfgErr *Error
+	if errors.As(err, &cfgErr) {
+		return cfgErr
+	}
+	var typeErr *yaml.TypeError
+	if !errors.As(err, &typeErr) {
+		return lineError(strings.TrimPrefix(err.Error(), "yaml: "))
+	}
+	errs := make([]error, 0, len(typeErr.Errors))
+	for _, e := range typeErr.Errors {
+		errs = append(errs, lineError(e))
+	}
+	return errors.Join(errs...)
+}
+
+// lineError turns a "line N: message" string from the yaml decoder into an
+// Error.
+func lineError(s string) *Error {
+	m := lineMessage.FindStringSubmatch(s)
+	if m == nil {
+		return &Error{Msg: s}
+	}
+	line, _ := strconv.Atoi(m[1])
+	return &Error{Line: line, Msg: m[2]}
+}
+
+// validator accumulates validation errors.
+type validator struct {
+	errs []error
+}
+
+func (v *validator) errorf(line int, format string, args ...interface{}) {
+	v.errs = append(v.errs, &Error{Line: line, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) validate(raw *rawConfig) *Config {
+	cfg := &Config{
+		Hosts:      v.hosts(raw.Hosts),
+		UseIPv4:    raw.UseIPv4,
+		UseIPv6:    raw.UseIPv6,
+		Ndots:      1,
+		SearchList: raw.SearchList,
+		TLS: TLS{
+			Hostname:           raw.TLS.Hostname,
+			InsecureSkipVerify: raw.TLS.InsecureSkipVerify,
+		},
+	}
+
+	if len(raw.Upstreams) == 0 {
+		v.errorf(0, "at least one upstream is required")
+	}
+	for _, u := range raw.Upstreams {
+		cfg.Upstreams = append(cfg.Upstreams, v.upstream(u))
+	}
+
+	for _, s := range raw.Bootstrap.Servers {
+		if !isIPAddr(s.Value) {
+			v.errorf(s.Line, "bootstrap server %q must be an IP address", s.Value)
+		}
+		cfg.Bootstrap.Servers = append(cfg.Bootstrap.Servers, s.Value)
+	}
+	cfg.Bootstrap.Hosts = v.hosts(raw.Bootstrap.Hosts)
+
+	for _, r := range raw.Routes {
+		route := Route{Upstream: v.upstream(r.Upstream)}
+		if len(r.Domains) == 0 {
+			v.errorf(r.Upstream.Line, "route has no domains")
+		}
+		for _, d := range r.Domains {
+			if d.Value == "" {
+				v.errorf(d.Line, "empty route domain")
+			}
+			route.Domains = append(route.Domains, d.Value)
+		}
+		cfg.Routes = append(cfg.Routes, route)
+	}
+
+	cfg.Cache.Disabled = raw.Cache.Disabled
+	cfg.Cache.TTL = v.duration(raw.Cache.TTL, "cache ttl")
+	cfg.Timeout = v.duration(raw.Timeout, "timeout")
+
+	switch raw.Prefer.Value {
+	case "", "ipv4", "ipv6":
+		cfg.Prefer = raw.Prefer.Value
+	default:
+		v.errorf(raw.Prefer.Line, "prefer must be ipv4 or ipv6, got %q", raw.Prefer.Value)
+	}
+
+	if raw.Proxy.Value != "" {
+		if _, err := proxy.Parse(raw.Proxy.Value, nil); err != nil {
+			v.errorf(raw.Proxy.Line, "invalid proxy %q: %s", raw.Proxy.Value, err)
+		}
+		cfg.Proxy = raw.Proxy.Value
+	}
+
+	if raw.Ndots.Value != "" {
+		ndots, err := strconv.Atoi(raw.Ndots.Value)
+		switch {
+		case err != nil:
+			v.errorf(raw.Ndots.Line, "invalid ndots %q", raw.Ndots.Value)
+		case ndots < 0:
+			v.errorf(raw.Ndots.Line, "ndots must not be negative")
+		default:
+			cfg.Ndots = ndots
+		}
+	}
+
+	return cfg
+}
+
+func (v *validator) upstream(u value) string {
+	if u.Value == "" {
+		v.errorf(u.Line, "missing upstream")
+	} else if statute.GetDNSType(u.Value) == "unknown" {
+		v.errorf(u.Line, "unsupported upstream %q", u.Value)
+	}
+	return u.Value
+}
+
+func (v *validator) hosts(raw map[string][]value) map[string][]string {
+	names := make([]string, 0, len(raw))
+	for host := range raw {
+		names = append(names, host)
+	}
+	sort.Strings(names)
+
+	hosts := make(map[string][]string, len(raw))
+	for _, host := range names {
+		for _, ip := range raw[host] {
+			if net.ParseIP(ip.Value) == nil {
+				v.errorf(ip.Line, "invalid IP address %q for host %s", ip.Value, host)
+			}
+			hosts[host] = append(hosts[host], ip.Value)
+		}
+	}
+	return hosts
+}
+
+func (v *validator) duration(d value, name string) time.Duration {
+	if d.Value == "" {
+		return 0
+	}
+	parsed, err := time.ParseDuration(d.Value)
+	if err != nil || parsed < 0 {
+		v.errorf(d.Line, "invalid %s %q", name, d.Value)
+		return 0
+	}
+	return parsed
+}
+
+// isIPAddr reports whether s is an IP address with an optional port.
+func isIPAddr(s string) bool {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return net.ParseIP(s) != nil
+}
@@ -0,0 +1,91 @@
+package config
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	yamlConfig := `
+upstreams:
+  - https://1.1.1.1/dns-query
+  - udp://8.8.8.8:53
+bootstrap:
+  servers: [9.9.9.9]
+routes:
+  - domains: [corp.example]
+    upstream: tcp://10.0.0.1:53
+hosts:
+  router.lan: [192.168.1.1]
+cache:
+  ttl: 30m
+timeout: 5s
+ndots: 2
+prefer: ipv4
+proxy: socks5://127.0.0.1:1080
+`
+	jsonConfig := `{"upstreams": ["udp://8.8.8.8:53"], "cache": {"disabled": true}}`
+
+	cfg, err := Parse([]byte(yamlConfig))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"https://1.1.1.1/dns-query", "udp://8.8.8.8:53"}, cfg.Upstreams)
+	assert.Equal(t, []string{"9.9.9.9"}, cfg.Bootstrap.Servers)
+	assert.Equal(t, []Route{{Domains: []string{"corp.example"}, Upstream: "tcp://10.0.0.1:53"}}, cfg.Routes)
+	assert.Equal(t, map[string][]string{"router.lan": {"192.168.1.1"}}, cfg.Hosts)
+	assert.Equal(t, 30*time.Minute, cfg.Cache.TTL)
+	assert.Equal(t, 5*time.Second, cfg.Timeout)
+	assert.Equal(t, 2, cfg.Ndots)
+	assert.Equal(t, "ipv4", cfg.Prefer)
+	assert.Equal(t, "socks5://127.0.0.1:1080", cfg.Proxy)
+
+	cfg, err = Parse([]byte(jsonConfig))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"udp://8.8.8.8:53"}, cfg.Upstreams)
+	assert.True(t, cfg.Cache.Disabled)
+	assert.Equal(t, 1, cfg.Ndots)
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		lines []int
+	}{
+		{"", []int{0}},
+		{"upstreams: [", []int{1}},
+		{"upstreams: [udp://8.8.8.8]\nunknown: 1\n", []int{2}},
+		{"upstreams:\n  - ftp://example.com\n", []int{2}},
+		{"upstreams: [udp://8.8.8.8]\ntimeout: soon\nprefer: ipv5\n", []int{2, 3}},
+		{"upstreams: [udp://8.8.8.8]\nhosts:\n  a.lan: [1.2.3.4, nope]\n", []int{3}},
+		{"upstreams: [udp://8.8.8.8]\nbootstrap:\n  servers:\n    - dns.example\n", []int{4}},
+		{"upstreams: [udp://8.8.8.8]\nroutes:\n  - upstream: udp://1.1.1.1\n", []int{3}},
+		{"upstreams: [udp://8.8.8.8]\nndots: [1]\n", []int{2}},
+		{"upstreams: [udp://8.8.8.8]\nipv4: true\nndots: -1\n", []int{3}},
+		{"upstreams: [udp://8.8.8.8]\nproxy: ftp://127.0.0.1\n", []int{2}},
+	}
+	for i, test := range tests {
+		_, err := Parse([]byte(test.input))
+		if !assert.NotNil(t, err, "test %d", i) {
+			continue
+		}
+
+		var lines []int
+		for _, e := range unwrap(err) {
+			var cfgErr *Error
+			if assert.True(t, errors.As(e, &cfgErr), "test %d: %v", i, e) {
+				lines = append(lines, cfgErr.Line)
+			}
+		}
+		assert.Equal(t, test.lines, lines, "test %d: %v", i, err)
+	}
+}
+
+// unwrap flattens errors joined with errors.Join.
+func unwrap(err error) []error {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
@@ -0,0 +1,329 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// bootstrapMinTTL is the shortest time a bootstrapped address is cached for,
+// so that upstreams answering with a zero TTL are not queried on every dial.
+const bootstrapMinTTL = 10 * time.Second
+
+// ErrNoBootstrapAddress is returned when a hostname could not be resolved by
+// any of the bootstrap sources.
+var ErrNoBootstrapAddress = errors.New("bootstrap: no address found")
+
+// bootstrapEntry is a cached bootstrap resolution result.
+type bootstrapEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// Bootstrap resolves the hostnames of upstream DNS servers without going
+// through the operating system resolver. Static hosts are consulted first,
+// then the plain DNS servers are queried and the answers are cached for
+// their TTL.
+type Bootstrap struct {
+	// Timeout is the timeout for a single bootstrap query.
+	Timeout time.Duration
+
+	mu       sync.Mutex
+	dialFunc TDialerFunc
+	servers  []string
+	hosts    map[string][]net.IP
+	pins     map[string][][]byte
+	cache    map[string]bootstrapEntry
+}
+
+// NewBootstrap creates a Bootstrap without any sources. dialFunc is used to
+// reach the bootstrap servers; if nil, a net.Dialer is used.
+func NewBootstrap(timeout time.Duration, dialFunc TDialerFunc) *Bootstrap {
+	return &Bootstrap{
+		Timeout:  timeout,
+		dialFunc: dialFunc,
+		hosts:    map[string][]net.IP{},
+		pins:     map[string][][]byte{},
+		cache:    map[string]bootstrapEntry{},
+	}
+}
+
+// SetDialFunc replaces the dialer function used to reach the bootstrap
+// servers.
+func (b *Bootstrap) SetDialFunc(dialFunc TDialerFunc) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dialFunc = dialFunc
+}
+
+// AddServer adds a plain DNS server, given as "ip" or "ip:port".
+func (b *Bootstrap) AddServer(server string) error {
+	server = strings.TrimPrefix(server, "udp://")
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		host, port = server, "53"
+	}
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("bootstrap server %q is not an IP address", server)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.servers = append(b.servers, net.JoinHostPort(host, port))
+	return nil
+}
+
+// AddHost statically maps a hostname to a list of IP addresses.
+func (b *Bootstrap) AddHost(host string, ips []string) error {
+	parsed := make([]net.IP, 0, len(ips))
+	for _, s := range ips {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return fmt.Errorf("bootstrap host %s: invalid IP address %q", host, s)
+		}
+		parsed = append(parsed, ip)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.hosts[canonicalHost(host)] = parsed
+	return nil
+}
+
+// AddPins requires the certificate chain of host to hold one of the TBS
+// certificates with the given SHA-256 hashes, on the connections of TLS
+// dialers wrapped by Wrap.
+func (b *Bootstrap) AddPins(host string, hashes [][]byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pins[canonicalHost(host)] = hashes
+}
+
+// Resolve returns the IP addresses of host. IP literals are returned as is.
+func (b *Bootstrap) Resolve(ctx context.Context, host string) ([]net.IP, error) {
+	host = canonicalHost(host)
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	b.mu.Lock()
+	if ips, ok := b.hosts[host]; ok {
+		b.mu.Unlock()
+		return ips, nil
+	}
+	entry, cached := b.cache[host]
+	servers, dialFunc := b.servers, b.dialFunc
+	b.mu.Unlock()
+
+	if cached && time.Now().Before(entry.expires) {
+		return entry.ips, nil
+	}
+
+	ips, ttl, err := b.lookup(ctx, dialFunc, servers, host)
+	if err != nil {
+		// Serve the expired answer rather than failing the dial outright.
+		if cached {
+			return entry.ips, nil
+		}
+		return nil, err
+	}
+
+	if ttl < bootstrapMinTTL {
+		ttl = bootstrapMinTTL
+	}
+	b.mu.Lock()
+	b.cache[host] = bootstrapEntry{ips: ips, expires: time.Now().Add(ttl)}
+	b.mu.Unlock()
+
+	return ips, nil
+}
+
+// Wrap returns a dialer function that resolves the host part of the address
+// through the bootstrap before handing each candidate IP to dial. The
+// original hostname and its pins are kept in the context for TLS dialers,
+// see ServerName and Pins. Without bootstrap servers, hostnames missing from
+// the static hosts are handed to dial as is.
+func (b *Bootstrap) Wrap(dial TDialerFunc) TDialerFunc {
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+
+		b.mu.Lock()
+		pins := b.pins[canonicalHost(host)]
+		_, static := b.hosts[canonicalHost(host)]
+		noServers := len(b.servers) == 0
+		b.mu.Unlock()
+		if len(pins) > 0 {
+			ctx = WithPins(ctx, pins)
+		}
+		// Without servers, only the static hosts are bootstrapped, the
+		// others are left to dial.
+		if !static && noServers {
+			return dial(ctx, network, addr)
+		}
+
+		ips, err := b.Resolve(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+
+		ctx = WithServerName(ctx, host)
+		err = ErrNoBootstrapAddress
+		for _, ip := range ips {
+			if !networkAccepts(network, ip) {
+				continue
+			}
+			var conn net.Conn
+			conn, err = dial(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+// lookup queries the bootstrap servers for the A and AAAA records of host and
+// returns the addresses along with the smallest TTL among them.
+func (b *Bootstrap) lookup(ctx context.Context, dialFunc TDialerFunc, servers []string, host string) ([]net.IP, time.Duration, error) {
+	if len(servers) == 0 {
+		return nil, 0, fmt.Errorf("%w for %s", ErrNoBootstrapAddress, host)
+	}
+
+	var lastErr error
+	for _, server := range servers {
+		var (
+			ips    []net.IP
+			minTTL uint32
+		)
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			msg := new(dns.Msg)
+			msg.SetQuestion(dns.Fqdn(host), qtype)
+			in, err := b.exchange(ctx, dialFunc, server, msg)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			for _, rr := range in.Answer {
+				var ip net.IP
+				switch v := rr.(type) {
+				case *dns.A:
+					ip = v.A
+				case *dns.AAAA:
+					ip = v.AAAA
+				default:
+					continue
+				}
+				if len(ips) == 0 || rr.Header().Ttl < minTTL {
+					minTTL = rr.Header().Ttl
+				}
+				ips = append(ips, ip)
+			}
+		}
+		if len(ips) > 0 {
+			return ips, time.Duration(minTTL) * time.Second, nil
+		}
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("%w for %s", ErrNoBootstrapAddress, host)
+	}
+	return nil, 0, lastErr
+}
+
+// exchange sends msg to server over UDP, or over TCP if the response is
+// truncated or UDP can't be dialed, as through HTTP proxies. It fails unless
+// the response is successful.
+func (b *Bootstrap) exchange(ctx context.Context, dialFunc TDialerFunc, server string, msg *dns.Msg) (*dns.Msg, error) {
+	network := "udp"
+	conn, err := b.dial(ctx, dialFunc, network, server)
+	if err != nil {
+		network = "tcp"
+		conn, err = b.dial(ctx, dialFunc, network, server)
+	}
+	if err != nil {
+		return nil, err
+	}
+	in, err := b.exchangeOver(conn, msg)
+	if err == nil && in.Truncated && network == "udp" {
+		if conn, err = b.dial(ctx, dialFunc, "tcp", server); err == nil {
+			in, err = b.exchangeOver(conn, msg)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if in.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("bootstrap: %s from %s for %s", dns.RcodeToString[in.Rcode], server, msg.Question[0].Name)
+	}
+	return in, nil
+}
+
+// dial connects to server over network.
+func (b *Bootstrap) dial(ctx context.Context, dialFunc TDialerFunc, network, server string) (net.Conn, error) {
+	if dialFunc != nil {
+		return dialFunc(ctx, network, server)
+	}
+	return (&net.Dialer{Timeout: b.Timeout}).DialContext(ctx, network, server)
+}
+
+// exchangeOver sends msg over conn, which it closes, and waits for the
+// matching reply. Replies to other queries, such as late ones, are skipped.
+func (b *Bootstrap) exchangeOver(conn net.Conn, msg *dns.Msg) (*dns.Msg, error) {
+	co := &dns.Conn{Conn: conn}
+	defer co.Close()
+
+	if b.Timeout > 0 {
+		_ = co.SetDeadline(time.Now().Add(b.Timeout))
+	}
+	if err := co.WriteMsg(msg); err != nil {
+		return nil, err
+	}
+	for {
+		p, err := co.ReadMsgHeader(nil)
+		if err != nil {
+			return nil, err
+		}
+		in := new(dns.Msg)
+		if in.Unpack(p) == nil && in.Id == msg.Id && sameQuestion(in, msg) {
+			return in, nil
+		}
+	}
+}
+
+// sameQuestion reports whether resp answers the question of query.
+func sameQuestion(resp, query *dns.Msg) bool {
+	if len(resp.Question) != 1 || len(query.Question) != 1 {
+		return false
+	}
+	a, b := resp.Question[0], query.Question[0]
+	return a.Qtype == b.Qtype && a.Qclass == b.Qclass && strings.EqualFold(a.Name, b.Name)
+}
+
+// canonicalHost lower-cases host and strips the trailing dot.
+func canonicalHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// networkAccepts reports whether ip can be dialed on the given network.
+func networkAccepts(network string, ip net.IP) bool {
+	switch {
+	case strings.HasSuffix(network, "4"):
+		return ip.To4() != nil
+	case strings.HasSuffix(network, "6"):
+		return ip.To4() == nil
+	default:
+		return true
+	}
+}
@@ -0,0 +1,171 @@
+package dialer
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// startBootstrapServer serves A records for dns.example. and counts queries.
+func startBootstrapServer(t *testing.T, ttl uint32) (string, *int32) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var queries int32
+	srv := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			atomic.AddInt32(&queries, 1)
+			m := new(dns.Msg)
+			m.SetReply(r)
+			if r.Question[0].Qtype == dns.TypeA && r.Question[0].Name == "dns.example." {
+				m.Answer = append(m.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: "dns.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+					A:   net.ParseIP("127.0.0.1"),
+				})
+			}
+			_ = w.WriteMsg(m)
+		}),
+	}
+	go func() { _ = srv.ActivateAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+	return pc.LocalAddr().String(), &queries
+}
+
+func TestBootstrapResolve(t *testing.T) {
+	addr, queries := startBootstrapServer(t, 300)
+
+	b := NewBootstrap(time.Second, nil)
+	assert.Nil(t, b.AddServer(addr))
+	assert.Nil(t, b.AddHost("static.example", []string{"192.0.2.1"}))
+	assert.NotNil(t, b.AddServer("dns.example:53"))
+
+	tests := []struct {
+		host string
+		exp  string
+	}{
+		{"dns.example", "127.0.0.1"},
+		{"DNS.example.", "127.0.0.1"},
+		{"static.example", "192.0.2.1"},
+		{"203.0.113.7", "203.0.113.7"},
+	}
+	for i, test := range tests {
+		ips, err := b.Resolve(context.Background(), test.host)
+		assert.Nil(t, err, "test %d", i)
+		if assert.Len(t, ips, 1, "test %d", i) {
+			assert.Equal(t, test.exp, ips[0].String(), "test %d", i)
+		}
+	}
+
+	// A and AAAA for the first lookup, the second one is served from cache.
+	assert.Equal(t, int32(2), atomic.LoadInt32(queries))
+
+	_, err := b.Resolve(context.Background(), "missing.example")
+	assert.ErrorIs(t, err, ErrNoBootstrapAddress)
+}
+
+func TestBootstrapWrap(t *testing.T) {
+	addr, _ := startBootstrapServer(t, 0)
+
+	b := NewBootstrap(time.Second, nil)
+	assert.Nil(t, b.AddServer(addr))
+
+	b.AddPins("DNS.example", [][]byte{{1, 2, 3}})
+
+	var (
+		dialed, serverName string
+		pins               [][]byte
+	)
+	dial := b.Wrap(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = addr
+		serverName = ServerName(ctx, addr)
+		pins = Pins(ctx)
+		c1, c2 := net.Pipe()
+		_ = c2.Close()
+		return c1, nil
+	})
+
+	conn, err := dial(context.Background(), "tcp", "dns.example:853")
+	assert.Nil(t, err)
+	_ = conn.Close()
+	assert.Equal(t, "127.0.0.1:853", dialed)
+	assert.Equal(t, "dns.example", serverName)
+	assert.Equal(t, [][]byte{{1, 2, 3}}, pins)
+
+	_, err = dial(context.Background(), "tcp6", "dns.example:853")
+	assert.ErrorIs(t, err, ErrNoBootstrapAddress)
+
+	// Without servers, hostnames missing from the static hosts are dialed
+	// as is.
+	b = NewBootstrap(time.Second, nil)
+	assert.Nil(t, b.AddHost("static.example", []string{"192.0.2.1"}))
+	dial = b.Wrap(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = addr
+		return nil, ErrNoBootstrapAddress
+	})
+	for _, addr := range []string{"static.example:853", "other.example:853"} {
+		_, _ = dial(context.Background(), "tcp", addr)
+	}
+	assert.Equal(t, "other.example:853", dialed)
+	_, _ = dial(context.Background(), "tcp", "static.example:853")
+	assert.Equal(t, "192.0.2.1:853", dialed)
+}
+
+// startTruncatingServer answers each query over UDP with a reply to another
+// query, a reply to another question and a truncated reply, in that order,
+// and with the address of dns.example. over TCP on the same port.
+func startTruncatingServer(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if w.LocalAddr().Network() == "udp" {
+			stray := m.Copy()
+			stray.Id++
+			_ = w.WriteMsg(stray)
+			other := m.Copy()
+			other.Question[0].Name = "other.example."
+			_ = w.WriteMsg(other)
+			m.Truncated = true
+		} else if r.Question[0].Qtype == dns.TypeA {
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: "dns.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.ParseIP("127.0.0.1"),
+			})
+		}
+		_ = w.WriteMsg(m)
+	}
+	for _, srv := range []*dns.Server{
+		{PacketConn: pc, Handler: dns.HandlerFunc(reply)},
+		{Listener: ln, Handler: dns.HandlerFunc(reply)},
+	} {
+		srv := srv
+		go func() { _ = srv.ActivateAndServe() }()
+		t.Cleanup(func() { _ = srv.Shutdown() })
+	}
+	return pc.LocalAddr().String()
+}
+
+func TestBootstrapExchange(t *testing.T) {
+	b := NewBootstrap(time.Second, nil)
+	assert.Nil(t, b.AddServer(startTruncatingServer(t)))
+
+	ips, err := b.Resolve(context.Background(), "dns.example")
+	assert.Nil(t, err)
+	if assert.Len(t, ips, 1) {
+		assert.Equal(t, "127.0.0.1", ips[0].String())
+	}
+}
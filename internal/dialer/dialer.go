@@ -6,14 +6,48 @@ import (
 	"time"
 )
 
+// serverNameKey is the context key under which WithServerName stores the TLS
+// server name.
+type serverNameKey struct{}
+
+// pinsKey is the context key under which WithPins stores the certificate
+// hashes.
+type pinsKey struct{}
+
 // TDialerFunc is a type definition for dialer functions.
 type TDialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
 
-// RawDialFunc is the raw dialer function.
-var RawDialFunc TDialerFunc
+// WithServerName returns a copy of ctx carrying the hostname a TLS dialer must
+// verify, for when the dialed address has already been resolved to an IP.
+func WithServerName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, serverNameKey{}, name)
+}
+
+// ServerName returns the TLS server name for addr, preferring the one carried
+// by ctx over the host part of addr.
+func ServerName(ctx context.Context, addr string) string {
+	if name, ok := ctx.Value(serverNameKey{}).(string); ok && name != "" {
+		return name
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// WithPins returns a copy of ctx carrying the SHA-256 hashes of the TBS
+// certificates a TLS dialer must find in the chain of the server, as in DNS
+// stamps.
+func WithPins(ctx context.Context, hashes [][]byte) context.Context {
+	return context.WithValue(ctx, pinsKey{}, hashes)
+}
 
-// TLSDialFunc is the TLS dialer function.
-var TLSDialFunc TDialerFunc
+// Pins returns the certificate hashes carried by ctx, if any.
+func Pins(ctx context.Context) [][]byte {
+	hashes, _ := ctx.Value(pinsKey{}).([][]byte)
+	return hashes
+}
 
 // DialerType represents the type of dialer.
 type DialerType int
@@ -42,6 +76,8 @@ type CustomDialer interface {
 type appDialer struct {
 	Timeout    time.Duration
 	DialerType DialerType
+	// DialFunc establishes the connections. If nil, net.DialTimeout is used.
+	DialFunc TDialerFunc
 }
 
 // GetTimeout returns the timeout duration for the dialer.
@@ -61,16 +97,8 @@ func (d *appDialer) GetDialerType() DialerType {
 
 // DialContext implements the CustomDialer interface's Dial method.
 func (d *appDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
-	var dialFunc TDialerFunc
-
-	if d.DialerType == RawDialer {
-		dialFunc = RawDialFunc
-	} else if d.DialerType == TLSDialer {
-		dialFunc = TLSDialFunc
-	}
-
-	if dialFunc != nil {
-		return dialFunc(ctx, network, address)
+	if d.DialFunc != nil {
+		return d.DialFunc(ctx, network, address)
 	}
 
 	conn, err := net.DialTimeout(network, address, d.Timeout)
@@ -89,11 +117,13 @@ type AppDialer struct {
 	appDialer
 }
 
-func NewAppDialer(timeout time.Duration) *AppDialer {
+// NewAppDialer creates an AppDialer establishing connections with dialFunc.
+func NewAppDialer(timeout time.Duration, dialFunc TDialerFunc) *AppDialer {
 	return &AppDialer{
 		appDialer{
 			Timeout:    timeout,
 			DialerType: RawDialer,
+			DialFunc:   dialFunc,
 		},
 	}
 }
@@ -103,11 +133,14 @@ type AppTLSDialer struct {
 	appDialer
 }
 
-func NewAppTLSDialer(timeout time.Duration) *AppTLSDialer {
+// NewAppTLSDialer creates an AppTLSDialer establishing TLS connections with
+// dialFunc.
+func NewAppTLSDialer(timeout time.Duration, dialFunc TDialerFunc) *AppTLSDialer {
 	return &AppTLSDialer{
 		appDialer{
 			Timeout:    timeout,
 			DialerType: TLSDialer,
+			DialFunc:   dialFunc,
 		},
 	}
 }
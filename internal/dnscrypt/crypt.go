@@ -8,6 +8,7 @@ import (
 	"github.com/bepass-org/dnsutils/internal/dialer"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/AdguardTeam/golibs/errors"
@@ -25,6 +26,34 @@ type Client struct {
 	// UDPSize is the maximum size of a DNS response (or query) this client can
 	// sent or receive. If not set, we use dns.MinMsgSize by default.
 	UDPSize int
+
+	// RelayAddr is the address of an Anonymized DNSCrypt relay the queries
+	// and certificate requests are sent through, so that servers never see
+	// the client address. See RelayAddress for relay stamps.
+	RelayAddr string
+
+	// IdleTimeout is how long TCP connections are kept open for reuse,
+	// defaultClientIdleTimeout if not set.
+	IdleTimeout time.Duration
+
+	mu     sync.Mutex
+	idle   map[string][]*pooledConn // idle TCP connections by address
+	closed bool
+}
+
+const (
+	// maxIdleConns is the number of idle TCP connections kept per address.
+	maxIdleConns = 4
+	// defaultClientIdleTimeout is the default Client.IdleTimeout, below
+	// the one of Server so that reused connections are rarely closed.
+	defaultClientIdleTimeout = 20 * time.Second
+)
+
+// pooledConn is an idle TCP connection, closed by its timer unless reused
+// in time.
+type pooledConn struct {
+	conn  net.Conn
+	timer *time.Timer
 }
 
 // ResolverInfo contains DNSCrypt resolver information necessary for decryption/encryption
@@ -40,6 +69,20 @@ type ResolverInfo struct {
 	SharedKey    [keySize]byte // Shared key that is to be used to encrypt/decrypt messages
 }
 
+// Rekey returns a copy of the resolver information with a new client key
+// pair, so that the next queries can't be linked to the previous ones by
+// the key.
+func (ri *ResolverInfo) Rekey() (*ResolverInfo, error) {
+	info := *ri
+	info.SecretKey, info.PublicKey = generateRandomKeyPair()
+	sharedKey, err := computeSharedKey(ri.ResolverCert.EsVersion, &info.SecretKey, &ri.ResolverCert.ResolverPk)
+	if err != nil {
+		return nil, err
+	}
+	info.SharedKey = sharedKey
+	return &info, nil
+}
+
 // Dial fetches and validates DNSCrypt certificate from the given server
 // Data received during this call is then used for DNS requests encryption/decryption
 // stampStr is an sdns:// address which is parsed using go-dnsstamps package
@@ -89,27 +132,30 @@ func (c *Client) DialStamp(stamp dnsstamps.ServerStamp) (*ResolverInfo, error) {
 }
 
 // Exchange performs a synchronous DNS query to the specified DNSCrypt server and returns a DNS response.
-// This method creates a new network connection for every call so avoid using it for TCP.
+// Over UDP, truncated responses are queried again over TCP. TCP connections are
+// kept open and reused by the next calls.
 // DNSCrypt cert needs to be fetched and validated prior to this call using the c.DialStamp method.
-func (c *Client) Exchange(m *dns.Msg, resolverInfo *ResolverInfo) (resp *dns.Msg, err error) {
-	network := "udp"
+func (c *Client) Exchange(m *dns.Msg, resolverInfo *ResolverInfo) (*dns.Msg, error) {
 	if c.Net == "tcp" {
-		network = "tcp"
+		return c.exchangeTCP(m, resolverInfo)
 	}
-	var conn net.Conn
-
-	if c.DialerFunc == nil {
-		conn, err = net.Dial(network, resolverInfo.ServerAddress)
-	} else {
-		conn, err = c.DialerFunc(context.Background(), network, resolverInfo.ServerAddress)
+	resp, err := c.exchangeUDP(m, resolverInfo)
+	if err == nil && resp.Truncated {
+		log.Debug("[%v] truncated response, retrying over tcp", resolverInfo.ProviderName)
+		return c.exchangeTCP(m, resolverInfo)
 	}
+	return resp, err
+}
 
+// exchangeUDP sends m over a new UDP connection.
+func (c *Client) exchangeUDP(m *dns.Msg, resolverInfo *ResolverInfo) (resp *dns.Msg, err error) {
+	conn, err := c.dial("udp", resolverInfo.ServerAddress)
 	if err != nil {
 		return nil, fmt.Errorf("dialing: %w", err)
 	}
 	defer func() { err = errors.WithDeferred(err, conn.Close()) }()
 
-	resp, err = c.ExchangeConn(conn, m, resolverInfo)
+	resp, err = c.exchangeConn(conn, "udp", m, resolverInfo)
 	if err != nil {
 		return nil, fmt.Errorf("exchanging: %w", err)
 	}
@@ -117,20 +163,150 @@ func (c *Client) Exchange(m *dns.Msg, resolverInfo *ResolverInfo) (resp *dns.Msg
 	return resp, nil
 }
 
+// exchangeTCP sends m over an idle TCP connection, or a new one if there is
+// none or the server closed it.
+func (c *Client) exchangeTCP(m *dns.Msg, resolverInfo *ResolverInfo) (*dns.Msg, error) {
+	address := c.dialAddress(resolverInfo.ServerAddress)
+	// A failed idle connection may have been closed by the server, so the
+	// query is retried once over a new one.
+	for reuse := true; ; reuse = false {
+		var conn net.Conn
+		reused := false
+		if reuse {
+			conn, reused = c.idleConn(address)
+		}
+		if conn == nil {
+			var err error
+			conn, err = c.dial("tcp", resolverInfo.ServerAddress)
+			if err != nil {
+				return nil, fmt.Errorf("dialing: %w", err)
+			}
+		}
+		resp, err := c.exchangeConn(conn, "tcp", m, resolverInfo)
+		if err != nil {
+			_ = conn.Close()
+			if reused {
+				continue
+			}
+			return nil, fmt.Errorf("exchanging: %w", err)
+		}
+		c.putIdleConn(address, conn)
+		return resp, nil
+	}
+}
+
+// idleConn takes an idle connection to address, if any.
+func (c *Client) idleConn(address string) (net.Conn, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conns := c.idle[address]
+	if len(conns) == 0 {
+		return nil, false
+	}
+	pc := conns[len(conns)-1]
+	c.idle[address] = conns[:len(conns)-1]
+	pc.timer.Stop()
+	return pc.conn, true
+}
+
+// putIdleConn keeps conn to address for the next queries, or closes it if
+// enough are kept already or the client is closed.
+func (c *Client) putIdleConn(address string, conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || len(c.idle[address]) >= maxIdleConns {
+		_ = conn.Close()
+		return
+	}
+	if c.idle == nil {
+		c.idle = map[string][]*pooledConn{}
+	}
+	timeout := c.IdleTimeout
+	if timeout <= 0 {
+		timeout = defaultClientIdleTimeout
+	}
+	pc := &pooledConn{conn: conn}
+	pc.timer = time.AfterFunc(timeout, func() { c.expire(address, pc) })
+	c.idle[address] = append(c.idle[address], pc)
+}
+
+// expire closes pc, an idle connection to address, unless it was taken for
+// reuse meanwhile.
+func (c *Client) expire(address string, pc *pooledConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conns := c.idle[address]
+	for i := range conns {
+		if conns[i] == pc {
+			c.idle[address] = append(conns[:i], conns[i+1:]...)
+			_ = pc.conn.Close()
+			return
+		}
+	}
+}
+
+// Close closes the idle TCP connections. The client can still be used, but
+// no longer keeps connections open.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	for _, conns := range c.idle {
+		for _, pc := range conns {
+			pc.timer.Stop()
+			if closeErr := pc.conn.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	}
+	c.idle = nil
+	c.closed = true
+	return err
+}
+
+// dialAddress returns the address to connect to for the server at address,
+// which is the relay if one is set.
+func (c *Client) dialAddress(address string) string {
+	if c.RelayAddr != "" {
+		return c.RelayAddr
+	}
+	return address
+}
+
+// dial connects to the server at address over network, or to the relay if
+// one is set.
+func (c *Client) dial(network, address string) (net.Conn, error) {
+	address = c.dialAddress(address)
+	if c.DialerFunc == nil {
+		return net.Dial(network, address)
+	}
+	return c.DialerFunc(context.Background(), network, address)
+}
+
 // ExchangeConn performs a synchronous DNS query to the specified DNSCrypt server and returns a DNS response.
 // DNSCrypt server information needs to be fetched and validated prior to this call using the c.DialStamp method
 func (c *Client) ExchangeConn(conn net.Conn, m *dns.Msg, resolverInfo *ResolverInfo) (*dns.Msg, error) {
-	query, err := c.encrypt(m, resolverInfo)
+	return c.exchangeConn(conn, c.network(), m, resolverInfo)
+}
+
+// exchangeConn is ExchangeConn over network, "udp" or "tcp".
+func (c *Client) exchangeConn(conn net.Conn, network string, m *dns.Msg, resolverInfo *ResolverInfo) (*dns.Msg, error) {
+	query, err := c.encrypt(m, network, resolverInfo)
 	if err != nil {
 		return nil, err
 	}
+	if c.RelayAddr != "" {
+		if query, err = anonymize(query, resolverInfo.ServerAddress); err != nil {
+			return nil, err
+		}
+	}
 
-	err = c.writeQuery(conn, query)
+	err = c.writeQuery(conn, network, query)
 	if err != nil {
 		return nil, err
 	}
 
-	b, err := c.readResponse(conn)
+	b, err := c.readResponse(conn, network)
 	if err != nil {
 		return nil, err
 	}
@@ -145,15 +321,16 @@ func (c *Client) ExchangeConn(conn net.Conn, m *dns.Msg, resolverInfo *ResolverI
 
 // writeQuery writes query to the network connection
 // depending on the protocol we may write a 2-byte prefix or not
-func (c *Client) writeQuery(conn net.Conn, query []byte) error {
+func (c *Client) writeQuery(conn net.Conn, network string, query []byte) error {
 	var err error
 
 	if c.Timeout > 0 {
 		_ = conn.SetWriteDeadline(time.Now().Add(c.Timeout))
 	}
 
-	// Write to the connection
-	if _, ok := conn.(*net.TCPConn); ok {
+	// Write to the connection. The protocol is taken from the caller rather
+	// than the connection type, which may be wrapped by a custom dialer.
+	if network == "tcp" {
 		l := make([]byte, 2)
 		binary.BigEndian.PutUint16(l, uint16(len(query)))
 		_, err = (&net.Buffers{l, query}).WriteTo(conn)
@@ -166,17 +343,12 @@ func (c *Client) writeQuery(conn net.Conn, query []byte) error {
 
 // readResponse reads response from the network connection
 // depending on the protocol, we may read a 2-byte prefix or not
-func (c *Client) readResponse(conn net.Conn) ([]byte, error) {
+func (c *Client) readResponse(conn net.Conn, network string) ([]byte, error) {
 	if c.Timeout > 0 {
 		_ = conn.SetReadDeadline(time.Now().Add(c.Timeout))
 	}
 
-	proto := "udp"
-	if _, ok := conn.(*net.TCPConn); ok {
-		proto = "tcp"
-	}
-
-	if proto == "udp" {
+	if network != "tcp" {
 		bufSize := c.UDPSize
 		if bufSize == 0 {
 			bufSize = dns.MinMsgSize
@@ -195,7 +367,7 @@ func (c *Client) readResponse(conn net.Conn) ([]byte, error) {
 }
 
 // encrypt encrypts a DNS message using shared key from the resolver info
-func (c *Client) encrypt(m *dns.Msg, resolverInfo *ResolverInfo) ([]byte, error) {
+func (c *Client) encrypt(m *dns.Msg, network string, resolverInfo *ResolverInfo) ([]byte, error) {
 	q := EncryptedQuery{
 		EsVersion:   resolverInfo.ResolverCert.EsVersion,
 		ClientMagic: resolverInfo.ResolverCert.ClientMagic,
@@ -206,7 +378,7 @@ func (c *Client) encrypt(m *dns.Msg, resolverInfo *ResolverInfo) ([]byte, error)
 		return nil, err
 	}
 	b, err := q.Encrypt(query, resolverInfo.SharedKey)
-	if len(b) > c.maxQuerySize() {
+	if len(b) > c.maxQuerySize(network) {
 		return nil, ErrQueryTooLarge
 	}
 
@@ -240,9 +412,19 @@ func (c *Client) fetchCert(stamp dnsstamps.ServerStamp) (cert *Cert, err error)
 
 	query := new(dns.Msg)
 	query.SetQuestion(providerName, dns.TypeTXT)
-	// use 1252 as a UDPSize for this client to make sure the buffer is not too small
-	client := dns.Client{Net: c.Net, UDPSize: uint16(1252), Timeout: c.Timeout}
-	r, _, err := client.Exchange(query, stamp.ServerAddrStr)
+	var r *dns.Msg
+	if c.RelayAddr != "" {
+		r, err = c.exchangeRelay(query, stamp.ServerAddrStr)
+	} else {
+		// use 1252 as a UDPSize for this client to make sure the buffer is not too small
+		client := dns.Client{
+			Net:     c.Net,
+			UDPSize: uint16(1252),
+			Timeout: c.Timeout,
+			Dialer:  dialer.NewAppDialer(c.Timeout, c.DialerFunc),
+		}
+		r, _, err = client.Exchange(query, stamp.ServerAddrStr)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -337,8 +519,16 @@ func parseCert(
 	return cert, nil
 }
 
-func (c *Client) maxQuerySize() int {
+// network returns the protocol of the client, "udp" unless set to "tcp".
+func (c *Client) network() string {
 	if c.Net == "tcp" {
+		return "tcp"
+	}
+	return "udp"
+}
+
+func (c *Client) maxQuerySize(network string) int {
+	if network == "tcp" {
 		return dns.MaxMsgSize
 	}
 
@@ -0,0 +1,101 @@
+package dnscrypt
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientExchange(t *testing.T) {
+	_, _, small := startServer(t, recordsHandler(1))
+	_, _, large := startServer(t, recordsHandler(100))
+
+	tests := []struct {
+		stamp   string
+		net     string
+		answers int
+		// dials are the connections made for the certificate and three
+		// queries.
+		dials map[string]int32
+	}{
+		{small, "udp", 1, map[string]int32{"udp": 4, "tcp": 0}},
+		{small, "tcp", 1, map[string]int32{"udp": 0, "tcp": 2}},
+		// Truncated responses are retried over a reused TCP connection.
+		{large, "udp", 100, map[string]int32{"udp": 4, "tcp": 1}},
+		{large, "tcp", 100, map[string]int32{"udp": 0, "tcp": 2}},
+	}
+	for i, test := range tests {
+		dials := map[string]*atomic.Int32{"udp": {}, "tcp": {}}
+		c := &Client{
+			Net:     test.net,
+			Timeout: time.Second,
+			DialerFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				dials[network].Add(1)
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			},
+		}
+		ri, err := c.Dial(test.stamp)
+		if !assert.Nil(t, err, "test %d", i) {
+			continue
+		}
+		for j := 0; j < 3; j++ {
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+			resp, err := c.Exchange(req, ri)
+			if assert.Nil(t, err, "test %d", i) {
+				assert.False(t, resp.Truncated, "test %d", i)
+				assert.Len(t, resp.Answer, test.answers, "test %d", i)
+			}
+		}
+		for network, n := range test.dials {
+			assert.Equal(t, n, dials[network].Load(), "test %d %s", i, network)
+		}
+		assert.Nil(t, c.Close(), "test %d", i)
+	}
+}
+
+func TestClientIdleConns(t *testing.T) {
+	_, _, stamp := startServer(t, recordsHandler(1))
+
+	var dials atomic.Int32
+	c := &Client{
+		Net:         "tcp",
+		Timeout:     time.Second,
+		IdleTimeout: 50 * time.Millisecond,
+		DialerFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dials.Add(1)
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+	ri, err := c.Dial(stamp)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	tests := []struct {
+		before func()
+		// dials are the connections made so far, including the one for
+		// the certificate.
+		dials int32
+	}{
+		{func() {}, 2},
+		{func() {}, 2},
+		{func() { time.Sleep(100 * time.Millisecond) }, 3},
+		{func() { assert.Nil(t, c.Close()) }, 4},
+		// Closed clients don't keep connections open.
+		{func() {}, 5},
+	}
+	for i, test := range tests {
+		test.before()
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		_, err := c.Exchange(req, ri)
+		assert.Nil(t, err, "test %d", i)
+		assert.Equal(t, test.dials, dials.Load(), "test %d", i)
+	}
+}
@@ -83,6 +83,8 @@ func (rc *ResolverConfig) CreateCert() (*Cert, error) {
 
 	copy(cert.ResolverPk[:], resolverPk[:])
 	copy(cert.ResolverSk[:], resolverSk)
+	// Clients pick the certificate by the first 8 bytes of its public key.
+	copy(cert.ClientMagic[:], resolverPk[:clientMagicSize])
 
 	// private key
 	privateKey, err := HexDecodeKey(rc.PrivateKey)
@@ -0,0 +1,99 @@
+package dnscrypt
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+)
+
+// anonMagic starts the header of the queries sent through Anonymized
+// DNSCrypt relays.
+var anonMagic = [12]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00}
+
+const (
+	// relayStampProto is the protocol of relay stamps, which dnsstamps
+	// doesn't know about.
+	relayStampProto = 0x81
+
+	// defaultRelayPort is the port of relay stamps without one.
+	defaultRelayPort = "443"
+)
+
+// RelayAddress returns the address of an Anonymized DNSCrypt relay given
+// by its sdns:// stamp, or as a host:port address.
+func RelayAddress(relay string) (string, error) {
+	addr := relay
+	if strings.HasPrefix(relay, "sdns://") {
+		// Relay stamps are 0x81 followed by the length-prefixed address.
+		bin, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(relay, "sdns://"))
+		if err != nil || len(bin) < 2 || bin[0] != relayStampProto || int(bin[1]) != len(bin)-2 {
+			return "", ErrInvalidDNSStamp
+		}
+		addr = string(bin[2:])
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), defaultRelayPort)
+	}
+	return addr, nil
+}
+
+// anonymize prepends to packet the header telling the relay where to
+// forward it:
+//
+//	<anon-magic> <server-ip> <server-port> <packet>
+func anonymize(packet []byte, serverAddr string) ([]byte, error) {
+	host, port, err := net.SplitHostPort(serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("relayed server address %q is not an IP address", serverAddr)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("relayed server port %q: %w", port, err)
+	}
+
+	b := make([]byte, 0, len(anonMagic)+net.IPv6len+2+len(packet))
+	b = append(b, anonMagic[:]...)
+	b = append(b, ip.To16()...)
+	b = binary.BigEndian.AppendUint16(b, uint16(p))
+	return append(b, packet...), nil
+}
+
+// exchangeRelay sends the plain DNS query m to the server at serverAddr
+// through the relay, as certificate requests are.
+func (c *Client) exchangeRelay(m *dns.Msg, serverAddr string) (resp *dns.Msg, err error) {
+	packet, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if packet, err = anonymize(packet, serverAddr); err != nil {
+		return nil, err
+	}
+	conn, err := c.dial(c.network(), serverAddr)
+	if err != nil {
+		return nil, fmt.Errorf("dialing relay: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, conn.Close()) }()
+
+	if err = c.writeQuery(conn, c.network(), packet); err != nil {
+		return nil, err
+	}
+	b, err := c.readResponse(conn, c.network())
+	if err != nil {
+		return nil, err
+	}
+	resp = new(dns.Msg)
+	if err = resp.Unpack(b); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
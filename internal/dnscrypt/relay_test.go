@@ -0,0 +1,166 @@
+package dnscrypt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// testRelay stands in for an Anonymized DNSCrypt relay on UDP and TCP,
+// counting the packets it forwards.
+type testRelay struct {
+	forwarded atomic.Int32
+}
+
+// deanonymize strips the relay header from packet and returns the address
+// it is for.
+func deanonymize(packet []byte) (string, []byte, bool) {
+	n := len(anonMagic) + net.IPv6len + 2
+	if len(packet) < n || !bytes.Equal(packet[:len(anonMagic)], anonMagic[:]) {
+		return "", nil, false
+	}
+	ip := net.IP(packet[len(anonMagic) : len(anonMagic)+net.IPv6len])
+	port := binary.BigEndian.Uint16(packet[n-2 : n])
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), packet[n:], true
+}
+
+// start listens on UDP and TCP, and returns the address.
+func (r *testRelay) start(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		pc.Close()
+		l.Close()
+	})
+
+	go func() {
+		b := make([]byte, dns.MaxMsgSize)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			server, packet, ok := deanonymize(b[:n])
+			if !ok {
+				continue
+			}
+			r.forwarded.Add(1)
+			go func() {
+				conn, err := net.Dial("udp", server)
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				_ = conn.SetDeadline(time.Now().Add(time.Second))
+				if _, err = conn.Write(packet); err != nil {
+					return
+				}
+				resp := make([]byte, dns.MaxMsgSize)
+				n, err := conn.Read(resp)
+				if err == nil {
+					_, _ = pc.WriteTo(resp[:n], addr)
+				}
+			}()
+		}
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go r.forwardTCP(conn)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+// forwardTCP forwards one length-prefixed query from conn and the response
+// back.
+func (r *testRelay) forwardTCP(conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(time.Second))
+	packet, err := readPrefixed(conn)
+	if err != nil {
+		return
+	}
+	server, packet, ok := deanonymize(packet)
+	if !ok {
+		return
+	}
+	r.forwarded.Add(1)
+	upstream, err := net.Dial("tcp", server)
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+	_ = upstream.SetDeadline(time.Now().Add(time.Second))
+	b := binary.BigEndian.AppendUint16(nil, uint16(len(packet)))
+	if _, err = upstream.Write(append(b, packet...)); err != nil {
+		return
+	}
+	_, _ = io.Copy(conn, upstream)
+}
+
+func TestClientRelay(t *testing.T) {
+	_, _, stamp := startServer(t, recordsHandler(1))
+	relay := &testRelay{}
+	addr := relay.start(t)
+
+	for i, network := range []string{"udp", "tcp"} {
+		relay.forwarded.Store(0)
+		c := &Client{Net: network, Timeout: time.Second, RelayAddr: addr}
+		ri, err := c.Dial(stamp)
+		if !assert.Nil(t, err, "test %d", i) {
+			continue
+		}
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		resp, err := c.Exchange(req, ri)
+		if assert.Nil(t, err, "test %d", i) {
+			assert.Len(t, resp.Answer, 1, "test %d", i)
+		}
+		// The certificate request and the query.
+		assert.Equal(t, int32(2), relay.forwarded.Load(), "test %d", i)
+	}
+}
+
+func TestRelayAddress(t *testing.T) {
+	stamp := func(addr string) string {
+		b := append([]byte{relayStampProto, byte(len(addr))}, addr...)
+		return "sdns://" + base64.RawURLEncoding.EncodeToString(b)
+	}
+	tests := []struct {
+		relay string
+		addr  string
+		err   bool
+	}{
+		{"192.0.2.1:53", "192.0.2.1:53", false},
+		{"192.0.2.1", "192.0.2.1:443", false},
+		{"[2001:db8::1]", "[2001:db8::1]:443", false},
+		{stamp("192.0.2.1:8443"), "192.0.2.1:8443", false},
+		{stamp("192.0.2.1"), "192.0.2.1:443", false},
+		{"sdns://AQcAAAAAAAAA", "", true},
+		{"sdns://!", "", true},
+	}
+	for i, test := range tests {
+		addr, err := RelayAddress(test.relay)
+		assert.Equal(t, test.err, err != nil, "test %d", i)
+		assert.Equal(t, test.addr, addr, "test %d", i)
+	}
+}
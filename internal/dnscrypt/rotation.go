@@ -0,0 +1,60 @@
+package dnscrypt
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// RotateCerts adds a certificate with a new short-term key pair every
+// interval, until ctx is done. Each certificate is valid for interval plus
+// overlap, so clients still using the previous one keep being answered
+// while they fetch the new one. The first certificate, valid for as long,
+// is left to add with AddCert; the short-term keys of rc are used for none
+// of the next ones.
+func (s *Server) RotateCerts(ctx context.Context, rc ResolverConfig, interval, overlap time.Duration) error {
+	if interval <= 0 || overlap < 0 {
+		return errors.New("dnscrypt: invalid certificate rotation interval")
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		cert, err := s.newCert(rc, interval+overlap)
+		if err != nil {
+			return err
+		}
+		s.AddCert(cert)
+	}
+}
+
+// newCert creates a certificate valid for ttl with a new short-term key
+// pair, and a serial above the ones of the current certificates, which
+// clients prefer.
+func (s *Server) newCert(rc ResolverConfig, ttl time.Duration) (*Cert, error) {
+	sk, pk := generateRandomKeyPair()
+	rc.ResolverSk = HexEncodeKey(sk[:])
+	rc.ResolverPk = HexEncodeKey(pk[:])
+	rc.CertificateTTL = ttl
+	cert, err := rc.CreateCert()
+	if err != nil {
+		return nil, err
+	}
+
+	// Serials are timestamps, which may collide with fast rotations.
+	for _, c := range s.Certs() {
+		if c.Serial >= cert.Serial {
+			cert.Serial = c.Serial + 1
+		}
+	}
+	privateKey, err := HexDecodeKey(rc.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	cert.Sign(privateKey)
+	return cert, nil
+}
@@ -0,0 +1,74 @@
+package dnscrypt
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerCertRotation(t *testing.T) {
+	s, rc, stamp := startServer(t, recordsHandler(1))
+
+	exchange := func(c *Client, ri *ResolverInfo) error {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		_, err := c.Exchange(req, ri)
+		return err
+	}
+	c := &Client{Net: "udp", Timeout: 200 * time.Millisecond}
+	before, err := c.Dial(stamp)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	next, err := s.newCert(rc, time.Hour)
+	if !assert.Nil(t, err) {
+		return
+	}
+	s.AddCert(next)
+	after, err := c.Dial(stamp)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Len(t, s.Certs(), 2)
+	assert.Equal(t, next.Serial, after.ResolverCert.Serial)
+	assert.Greater(t, after.ResolverCert.Serial, before.ResolverCert.Serial)
+
+	// Both certificates are accepted until the first expires.
+	assert.Nil(t, exchange(c, before))
+	assert.Nil(t, exchange(c, after))
+	for _, cert := range s.Certs() {
+		if cert.Serial != next.Serial {
+			s.certsMu.Lock()
+			cert.NotAfter = uint32(time.Now().Add(-time.Minute).Unix())
+			s.certsMu.Unlock()
+		}
+	}
+	assert.NotNil(t, exchange(c, before))
+	assert.Nil(t, exchange(c, after))
+	assert.Len(t, s.Certs(), 1)
+}
+
+func TestRotateCerts(t *testing.T) {
+	rc, err := GenerateResolverConfig("example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{ProviderName: rc.ProviderName, Handler: recordsHandler(1)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.RotateCerts(ctx, rc, 50*time.Millisecond, 2*time.Second) }()
+	assert.Eventually(t, func() bool { return len(s.Certs()) >= 2 }, time.Second, 10*time.Millisecond)
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+
+	certs := s.Certs()
+	assert.Greater(t, certs[0].Serial, certs[1].Serial)
+	assert.NotEqual(t, certs[0].ClientMagic, certs[1].ClientMagic)
+	assert.NotEqual(t, rc.ResolverPk, HexEncodeKey(certs[1].ResolverPk[:]))
+	assert.ErrorContains(t, s.RotateCerts(context.Background(), rc, 0, 0), "interval")
+}
@@ -0,0 +1,419 @@
+package dnscrypt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/ameshkov/dnscrypt/v2/xsecretbox"
+	"github.com/miekg/dns"
+)
+
+// ErrServerClosed is returned by the Serve methods after Shutdown.
+var ErrServerClosed = errors.New("dnscrypt: server closed")
+
+const (
+	// certTTL is the TTL of the TXT records holding the certificates.
+	certTTL = 600
+
+	// responseOverhead is the length of a response besides the padded
+	// <resolver-response>: <resolver-magic> <nonce> and the tag.
+	responseOverhead = resolverMagicSize + nonceSize + xsecretbox.TagSize
+
+	// defaultServerTimeout is the read and write timeout of connections.
+	defaultServerTimeout = 10 * time.Second
+
+	// defaultIdleTimeout is how long TCP connections are kept open without
+	// queries.
+	defaultIdleTimeout = 30 * time.Second
+)
+
+// Handler answers the queries decrypted by a Server.
+type Handler interface {
+	// Exchange returns the response to req, even along with an error.
+	Exchange(req *dns.Msg) (*dns.Msg, error)
+}
+
+// Server is a DNSCrypt server. It answers the certificate queries for the
+// provider name in plain DNS, and the encrypted queries through Handler.
+// Certificates are added with AddCert or RotateCerts.
+type Server struct {
+	// ProviderName is the provider name of the certificates, with the
+	// 2.dnscrypt-cert. prefix.
+	ProviderName string
+	// Handler answers the decrypted queries.
+	Handler Handler
+	// UDPSize caps the size of responses over UDP, which are never larger
+	// than their query. If not set, only the query size applies.
+	UDPSize int
+	// Timeout is the read and write timeout of connections, 10s if not set.
+	Timeout time.Duration
+	// IdleTimeout is how long TCP connections are kept open without
+	// queries, 30s if not set.
+	IdleTimeout time.Duration
+
+	certsMu sync.RWMutex
+	certs   []*Cert
+
+	closing atomic.Bool
+	mu      sync.Mutex
+	closers []interface{ Close() error }
+	conns   map[net.Conn]struct{}
+	wg      sync.WaitGroup
+}
+
+// AddCert adds a certificate created with ResolverConfig.CreateCert, and
+// removes the expired ones. Queries are accepted for all the certificates
+// still valid, so clients can move to the latest at their own pace.
+func (s *Server) AddCert(cert *Cert) {
+	s.certsMu.Lock()
+	defer s.certsMu.Unlock()
+	certs := []*Cert{cert}
+	for _, c := range s.certs {
+		if c.VerifyDate() {
+			certs = append(certs, c)
+		}
+	}
+	s.certs = certs
+}
+
+// Certs returns the valid certificates, the latest first.
+func (s *Server) Certs() []*Cert {
+	s.certsMu.RLock()
+	defer s.certsMu.RUnlock()
+	var certs []*Cert
+	for _, c := range s.certs {
+		if c.VerifyDate() {
+			certs = append(certs, c)
+		}
+	}
+	sort.Slice(certs, func(i, j int) bool { return certs[i].Serial > certs[j].Serial })
+	return certs
+}
+
+// certFor returns the valid certificate with the client magic of packet.
+func (s *Server) certFor(packet []byte) *Cert {
+	if len(packet) < clientMagicSize {
+		return nil
+	}
+	for _, c := range s.Certs() {
+		if bytes.Equal(packet[:clientMagicSize], c.ClientMagic[:]) {
+			return c
+		}
+	}
+	return nil
+}
+
+// ServeUDP serves queries received on pc until Shutdown.
+func (s *Server) ServeUDP(pc net.PacketConn) error {
+	if !s.track(pc) {
+		return ErrServerClosed
+	}
+	defer s.wg.Done()
+
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if s.closing.Load() {
+				return ErrServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		packet := append([]byte(nil), buf[:n]...)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			resp := s.handle(packet, true)
+			if resp == nil {
+				return
+			}
+			if _, err := pc.WriteTo(resp, addr); err != nil {
+				log.Debug("dnscrypt: writing response to %s: %v", addr, err)
+			}
+		}()
+	}
+}
+
+// ServeTCP serves queries received on the connections of l until Shutdown.
+func (s *Server) ServeTCP(l net.Listener) error {
+	if !s.track(l) {
+		return ErrServerClosed
+	}
+	defer s.wg.Done()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.closing.Load() {
+				return ErrServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		s.mu.Lock()
+		if s.closing.Load() {
+			s.mu.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		if s.conns == nil {
+			s.conns = map[net.Conn]struct{}{}
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+// track registers a listener to close on Shutdown, unless the server is
+// already shut down.
+func (s *Server) track(c interface{ Close() error }) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing.Load() {
+		c.Close()
+		return false
+	}
+	s.closers = append(s.closers, c)
+	s.wg.Add(1)
+	return true
+}
+
+// serveConn answers the queries of a TCP connection in turn, until it is
+// idle, closed by the client, or the server shuts down.
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		s.wg.Done()
+	}()
+
+	timeout := s.timeout()
+	for {
+		// Shutdown sets the deadline to now after setting closing, so one
+		// of them stops the loop.
+		_ = conn.SetReadDeadline(time.Now().Add(timeout))
+		if s.closing.Load() {
+			return
+		}
+		query, err := readPrefixed(conn)
+		if err != nil {
+			if !errors.Is(err, os.ErrDeadlineExceeded) && !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.EOF) {
+				log.Debug("dnscrypt: reading query from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		timeout = s.IdleTimeout
+		if timeout <= 0 {
+			timeout = defaultIdleTimeout
+		}
+
+		resp := s.handle(query, false)
+		if resp == nil {
+			return
+		}
+		l := make([]byte, 2)
+		binary.BigEndian.PutUint16(l, uint16(len(resp)))
+		_ = conn.SetWriteDeadline(time.Now().Add(s.timeout()))
+		if _, err := (&net.Buffers{l, resp}).WriteTo(conn); err != nil {
+			log.Debug("dnscrypt: writing response to %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// Shutdown stops the listeners and waits for the queries in progress to be
+// answered, or ctx to be done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing.Store(true)
+	for _, c := range s.closers {
+		c.Close()
+	}
+	for conn := range s.conns {
+		_ = conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// ShutdownContext is Shutdown.
+func (s *Server) ShutdownContext(ctx context.Context) error {
+	return s.Shutdown(ctx)
+}
+
+func (s *Server) timeout() time.Duration {
+	if s.Timeout > 0 {
+		return s.Timeout
+	}
+	return defaultServerTimeout
+}
+
+// handle returns the response to a packet, either a certificate query in
+// plain DNS or an encrypted query, or nil if it is neither.
+func (s *Server) handle(packet []byte, udp bool) []byte {
+	if cert := s.certFor(packet); cert != nil {
+		resp, err := s.handleEncrypted(packet, cert, udp)
+		if err != nil {
+			log.Debug("dnscrypt: %v", err)
+		}
+		return resp
+	}
+
+	req := new(dns.Msg)
+	if err := req.Unpack(packet); err != nil {
+		return nil
+	}
+	resp := s.certResponse(req)
+	if resp == nil {
+		return nil
+	}
+	if udp {
+		resp.Truncate(dns.MinMsgSize)
+	}
+	b, err := resp.Pack()
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// certResponse answers a plain DNS query for the certificate, or returns
+// nil for any other query, which plain DNS clients aren't served.
+func (s *Server) certResponse(req *dns.Msg) *dns.Msg {
+	if len(req.Question) != 1 || req.Question[0].Qtype != dns.TypeTXT ||
+		!strings.EqualFold(dns.Fqdn(req.Question[0].Name), dns.Fqdn(s.ProviderName)) {
+		return nil
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Authoritative = true
+	for _, cert := range s.Certs() {
+		b, err := cert.Serialize()
+		if err != nil {
+			log.Debug("dnscrypt: serializing certificate: %v", err)
+			continue
+		}
+		resp.Answer = append(resp.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: certTTL},
+			Txt: []string{packTxtString(b)},
+		})
+	}
+	return resp
+}
+
+// handleEncrypted decrypts a query, answers it through the handler and
+// returns the encrypted response.
+func (s *Server) handleEncrypted(packet []byte, cert *Cert, udp bool) ([]byte, error) {
+	q := EncryptedQuery{EsVersion: cert.EsVersion, ClientMagic: cert.ClientMagic}
+	b, err := q.Decrypt(packet, cert.ResolverSk)
+	if err != nil {
+		return nil, err
+	}
+	req := new(dns.Msg)
+	if err := req.Unpack(b); err != nil {
+		return nil, err
+	}
+
+	resp, err := s.Handler.Exchange(req)
+	if err != nil {
+		log.Debug("dnscrypt: answering %v: %v", req.Question, err)
+	}
+	if resp == nil {
+		resp = new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeServerFailure)
+	}
+	resp.Id = req.Id
+	if udp {
+		truncate(resp, s.maxUDPResponse(req, len(packet)))
+	}
+	out, err := resp.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	sharedKey, err := computeSharedKey(cert.EsVersion, &cert.ResolverSk, &q.ClientPk)
+	if err != nil {
+		return nil, err
+	}
+	r := EncryptedResponse{EsVersion: cert.EsVersion}
+	copy(r.Nonce[:nonceSize/2], q.Nonce[:nonceSize/2])
+	return r.Encrypt(out, sharedKey)
+}
+
+// maxUDPResponse returns the largest plain response to req that fits in an
+// encrypted response over UDP. Responses can't be larger than their query,
+// so the server can't be used for amplification; clients pad their queries
+// to get larger responses, or retry over TCP.
+func (s *Server) maxUDPResponse(req *dns.Msg, querySize int) int {
+	size := querySize
+	if s.UDPSize > 0 && s.UDPSize < size {
+		size = s.UDPSize
+	}
+	clientSize := dns.MinMsgSize
+	if opt := req.IsEdns0(); opt != nil && int(opt.UDPSize()) > clientSize {
+		clientSize = int(opt.UDPSize())
+	}
+	if clientSize < size {
+		size = clientSize
+	}
+	// Responses are padded to a multiple of 64 bytes, with at least the
+	// 0x80 byte.
+	padded := (size - responseOverhead) / 64 * 64
+	if padded < minUDPQuestionSize {
+		padded = minUDPQuestionSize
+	}
+	return padded - 1
+}
+
+// truncate truncates resp to size, setting TC. Unlike dns.Msg.Truncate, it
+// keeps responses under 512 bytes, dropping all the records if needed.
+func truncate(resp *dns.Msg, size int) {
+	resp.Truncate(size)
+	if resp.Len() <= size {
+		return
+	}
+	var opt []dns.RR
+	if rr := resp.IsEdns0(); rr != nil {
+		opt = []dns.RR{rr}
+	}
+	resp.Answer, resp.Ns, resp.Extra = nil, nil, opt
+	resp.Truncated = true
+}
@@ -0,0 +1,117 @@
+package dnscrypt
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordsHandler answers every query with n A records.
+type recordsHandler int
+
+func (n recordsHandler) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	for i := 0; i < int(n); i++ {
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(192, 0, 2, byte(i)),
+		})
+	}
+	return resp, nil
+}
+
+// startServer starts a server answering with handler on UDP and TCP, and
+// returns it with its configuration and stamp.
+func startServer(t *testing.T, handler Handler) (*Server, ResolverConfig, string) {
+	rc, err := GenerateResolverConfig("example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := rc.CreateCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{ProviderName: rc.ProviderName, Handler: handler}
+	s.AddCert(cert)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = s.ServeUDP(pc) }()
+	go func() { _ = s.ServeTCP(l) }()
+	t.Cleanup(func() { _ = s.Shutdown(context.Background()) })
+
+	stamp, err := rc.CreateStamp(pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, rc, stamp.String()
+}
+
+func TestServer(t *testing.T) {
+	_, _, small := startServer(t, recordsHandler(1))
+	_, _, large := startServer(t, recordsHandler(100))
+
+	tests := []struct {
+		stamp     string
+		net       string
+		answers   int
+		truncated bool
+	}{
+		{small, "udp", 1, false},
+		{small, "tcp", 1, false},
+		{large, "udp", 0, true},
+		{large, "tcp", 100, false},
+	}
+	for i, test := range tests {
+		c := &Client{Net: test.net, Timeout: time.Second, UDPSize: dns.MaxMsgSize}
+		ri, err := c.Dial(test.stamp)
+		if !assert.Nil(t, err, "test %d", i) {
+			continue
+		}
+		conn, err := net.Dial(test.net, ri.ServerAddress)
+		if !assert.Nil(t, err, "test %d", i) {
+			continue
+		}
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		resp, err := c.ExchangeConn(conn, req, ri)
+		conn.Close()
+		if !assert.Nil(t, err, "test %d", i) {
+			continue
+		}
+		assert.Equal(t, req.Id, resp.Id, "test %d", i)
+		assert.Equal(t, test.truncated, resp.Truncated, "test %d", i)
+		if !test.truncated {
+			assert.Len(t, resp.Answer, test.answers, "test %d", i)
+		}
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	s := &Server{Handler: recordsHandler(1)}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.ServeUDP(pc) }()
+
+	assert.Nil(t, s.Shutdown(context.Background()))
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, ErrServerClosed)
+	case <-time.After(time.Second):
+		t.Fatal("server still running")
+	}
+}
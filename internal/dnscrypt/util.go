@@ -2,8 +2,10 @@ package dnscrypt
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io"
 	"net"
+	"strings"
 
 	"github.com/ameshkov/dnscrypt/v2/xsecretbox"
 	"github.com/miekg/dns"
@@ -95,6 +97,24 @@ func dddToByte(s []byte) byte {
 	return (s[0]-'0')*100 + (s[1]-'0')*10 + (s[2] - '0')
 }
 
+// packTxtString escapes binary data for a TXT record, the reverse of
+// unpackTxtString.
+func packTxtString(b []byte) string {
+	var sb strings.Builder
+	for _, c := range b {
+		switch {
+		case c == '"' || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&sb, "\\%03d", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
 func unpackTxtString(s string) ([]byte, error) {
 	bs := make([]byte, len(s))
 	msg := make([]byte, 0)
@@ -127,7 +147,7 @@ func unpackTxtString(s string) ([]byte, error) {
 // readPrefixed -- reads a DNS message with a 2-byte prefix containing message length
 func readPrefixed(conn net.Conn) ([]byte, error) {
 	l := make([]byte, 2)
-	_, err := conn.Read(l)
+	_, err := io.ReadFull(conn, l)
 	if err != nil {
 		return nil, err
 	}
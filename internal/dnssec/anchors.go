@@ -0,0 +1,32 @@
+package dnssec
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultTrustAnchors are the DS records of the root zone key signing keys
+// published by IANA: KSK-2017 and KSK-2024.
+var DefaultTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// ParseTrustAnchors parses DS or DNSKEY records in zone file format.
+func ParseTrustAnchors(anchors ...string) ([]dns.RR, error) {
+	rrs := make([]dns.RR, 0, len(anchors))
+	for _, s := range anchors {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			return nil, fmt.Errorf("dnssec: invalid trust anchor %q: %w", s, err)
+		}
+		switch rr.(type) {
+		case *dns.DS, *dns.DNSKEY:
+		default:
+			return nil, fmt.Errorf("dnssec: trust anchor must be a DS or DNSKEY record: %q", s)
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
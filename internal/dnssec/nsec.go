@@ -0,0 +1,262 @@
+package dnssec
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// nsec3OptOut is the opt-out flag of NSEC3 records, see RFC 5155.
+const nsec3OptOut = 0x01
+
+// denial holds the authenticated NSEC and NSEC3 records of a response,
+// which prove that names or types do not exist.
+type denial struct {
+	nsec  []*dns.NSEC
+	nsec3 []*dns.NSEC3
+}
+
+// add collects the NSEC and NSEC3 records of rrs.
+func (d *denial) add(rrs []dns.RR) {
+	for _, rr := range rrs {
+		switch v := rr.(type) {
+		case *dns.NSEC:
+			d.nsec = append(d.nsec, v)
+		case *dns.NSEC3:
+			if v.Hash == dns.SHA1 {
+				d.nsec3 = append(d.nsec3, v)
+			}
+		}
+	}
+}
+
+// noData proves that name exists without records of qtype. cut reports
+// whether name is an unsigned delegation and optOut whether the proof relies
+// on an NSEC3 opt-out span, in which case name may be an unsigned
+// delegation as well.
+func (d *denial) noData(name string, qtype uint16) (cut, optOut bool, err error) {
+	for _, n := range d.nsec {
+		if dns.CanonicalName(n.Hdr.Name) != name {
+			continue
+		}
+		if hasType(n.TypeBitMap, qtype) || hasType(n.TypeBitMap, dns.TypeCNAME) {
+			return false, false, bogus("NSEC of %s lists %s", name, dns.TypeToString[qtype])
+		}
+		return isDelegation(n.TypeBitMap), false, nil
+	}
+	for _, n := range d.nsec3 {
+		if !n.Match(name) {
+			continue
+		}
+		if hasType(n.TypeBitMap, qtype) || hasType(n.TypeBitMap, dns.TypeCNAME) {
+			return false, false, bogus("NSEC3 of %s lists %s", name, dns.TypeToString[qtype])
+		}
+		return isDelegation(n.TypeBitMap), false, nil
+	}
+
+	// An empty non-terminal has no records of its own, only descendants.
+	for _, n := range d.nsec {
+		if covers(n, name) && dns.IsSubDomain(name, dns.CanonicalName(n.NextDomain)) {
+			return false, false, nil
+		}
+	}
+
+	if len(d.nsec) > 0 {
+		// The name may have been synthesized from a wildcard lacking qtype.
+		ce, err := d.nsecClosestEncloser(name)
+		if err != nil {
+			return false, false, err
+		}
+		wildcard := wildcardOf(ce)
+		for _, n := range d.nsec {
+			if dns.CanonicalName(n.Hdr.Name) != wildcard {
+				continue
+			}
+			if hasType(n.TypeBitMap, qtype) || hasType(n.TypeBitMap, dns.TypeCNAME) {
+				return false, false, bogus("NSEC of %s lists %s", wildcard, dns.TypeToString[qtype])
+			}
+			return false, false, nil
+		}
+		return false, false, bogus("no proof that %s has no %s records", name, dns.TypeToString[qtype])
+	}
+
+	ce, nextCloser, err := d.nsec3ClosestEncloser(name)
+	if err != nil {
+		return false, false, err
+	}
+	if qtype == dns.TypeDS {
+		// RFC 5155 section 8.6: an insecure delegation in an opt-out span.
+		if n := d.nsec3Covering(nextCloser); n != nil && n.Flags&nsec3OptOut != 0 {
+			return false, true, nil
+		}
+	}
+	for _, n := range d.nsec3 {
+		if n.Match(wildcardOf(ce)) {
+			if hasType(n.TypeBitMap, qtype) || hasType(n.TypeBitMap, dns.TypeCNAME) {
+				return false, false, bogus("NSEC3 of %s lists %s", wildcardOf(ce), dns.TypeToString[qtype])
+			}
+			return false, false, nil
+		}
+	}
+	return false, false, bogus("no proof that %s has no %s records", name, dns.TypeToString[qtype])
+}
+
+// nxDomain proves that name does not exist, either directly or through a
+// wildcard. optOut reports whether the proof relies on an NSEC3 opt-out span.
+func (d *denial) nxDomain(name string) (optOut bool, err error) {
+	if len(d.nsec) > 0 {
+		ce, err := d.nsecClosestEncloser(name)
+		if err != nil {
+			return false, err
+		}
+		if !d.nsecCovered(wildcardOf(ce)) {
+			return false, bogus("no proof that %s does not exist", wildcardOf(ce))
+		}
+		return false, nil
+	}
+
+	ce, nextCloser, err := d.nsec3ClosestEncloser(name)
+	if err != nil {
+		return false, err
+	}
+	n := d.nsec3Covering(nextCloser)
+	if d.nsec3Covering(wildcardOf(ce)) == nil {
+		return false, bogus("no proof that %s does not exist", wildcardOf(ce))
+	}
+	return n.Flags&nsec3OptOut != 0, nil
+}
+
+// noCloserMatch proves that a name answered from a wildcard with the given
+// number of labels had no closer match, see RFC 4035 section 5.3.4.
+func (d *denial) noCloserMatch(name string, labels int) error {
+	if d.nsecCovered(name) {
+		return nil
+	}
+	// The next closer name is one label longer than the wildcard's parent.
+	indexes := dns.Split(name)
+	if len(indexes) > labels {
+		nextCloser := name[indexes[len(indexes)-labels-1]:]
+		if d.nsec3Covering(nextCloser) != nil {
+			return nil
+		}
+	}
+	return bogus("no proof that %s has no closer match than its wildcard", name)
+}
+
+// nsecClosestEncloser finds the NSEC record covering name and returns the
+// closest existing ancestor of name it reveals.
+func (d *denial) nsecClosestEncloser(name string) (string, error) {
+	for _, n := range d.nsec {
+		if !covers(n, name) {
+			continue
+		}
+		owner, next := dns.CanonicalName(n.Hdr.Name), dns.CanonicalName(n.NextDomain)
+		ce := commonAncestor(name, owner)
+		if c := commonAncestor(name, next); dns.CountLabel(c) > dns.CountLabel(ce) {
+			ce = c
+		}
+		return ce, nil
+	}
+	return "", bogus("no NSEC proves that %s does not exist", name)
+}
+
+// nsecCovered reports whether an NSEC record covers name.
+func (d *denial) nsecCovered(name string) bool {
+	for _, n := range d.nsec {
+		if covers(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// nsec3ClosestEncloser finds the closest ancestor of name matched by an
+// NSEC3 record and the next closer name, which must be covered by another
+// one. See RFC 5155 section 8.3.
+func (d *denial) nsec3ClosestEncloser(name string) (ce, nextCloser string, err error) {
+	nextCloser = name
+	for ce = parentName(name); ; ce = parentName(ce) {
+		for _, n := range d.nsec3 {
+			if !n.Match(ce) {
+				continue
+			}
+			if isDelegation(n.TypeBitMap) || hasType(n.TypeBitMap, dns.TypeDNAME) {
+				return "", "", bogus("closest encloser %s of %s is a delegation", ce, name)
+			}
+			if d.nsec3Covering(nextCloser) == nil {
+				return "", "", bogus("no NSEC3 covers %s", nextCloser)
+			}
+			return ce, nextCloser, nil
+		}
+		if ce == "." {
+			return "", "", bogus("no closest encloser proof for %s", name)
+		}
+		nextCloser = ce
+	}
+}
+
+// nsec3Covering returns the NSEC3 record covering name, if any.
+func (d *denial) nsec3Covering(name string) *dns.NSEC3 {
+	for _, n := range d.nsec3 {
+		if n.Cover(name) {
+			return n
+		}
+	}
+	return nil
+}
+
+// covers reports whether name falls strictly between the owner and next
+// name of an NSEC record, in canonical order.
+func covers(n *dns.NSEC, name string) bool {
+	owner, next := dns.CanonicalName(n.Hdr.Name), dns.CanonicalName(n.NextDomain)
+	if compareNames(owner, next) < 0 {
+		return compareNames(owner, name) < 0 && compareNames(name, next) < 0
+	}
+	// The last NSEC of a zone points back to its apex.
+	return compareNames(owner, name) < 0 && dns.IsSubDomain(next, name)
+}
+
+// compareNames compares two canonical names in the canonical DNS order of
+// RFC 4034 section 6.1: label by label, starting with the rightmost one.
+func compareNames(a, b string) int {
+	la, lb := dns.SplitDomainName(a), dns.SplitDomainName(b)
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(strings.ToLower(la[i]), strings.ToLower(lb[j])); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// commonAncestor returns the longest name that a and b both belong to.
+func commonAncestor(a, b string) string {
+	n := dns.CompareDomainName(a, b)
+	if n == 0 {
+		return "."
+	}
+	labels := dns.Split(a)
+	return a[labels[len(labels)-n]:]
+}
+
+// wildcardOf returns the wildcard name directly below name.
+func wildcardOf(name string) string {
+	if name == "." {
+		return "*."
+	}
+	return "*." + name
+}
+
+// isDelegation reports whether a type bitmap belongs to a delegation point.
+func isDelegation(types []uint16) bool {
+	return hasType(types, dns.TypeNS) && !hasType(types, dns.TypeSOA)
+}
+
+// hasType reports whether qtype is in a type bitmap.
+func hasType(types []uint16, qtype uint16) bool {
+	for _, t := range types {
+		if t == qtype {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,580 @@
+package dnssec
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/dnsutils/internal/statute"
+	"github.com/miekg/dns"
+)
+
+const (
+	// maxCacheTTL bounds how long a validated zone is trusted without
+	// fetching its keys again.
+	maxCacheTTL = time.Hour
+
+	// maxCNAMEChain is the longest CNAME chain followed in an answer.
+	maxCNAMEChain = 16
+
+	// maxZoneEntries is the size above which the expired zones are pruned.
+	maxZoneEntries = 4096
+)
+
+// ErrBogus is returned for responses failing validation.
+var ErrBogus = errors.New("dnssec: bogus response")
+
+// bogus returns an ErrBogus error with the given reason.
+func bogus(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrBogus, fmt.Sprintf(format, args...))
+}
+
+// ExchangeFunc sends a single question upstream and returns the raw reply,
+// with the DNSSEC records requested.
+type ExchangeFunc func(q dns.Question) (*dns.Msg, error)
+
+// zone is a point of the chain of trust: a zone apex along with the keys
+// trusted to sign its data, if it is secure.
+type zone struct {
+	name     string
+	keys     []*dns.DNSKEY
+	security statute.Security
+	expires  time.Time
+}
+
+// Validator checks responses against a chain of trust built from its trust
+// anchors down to the zone that signed them. The keys and delegations met
+// along the way are fetched with the exchange function and cached.
+type Validator struct {
+	exchange ExchangeFunc
+	anchors  map[string][]dns.RR
+
+	mu    sync.Mutex
+	zones map[string]*zone
+
+	// now is replaceable for tests.
+	now func() time.Time
+}
+
+// NewValidator creates a Validator trusting the given DS or DNSKEY records.
+// Without anchors, the root zone anchors from DefaultTrustAnchors are used.
+func NewValidator(exchange ExchangeFunc, anchors []dns.RR) (*Validator, error) {
+	if len(anchors) == 0 {
+		var err error
+		if anchors, err = ParseTrustAnchors(DefaultTrustAnchors...); err != nil {
+			return nil, err
+		}
+	}
+
+	v := &Validator{
+		exchange: exchange,
+		anchors:  map[string][]dns.RR{},
+		zones:    map[string]*zone{},
+		now:      time.Now,
+	}
+	for _, rr := range anchors {
+		switch rr.(type) {
+		case *dns.DS, *dns.DNSKEY:
+		default:
+			return nil, fmt.Errorf("dnssec: trust anchor must be a DS or DNSKEY record: %s", rr)
+		}
+		name := dns.CanonicalName(rr.Header().Name)
+		v.anchors[name] = append(v.anchors[name], rr)
+	}
+	return v, nil
+}
+
+// Validate checks the answer and, for negative or wildcard answers, the
+// denial of existence proofs of msg. A bogus response is reported with an
+// error wrapping ErrBogus.
+func (v *Validator) Validate(msg *dns.Msg) (statute.Security, error) {
+	if len(msg.Question) == 0 {
+		return statute.Bogus, bogus("response without question")
+	}
+	if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+		return statute.Indeterminate, nil
+	}
+	q := msg.Question[0]
+	if v.anchorFor(dns.CanonicalName(q.Name)) == "" {
+		return statute.Indeterminate, nil
+	}
+
+	security := statute.Secure
+	var wildcards []*dns.RRSIG
+
+	answers := rrsets(msg.Answer)
+	for _, set := range answers {
+		s, sig, err := v.verifySet(set)
+		if err != nil {
+			return statute.Bogus, err
+		}
+		security = weakest(security, s)
+		if sig != nil && int(sig.Labels) < dns.CountLabel(set.name) {
+			wildcards = append(wildcards, sig)
+		}
+	}
+
+	target, found := chase(answers, dns.CanonicalName(q.Name), q.Qtype)
+	if found && len(wildcards) == 0 {
+		return security, nil
+	}
+
+	// Negative and wildcard answers are only as good as their proofs.
+	d := &denial{}
+	signed := false
+	for _, set := range rrsets(msg.Ns) {
+		switch set.rrtype {
+		case dns.TypeSOA, dns.TypeNSEC, dns.TypeNSEC3:
+		default:
+			continue
+		}
+		s, _, err := v.verifySet(set)
+		if err != nil {
+			return statute.Bogus, err
+		}
+		security = weakest(security, s)
+		if s == statute.Secure {
+			signed = true
+			d.add(set.rrs)
+		}
+	}
+	if security != statute.Secure {
+		return security, nil
+	}
+
+	for _, sig := range wildcards {
+		if err := d.noCloserMatch(dns.CanonicalName(sig.Hdr.Name), int(sig.Labels)); err != nil {
+			return statute.Bogus, err
+		}
+	}
+	if found {
+		return security, nil
+	}
+
+	if !signed {
+		z, err := v.zone(target)
+		if err != nil {
+			return statute.Bogus, err
+		}
+		if z.security != statute.Secure {
+			return z.security, nil
+		}
+		return statute.Bogus, bogus("no denial of existence for %s", target)
+	}
+
+	var (
+		optOut bool
+		err    error
+	)
+	if msg.Rcode == dns.RcodeNameError {
+		optOut, err = d.nxDomain(target)
+	} else {
+		_, optOut, err = d.noData(target, q.Qtype)
+	}
+	if err != nil {
+		return statute.Bogus, err
+	}
+	if optOut {
+		return statute.Insecure, nil
+	}
+	return security, nil
+}
+
+// verifySet checks the signatures of set and returns the signature that
+// validated it, if any.
+func (v *Validator) verifySet(set *rrset) (statute.Security, *dns.RRSIG, error) {
+	if len(set.sigs) == 0 {
+		z, err := v.zone(set.name)
+		if err != nil {
+			return statute.Bogus, nil, err
+		}
+		if z.security != statute.Secure {
+			return z.security, nil, nil
+		}
+		return statute.Bogus, nil, bogus("%s %s is not signed", set.name, dns.TypeToString[set.rrtype])
+	}
+
+	err := bogus("no usable signature for %s %s", set.name, dns.TypeToString[set.rrtype])
+	for _, sig := range set.sigs {
+		signer := dns.CanonicalName(sig.SignerName)
+		if !dns.IsSubDomain(signer, set.name) {
+			continue
+		}
+		z, zerr := v.zone(signer)
+		if zerr != nil {
+			err = zerr
+			continue
+		}
+		if z.security != statute.Secure {
+			return z.security, nil, nil
+		}
+		if z.name != signer {
+			err = bogus("signer %s of %s is not a zone", signer, set.name)
+			continue
+		}
+		if verr := v.verify(set.rrs, sig, z.keys); verr != nil {
+			err = verr
+			continue
+		}
+		return statute.Secure, sig, nil
+	}
+	return statute.Bogus, nil, err
+}
+
+// verify checks sig over rrs with any of keys.
+func (v *Validator) verify(rrs []dns.RR, sig *dns.RRSIG, keys []*dns.DNSKEY) error {
+	if !sig.ValidityPeriod(v.now()) {
+		return bogus("signature of %s %s is expired or not yet valid", sig.Hdr.Name, dns.TypeToString[sig.TypeCovered])
+	}
+	for _, key := range keys {
+		if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+			continue
+		}
+		if err := sig.Verify(key, rrs); err == nil {
+			return nil
+		}
+	}
+	return bogus("invalid signature of %s %s", sig.Hdr.Name, dns.TypeToString[sig.TypeCovered])
+}
+
+// zone returns the deepest zone enclosing name, walking the chain of trust
+// down from the closest trust anchor. Names without a trust anchor above
+// them are indeterminate.
+func (v *Validator) zone(name string) (*zone, error) {
+	name = dns.CanonicalName(name)
+
+	v.mu.Lock()
+	z, ok := v.zones[name]
+	v.mu.Unlock()
+	if ok && v.now().Before(z.expires) {
+		return z, nil
+	}
+
+	anchor := v.anchorFor(name)
+	var err error
+	switch {
+	case anchor == "":
+		z = &zone{name: name, security: statute.Indeterminate, expires: v.now().Add(maxCacheTTL)}
+	case anchor == name:
+		z, err = v.anchorZone(name)
+	default:
+		var parent *zone
+		if parent, err = v.zone(parentName(name)); err != nil {
+			return nil, err
+		}
+		if parent.security != statute.Secure {
+			z = parent
+		} else {
+			z, err = v.delegation(parent, name)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	v.mu.Lock()
+	v.pruneLocked()
+	v.zones[name] = z
+	v.mu.Unlock()
+	return z, nil
+}
+
+// pruneLocked removes the expired zones when they grow too many, as every
+// owner name of an unsigned zone gets an entry; v.mu must be held.
+func (v *Validator) pruneLocked() {
+	if len(v.zones) < maxZoneEntries {
+		return
+	}
+	now := v.now()
+	for name, z := range v.zones {
+		if !now.Before(z.expires) {
+			delete(v.zones, name)
+		}
+	}
+}
+
+// anchorFor returns the deepest trust anchor enclosing name, or "".
+func (v *Validator) anchorFor(name string) string {
+	for {
+		if _, ok := v.anchors[name]; ok {
+			return name
+		}
+		if name == "." {
+			return ""
+		}
+		name = parentName(name)
+	}
+}
+
+// anchorZone fetches and authenticates the keys of a trust anchor zone.
+func (v *Validator) anchorZone(name string) (*zone, error) {
+	var ds []*dns.DS
+	var trusted []*dns.DNSKEY
+	for _, rr := range v.anchors[name] {
+		switch a := rr.(type) {
+		case *dns.DS:
+			ds = append(ds, a)
+		case *dns.DNSKEY:
+			trusted = append(trusted, a)
+		}
+	}
+	return v.keys(name, ds, trusted)
+}
+
+// delegation follows the chain of trust from the secure zone parent to its
+// descendant name, which may or may not be a zone of its own.
+func (v *Validator) delegation(parent *zone, name string) (*zone, error) {
+	msg, err := v.exchange(dns.Question{Name: name, Qtype: dns.TypeDS, Qclass: dns.ClassINET})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, set := range rrsets(msg.Answer) {
+		if set.rrtype != dns.TypeDS || set.name != name {
+			continue
+		}
+		if err = v.verifyWith(parent, set); err != nil {
+			return nil, err
+		}
+		var ds []*dns.DS
+		for _, rr := range set.rrs {
+			ds = append(ds, rr.(*dns.DS))
+		}
+		return v.keys(name, ds, nil)
+	}
+
+	// Without a DS record, the parent must prove there is none.
+	d := &denial{}
+	for _, set := range rrsets(msg.Ns) {
+		if set.rrtype != dns.TypeNSEC && set.rrtype != dns.TypeNSEC3 {
+			continue
+		}
+		if err = v.verifyWith(parent, set); err != nil {
+			return nil, err
+		}
+		d.add(set.rrs)
+	}
+
+	expires := v.now().Add(minTTL(msg.Ns))
+	if msg.Rcode == dns.RcodeNameError {
+		if _, err = d.nxDomain(name); err != nil {
+			return nil, err
+		}
+		return &zone{name: parent.name, keys: parent.keys, security: statute.Secure, expires: expires}, nil
+	}
+
+	cut, optOut, err := d.noData(name, dns.TypeDS)
+	if err != nil {
+		return nil, err
+	}
+	if cut || optOut {
+		return &zone{name: name, security: statute.Insecure, expires: expires}, nil
+	}
+	// Not a zone cut: name belongs to the parent zone.
+	return &zone{name: parent.name, keys: parent.keys, security: statute.Secure, expires: expires}, nil
+}
+
+// verifyWith checks that set is signed by the secure zone z.
+func (v *Validator) verifyWith(z *zone, set *rrset) error {
+	err := bogus("%s %s is not signed by %s", set.name, dns.TypeToString[set.rrtype], z.name)
+	for _, sig := range set.sigs {
+		if dns.CanonicalName(sig.SignerName) != z.name {
+			continue
+		}
+		if err = v.verify(set.rrs, sig, z.keys); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// keys fetches the DNSKEY records of name and authenticates them with the
+// given DS records or trusted keys: one of the keys they designate must have
+// signed the whole DNSKEY set.
+func (v *Validator) keys(name string, ds []*dns.DS, trusted []*dns.DNSKEY) (*zone, error) {
+	supported := len(trusted) > 0
+	for _, d := range ds {
+		if supportedAlgorithm(d.Algorithm) && (d.DigestType == dns.SHA1 || d.DigestType == dns.SHA256 || d.DigestType == dns.SHA384) {
+			supported = true
+		}
+	}
+	if !supported {
+		// RFC 4035 section 5.2: treat zones signed with unknown algorithms as
+		// unsigned.
+		return &zone{name: name, security: statute.Insecure, expires: v.now().Add(maxCacheTTL)}, nil
+	}
+
+	msg, err := v.exchange(dns.Question{Name: name, Qtype: dns.TypeDNSKEY, Qclass: dns.ClassINET})
+	if err != nil {
+		return nil, err
+	}
+
+	var set *rrset
+	for _, s := range rrsets(msg.Answer) {
+		if s.rrtype == dns.TypeDNSKEY && s.name == name {
+			set = s
+		}
+	}
+	if set == nil {
+		return nil, bogus("no DNSKEY records for %s", name)
+	}
+
+	var keys, entry []*dns.DNSKEY
+	for _, rr := range set.rrs {
+		key := rr.(*dns.DNSKEY)
+		keys = append(keys, key)
+		if matchesAnchor(key, ds, trusted) {
+			entry = append(entry, key)
+		}
+	}
+	if len(entry) == 0 {
+		return nil, bogus("no DNSKEY of %s matches its DS records", name)
+	}
+
+	for _, sig := range set.sigs {
+		if dns.CanonicalName(sig.SignerName) != name {
+			continue
+		}
+		if err = v.verify(set.rrs, sig, entry); err == nil {
+			return &zone{
+				name:     name,
+				keys:     keys,
+				security: statute.Secure,
+				expires:  v.now().Add(minTTL(set.rrs)),
+			}, nil
+		}
+	}
+	return nil, bogus("DNSKEY set of %s is not self-signed by a trusted key", name)
+}
+
+// supportedAlgorithm reports whether signatures made with alg can be
+// verified.
+func supportedAlgorithm(alg uint8) bool {
+	switch alg {
+	case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512,
+		dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519:
+		return true
+	default:
+		return false
+	}
+}
+
+// matchesAnchor reports whether key is designated by one of ds or trusted.
+func matchesAnchor(key *dns.DNSKEY, ds []*dns.DS, trusted []*dns.DNSKEY) bool {
+	if key.Flags&dns.ZONE == 0 {
+		return false
+	}
+	for _, t := range trusted {
+		if key.Algorithm == t.Algorithm && key.Flags == t.Flags && key.PublicKey == t.PublicKey {
+			return true
+		}
+	}
+	for _, d := range ds {
+		if key.KeyTag() != d.KeyTag || key.Algorithm != d.Algorithm {
+			continue
+		}
+		if digest := key.ToDS(d.DigestType); digest != nil && strings.EqualFold(digest.Digest, d.Digest) {
+			return true
+		}
+	}
+	return false
+}
+
+// rrset is a set of records sharing a name and type, with their signatures.
+type rrset struct {
+	name   string
+	rrtype uint16
+	rrs    []dns.RR
+	sigs   []*dns.RRSIG
+}
+
+// rrsets groups the records of a section into RRsets, in order of first
+// appearance.
+func rrsets(section []dns.RR) []*rrset {
+	var sets []*rrset
+	index := map[string]*rrset{}
+	get := func(name string, rrtype uint16) *rrset {
+		key := name + "/" + dns.TypeToString[rrtype]
+		set, ok := index[key]
+		if !ok {
+			set = &rrset{name: name, rrtype: rrtype}
+			index[key] = set
+			sets = append(sets, set)
+		}
+		return set
+	}
+
+	for _, rr := range section {
+		name := dns.CanonicalName(rr.Header().Name)
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			set := get(name, sig.TypeCovered)
+			set.sigs = append(set.sigs, sig)
+			continue
+		}
+		set := get(name, rr.Header().Rrtype)
+		set.rrs = append(set.rrs, rr)
+	}
+
+	// Drop signatures without records.
+	kept := sets[:0]
+	for _, set := range sets {
+		if len(set.rrs) > 0 {
+			kept = append(kept, set)
+		}
+	}
+	return kept
+}
+
+// chase follows the CNAME chain from name and reports whether the answer
+// holds records of qtype at its end.
+func chase(answers []*rrset, name string, qtype uint16) (string, bool) {
+	for i := 0; i < maxCNAMEChain; i++ {
+		var cname string
+		for _, set := range answers {
+			if set.name != name {
+				continue
+			}
+			if set.rrtype == qtype || qtype == dns.TypeANY {
+				return name, true
+			}
+			if set.rrtype == dns.TypeCNAME {
+				cname = dns.CanonicalName(set.rrs[0].(*dns.CNAME).Target)
+			}
+		}
+		if cname == "" {
+			return name, false
+		}
+		name = cname
+	}
+	return name, false
+}
+
+// weakest returns the weaker of two security statuses.
+func weakest(a, b statute.Security) statute.Security {
+	if a == statute.Secure {
+		return b
+	}
+	return a
+}
+
+// minTTL returns the smallest TTL of rrs, capped at maxCacheTTL.
+func minTTL(rrs []dns.RR) time.Duration {
+	ttl := maxCacheTTL
+	for _, rr := range rrs {
+		if t := time.Duration(rr.Header().Ttl) * time.Second; t < ttl {
+			ttl = t
+		}
+	}
+	return ttl
+}
+
+// parentName returns the name one label above name.
+func parentName(name string) string {
+	off, end := dns.NextLabel(name, 0)
+	if end {
+		return "."
+	}
+	return name[off:]
+}
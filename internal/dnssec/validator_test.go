@@ -0,0 +1,462 @@
+package dnssec
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/dnsutils/internal/statute"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// Denial of existence flavours of test zones.
+const (
+	unsigned = iota
+	signedNSEC
+	signedNSEC3
+)
+
+// testZone is a tiny authoritative zone, signed on the fly.
+type testZone struct {
+	origin string
+	mode   int
+	key    *dns.DNSKEY
+	signer crypto.Signer
+	rrs    []dns.RR
+	denial []dns.RR
+}
+
+func newTestZone(t *testing.T, origin string, mode int, records ...string) *testZone {
+	ns := "ns." + origin
+	if origin == "." {
+		ns = "ns.root."
+	}
+	z := &testZone{origin: origin, mode: mode}
+	records = append([]string{
+		fmt.Sprintf("%s 3600 IN SOA %s admin.%s 1 3600 600 86400 300", origin, ns, strings.TrimPrefix(origin, ".")),
+		fmt.Sprintf("%s 3600 IN NS %s", origin, ns),
+	}, records...)
+	for _, s := range records {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		z.rrs = append(z.rrs, rr)
+	}
+	if mode == unsigned {
+		return z
+	}
+
+	z.key = &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: origin, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := z.key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z.signer = priv.(crypto.Signer)
+	z.rrs = append(z.rrs, z.key)
+	z.buildDenial()
+	return z
+}
+
+// ds returns the DS record of the zone, for its parent.
+func (z *testZone) ds() string {
+	return z.key.ToDS(dns.SHA256).String()
+}
+
+// names returns the names of the zone in canonical order, with their types.
+// Empty non-terminals are included for NSEC3.
+func (z *testZone) names() ([]string, map[string][]uint16) {
+	types := map[string][]uint16{}
+	for _, rr := range z.rrs {
+		name := dns.CanonicalName(rr.Header().Name)
+		types[name] = append(types[name], rr.Header().Rrtype)
+		for p := name; z.mode == signedNSEC3 && p != z.origin; p = parentName(p) {
+			if _, ok := types[p]; !ok {
+				types[p] = nil
+			}
+		}
+	}
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return compareNames(names[i], names[j]) < 0 })
+	return names, types
+}
+
+// buildDenial builds the NSEC or NSEC3 chain of the zone.
+func (z *testZone) buildDenial() {
+	names, types := z.names()
+	bitmap := func(name string, extra ...uint16) []uint16 {
+		bm := append(extra, types[name]...)
+		if len(types[name]) > 0 {
+			bm = append(bm, dns.TypeRRSIG)
+		}
+		sort.Slice(bm, func(i, j int) bool { return bm[i] < bm[j] })
+		return bm
+	}
+
+	if z.mode == signedNSEC {
+		for i, name := range names {
+			z.denial = append(z.denial, &dns.NSEC{
+				Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+				NextDomain: names[(i+1)%len(names)],
+				TypeBitMap: bitmap(name, dns.TypeNSEC),
+			})
+		}
+		return
+	}
+
+	hashes := make([]string, len(names))
+	byHash := map[string]string{}
+	for i, name := range names {
+		hashes[i] = dns.HashName(name, dns.SHA1, 0, "")
+		byHash[hashes[i]] = name
+	}
+	sort.Strings(hashes)
+	for i, hash := range hashes {
+		name := byHash[hash]
+		z.denial = append(z.denial, &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: strings.ToLower(hash) + "." + z.origin, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+			Hash:       dns.SHA1,
+			NextDomain: hashes[(i+1)%len(hashes)],
+			HashLength: 20,
+			TypeBitMap: bitmap(name),
+		})
+	}
+}
+
+// sign returns rrs along with the signatures of each of their RRsets.
+func (z *testZone) sign(rrs []dns.RR) []dns.RR {
+	if z.signer == nil {
+		return rrs
+	}
+	out := append([]dns.RR{}, rrs...)
+	for _, set := range rrsets(rrs) {
+		if set.rrtype == dns.TypeNS && set.name != z.origin {
+			continue
+		}
+		sig := &dns.RRSIG{
+			Hdr:         dns.RR_Header{Name: set.name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: set.rrs[0].Header().Ttl},
+			TypeCovered: set.rrtype,
+			Algorithm:   z.key.Algorithm,
+			SignerName:  z.origin,
+			KeyTag:      z.key.KeyTag(),
+			Inception:   uint32(time.Now().Add(-time.Hour).Unix()),
+			Expiration:  uint32(time.Now().Add(time.Hour).Unix()),
+		}
+		if err := sig.Sign(z.signer, set.rrs); err != nil {
+			panic(err)
+		}
+		out = append(out, sig)
+	}
+	return out
+}
+
+// find returns the records of the zone at name with type qtype.
+func (z *testZone) find(name string, qtype uint16) []dns.RR {
+	var rrs []dns.RR
+	for _, rr := range z.rrs {
+		if dns.CanonicalName(rr.Header().Name) == name && rr.Header().Rrtype == qtype {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+// exists reports whether name or any of its descendants has records.
+func (z *testZone) exists(name string) bool {
+	for _, rr := range z.rrs {
+		if dns.IsSubDomain(name, dns.CanonicalName(rr.Header().Name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// proof returns the NSEC or NSEC3 records matching or covering name.
+func (z *testZone) proof(name string) []dns.RR {
+	var rrs []dns.RR
+	for _, rr := range z.denial {
+		switch n := rr.(type) {
+		case *dns.NSEC:
+			if dns.CanonicalName(n.Hdr.Name) == name || covers(n, name) {
+				rrs = append(rrs, n)
+			}
+		case *dns.NSEC3:
+			if n.Match(name) || n.Cover(name) {
+				rrs = append(rrs, n)
+			}
+		}
+	}
+	return rrs
+}
+
+// answer answers q like an authoritative server of the zone would.
+func (z *testZone) answer(q dns.Question) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(q.Name, q.Qtype)
+	m.Response = true
+	name := dns.CanonicalName(q.Name)
+
+	if rrs := z.find(name, q.Qtype); len(rrs) > 0 {
+		m.Answer = z.sign(rrs)
+		return m
+	}
+	if rrs := z.find(name, dns.TypeCNAME); len(rrs) > 0 {
+		m.Answer = z.sign(rrs)
+		return m
+	}
+
+	soa := z.find(z.origin, dns.TypeSOA)
+	if z.exists(name) {
+		m.Ns = z.sign(append(soa, z.proof(name)...))
+		return m
+	}
+
+	ce := parentName(name)
+	for !z.exists(ce) {
+		ce = parentName(ce)
+	}
+	nextCloser := name
+	for parentName(nextCloser) != ce {
+		nextCloser = parentName(nextCloser)
+	}
+
+	if rrs := z.find(wildcardOf(ce), q.Qtype); len(rrs) > 0 {
+		for _, rr := range z.sign(rrs) {
+			rr = dns.Copy(rr)
+			rr.Header().Name = q.Name
+			m.Answer = append(m.Answer, rr)
+		}
+		m.Ns = z.sign(z.proof(nextCloser))
+		return m
+	}
+
+	m.Rcode = dns.RcodeNameError
+	proof := append(z.proof(nextCloser), z.proof(wildcardOf(ce))...)
+	if z.mode == signedNSEC3 {
+		proof = append(proof, z.proof(ce)...)
+	}
+	m.Ns = z.sign(append(soa, dedup(proof)...))
+	return m
+}
+
+func dedup(rrs []dns.RR) []dns.RR {
+	seen := map[string]bool{}
+	var out []dns.RR
+	for _, rr := range rrs {
+		if s := rr.String(); !seen[s] {
+			seen[s] = true
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+// testNet routes questions to the zone a recursive resolver would ask.
+type testNet []*testZone
+
+func (n testNet) exchange(q dns.Question) (*dns.Msg, error) {
+	name := dns.CanonicalName(q.Name)
+	var zone *testZone
+	for _, z := range n {
+		if !dns.IsSubDomain(z.origin, name) || (q.Qtype == dns.TypeDS && z.origin == name) {
+			continue
+		}
+		if zone == nil || dns.CountLabel(z.origin) > dns.CountLabel(zone.origin) {
+			zone = z
+		}
+	}
+	m := zone.answer(q)
+
+	// Follow CNAMEs across zones.
+	if len(m.Answer) > 0 && q.Qtype != dns.TypeCNAME {
+		for _, rr := range m.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok && dns.CanonicalName(cname.Hdr.Name) == name {
+				next, err := n.exchange(dns.Question{Name: cname.Target, Qtype: q.Qtype, Qclass: q.Qclass})
+				if err != nil {
+					return nil, err
+				}
+				m.Answer = append(m.Answer, next.Answer...)
+				m.Ns = next.Ns
+				m.Rcode = next.Rcode
+				break
+			}
+		}
+	}
+	return m, nil
+}
+
+// newTestNet builds a signed root, a signed "test." zone using NSEC with a
+// signed child "n3.test." using NSEC3, and an unsigned child "insecure.test.".
+func newTestNet(t *testing.T) (testNet, *testZone) {
+	n3 := newTestZone(t, "n3.test.", signedNSEC3,
+		"www.n3.test. 300 IN A 192.0.2.3",
+		"*.wild.n3.test. 300 IN A 192.0.2.5",
+	)
+	insecure := newTestZone(t, "insecure.test.", unsigned,
+		"www.insecure.test. 300 IN A 192.0.2.4",
+	)
+	tld := newTestZone(t, "test.", signedNSEC,
+		"www.test. 300 IN A 192.0.2.1",
+		"alias.test. 300 IN CNAME www.test.",
+		"*.wild.test. 300 IN A 192.0.2.2",
+		"insecure.test. 3600 IN NS ns.insecure.test.",
+		"n3.test. 3600 IN NS ns.n3.test.",
+		n3.ds(),
+	)
+	root := newTestZone(t, ".", signedNSEC,
+		"test. 3600 IN NS ns.test.",
+		tld.ds(),
+	)
+	return testNet{root, tld, n3, insecure}, root
+}
+
+func TestValidator(t *testing.T) {
+	net, root := newTestNet(t)
+	anchors, err := ParseTrustAnchors(root.ds())
+	assert.Nil(t, err)
+	v, err := NewValidator(net.exchange, anchors)
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name     string
+		qtype    uint16
+		rcode    int
+		security statute.Security
+	}{
+		{"www.test.", dns.TypeA, dns.RcodeSuccess, statute.Secure},
+		{"alias.test.", dns.TypeA, dns.RcodeSuccess, statute.Secure},
+		{"nope.test.", dns.TypeA, dns.RcodeNameError, statute.Secure},
+		{"www.test.", dns.TypeTXT, dns.RcodeSuccess, statute.Secure},
+		{"host.wild.test.", dns.TypeA, dns.RcodeSuccess, statute.Secure},
+		{"www.insecure.test.", dns.TypeA, dns.RcodeSuccess, statute.Insecure},
+		{"www.n3.test.", dns.TypeA, dns.RcodeSuccess, statute.Secure},
+		{"nope.n3.test.", dns.TypeA, dns.RcodeNameError, statute.Secure},
+		{"www.n3.test.", dns.TypeTXT, dns.RcodeSuccess, statute.Secure},
+		{"wild.n3.test.", dns.TypeA, dns.RcodeSuccess, statute.Secure},
+		{"host.wild.n3.test.", dns.TypeA, dns.RcodeSuccess, statute.Secure},
+	}
+	for i, test := range tests {
+		msg, err := net.exchange(dns.Question{Name: test.name, Qtype: test.qtype, Qclass: dns.ClassINET})
+		assert.Nil(t, err, "test %d", i)
+		assert.Equal(t, test.rcode, msg.Rcode, "test %d", i)
+
+		security, err := v.Validate(msg)
+		assert.Nil(t, err, "test %d", i)
+		assert.Equal(t, test.security, security, "test %d", i)
+	}
+}
+
+func TestValidatorBogus(t *testing.T) {
+	net, root := newTestNet(t)
+	anchors, _ := ParseTrustAnchors(root.ds())
+	query := func(name string, qtype uint16) *dns.Msg {
+		msg, _ := net.exchange(dns.Question{Name: name, Qtype: qtype, Qclass: dns.ClassINET})
+		return msg
+	}
+
+	tests := []struct {
+		msg     *dns.Msg
+		anchors []dns.RR
+		now     time.Time
+	}{
+		// Tampered answer.
+		{msg: func() *dns.Msg {
+			m := query("www.test.", dns.TypeA)
+			m.Answer[0].(*dns.A).A[3] = 66
+			return m
+		}()},
+		// Stripped signatures.
+		{msg: func() *dns.Msg {
+			m := query("www.n3.test.", dns.TypeA)
+			m.Answer = m.Answer[:1]
+			return m
+		}()},
+		// Denial of existence of another name.
+		{msg: func() *dns.Msg {
+			m := query("nope.test.", dns.TypeA)
+			m.Question[0].Name = "www.test."
+			return m
+		}()},
+		// Missing denial of existence.
+		{msg: func() *dns.Msg {
+			m := query("nope.n3.test.", dns.TypeA)
+			m.Ns = m.Ns[:2]
+			return m
+		}()},
+		// Data claimed not to exist while it does.
+		{msg: func() *dns.Msg {
+			m := query("www.test.", dns.TypeTXT)
+			m.Question[0].Qtype = dns.TypeA
+			return m
+		}()},
+		// Expired signatures.
+		{msg: query("www.test.", dns.TypeA), now: time.Now().Add(48 * time.Hour)},
+		// Untrusted root key.
+		{msg: query("www.test.", dns.TypeA), anchors: func() []dns.RR {
+			other := newTestZone(t, ".", signedNSEC)
+			rrs, _ := ParseTrustAnchors(other.ds())
+			return rrs
+		}()},
+	}
+	for i, test := range tests {
+		a := anchors
+		if test.anchors != nil {
+			a = test.anchors
+		}
+		v, err := NewValidator(net.exchange, a)
+		assert.Nil(t, err, "test %d", i)
+		if !test.now.IsZero() {
+			v.now = func() time.Time { return test.now }
+		}
+
+		security, err := v.Validate(test.msg)
+		assert.Equal(t, statute.Bogus, security, "test %d", i)
+		assert.True(t, errors.Is(err, ErrBogus), "test %d: %v", i, err)
+	}
+}
+
+func TestValidatorIndeterminate(t *testing.T) {
+	net, _ := newTestNet(t)
+	other := newTestZone(t, "other.", signedNSEC)
+	anchors, _ := ParseTrustAnchors(other.ds())
+	v, err := NewValidator(net.exchange, anchors)
+	assert.Nil(t, err)
+
+	msg, _ := net.exchange(dns.Question{Name: "www.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	security, err := v.Validate(msg)
+	assert.Nil(t, err)
+	assert.Equal(t, statute.Indeterminate, security)
+
+	_, err = ParseTrustAnchors("www.test. IN A 192.0.2.1")
+	assert.NotNil(t, err)
+}
+
+func TestValidatorPrune(t *testing.T) {
+	net, root := newTestNet(t)
+	anchors, _ := ParseTrustAnchors(root.ds())
+	v, err := NewValidator(net.exchange, anchors)
+	assert.Nil(t, err)
+
+	expired := &zone{name: "insecure.test.", security: statute.Insecure, expires: time.Now().Add(-time.Second)}
+	for i := 0; i < maxZoneEntries; i++ {
+		v.zones[fmt.Sprintf("host%d.insecure.test.", i)] = expired
+	}
+	msg, _ := net.exchange(dns.Question{Name: "www.insecure.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	security, err := v.Validate(msg)
+	assert.Nil(t, err)
+	assert.Equal(t, statute.Insecure, security)
+	assert.Less(t, len(v.zones), 8)
+}
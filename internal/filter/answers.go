@@ -0,0 +1,93 @@
+package filter
+
+import (
+	"net"
+
+	"github.com/bepass-org/dnsutils/internal/statute"
+	"github.com/miekg/dns"
+)
+
+// AnswerAction is what is done with responses whose answer section matches
+// the blocklist.
+type AnswerAction int
+
+const (
+	// AnswerBlock blocks the whole response.
+	AnswerBlock AnswerAction = iota
+	// AnswerStrip removes the blocked addresses from the answer, and blocks
+	// the response only if none are left. Blocked CNAME targets still block
+	// the whole response.
+	AnswerStrip
+)
+
+// FilterAnswer matches the answer of rsp against the blocklist: CNAME
+// targets against the domain rules, to uncover trackers cloaked behind
+// first-party names, and addresses against the address rules. It reports
+// whether the response must be blocked as a whole.
+func (b *Blocklist) FilterAnswer(rsp statute.Response, action AnswerAction) (statute.Response, bool) {
+	var (
+		answers  = make([]statute.Answer, 0, len(rsp.Answers))
+		stripped = false
+	)
+	for _, a := range rsp.Answers {
+		switch a.Type {
+		case "CNAME":
+			if b.Match(a.Address) {
+				return rsp, true
+			}
+		case "A", "AAAA":
+			if ip := net.ParseIP(a.Address); ip != nil && b.MatchIP(ip) {
+				if action != AnswerStrip {
+					return rsp, true
+				}
+				stripped = true
+				continue
+			}
+		}
+		answers = append(answers, a)
+	}
+	if !stripped {
+		return rsp, false
+	}
+	if !hasAddress(answers) {
+		return rsp, true
+	}
+	rsp.Answers = answers
+
+	rsp.Msg = stripAddresses(rsp.Msg, b.MatchIP)
+	return rsp, false
+}
+
+// hasAddress reports whether answers hold an A or AAAA record.
+func hasAddress(answers []statute.Answer) bool {
+	for _, a := range answers {
+		if a.Type == "A" || a.Type == "AAAA" {
+			return true
+		}
+	}
+	return false
+}
+
+// stripAddresses returns a copy of msg without the A and AAAA answer records
+// holding addresses for which drop returns true.
+func stripAddresses(msg *dns.Msg, drop func(net.IP) bool) *dns.Msg {
+	if msg == nil {
+		return nil
+	}
+	stripped := msg.Copy()
+	stripped.Answer = stripped.Answer[:0]
+	for _, rr := range msg.Answer {
+		var ip net.IP
+		switch v := rr.(type) {
+		case *dns.A:
+			ip = v.A
+		case *dns.AAAA:
+			ip = v.AAAA
+		}
+		if ip != nil && drop(ip) {
+			continue
+		}
+		stripped.Answer = append(stripped.Answer, rr)
+	}
+	return stripped
+}
@@ -0,0 +1,41 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bepass-org/dnsutils/internal/statute"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlocklistFilterAnswer(t *testing.T) {
+	b := NewBlocklist()
+	_, _ = b.Load(strings.NewReader("||tracker.example^\n203.0.113.0/24\n@@203.0.113.9\n"))
+
+	cname := statute.Answer{Type: "CNAME", Address: "metrics.tracker.example."}
+	good := statute.Answer{Type: "A", Address: "192.0.2.1"}
+	bad := statute.Answer{Type: "A", Address: "203.0.113.5"}
+	allowed := statute.Answer{Type: "A", Address: "203.0.113.9"}
+
+	tests := []struct {
+		answers []statute.Answer
+		action  AnswerAction
+		exp     []statute.Answer
+		blocked bool
+	}{
+		{[]statute.Answer{good}, AnswerBlock, []statute.Answer{good}, false},
+		{[]statute.Answer{cname, good}, AnswerBlock, nil, true},
+		{[]statute.Answer{cname, good}, AnswerStrip, nil, true},
+		{[]statute.Answer{bad, good}, AnswerBlock, nil, true},
+		{[]statute.Answer{bad, good}, AnswerStrip, []statute.Answer{good}, false},
+		{[]statute.Answer{bad}, AnswerStrip, nil, true},
+		{[]statute.Answer{allowed}, AnswerBlock, []statute.Answer{allowed}, false},
+	}
+	for i, test := range tests {
+		rsp, blocked := b.FilterAnswer(statute.Response{Answers: test.answers}, test.action)
+		assert.Equal(t, test.blocked, blocked, "test %d", i)
+		if !blocked {
+			assert.Equal(t, test.exp, rsp.Answers, "test %d", i)
+		}
+	}
+}
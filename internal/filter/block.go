@@ -0,0 +1,47 @@
+package filter
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// blockedTTL is the TTL of the records answering blocked queries, short so
+// that unblocking takes effect quickly.
+const blockedTTL = 10
+
+// BlockMode is how queries for blocked domains are answered.
+type BlockMode int
+
+const (
+	// BlockNXDomain answers that the domain does not exist.
+	BlockNXDomain BlockMode = iota
+	// BlockZeroIP answers with the unspecified address, 0.0.0.0 or ::.
+	BlockZeroIP
+	// BlockRefused refuses the query.
+	BlockRefused
+)
+
+// Reply builds the response to a blocked question. With BlockZeroIP, the
+// questions of types other than A and AAAA get an empty answer.
+func (m BlockMode) Reply(q dns.Question) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.Response = true
+	msg.RecursionAvailable = true
+	msg.Question = []dns.Question{q}
+	switch m {
+	case BlockRefused:
+		msg.Rcode = dns.RcodeRefused
+	case BlockZeroIP:
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: q.Qclass, Ttl: blockedTTL}
+		switch q.Qtype {
+		case dns.TypeA:
+			msg.Answer = []dns.RR{&dns.A{Hdr: hdr, A: net.IPv4zero}}
+		case dns.TypeAAAA:
+			msg.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: net.IPv6unspecified}}
+		}
+	default:
+		msg.Rcode = dns.RcodeNameError
+	}
+	return msg
+}
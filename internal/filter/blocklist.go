@@ -0,0 +1,334 @@
+package filter
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// ErrUnsupportedRule is returned for rules that are valid for content
+// blockers but meaningless or unsupported for DNS, such as cosmetic rules.
+var ErrUnsupportedRule = errors.New("unsupported rule")
+
+// localNames are the names hosts files map to the local host, which are not
+// blocked.
+var localNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+// Blocklist matches domains against block and exception rules, loaded from
+// lists in hosts file, plain domain or adblock format:
+//
+//	0.0.0.0 ads.example.com   blocks ads.example.com
+//	ads.example.com           blocks ads.example.com
+//	*.ads.example.com         blocks the subdomains of ads.example.com
+//	||ads.example.com^        blocks ads.example.com and its subdomains
+//	||ad*.example.com^        wildcards match any characters
+//	@@||ads.example.com^      exempts from the block rules
+//	192.0.2.1                 blocks answers holding the address
+//	198.51.100.0/24           blocks answers holding addresses in the range
+//
+// Exceptions take precedence over block rules. It is safe for concurrent use.
+type Blocklist struct {
+	mu        sync.RWMutex
+	block     *trie
+	allow     *trie
+	blockRe   []*regexp.Regexp
+	allowRe   []*regexp.Regexp
+	blockNets []*net.IPNet
+	allowNets []*net.IPNet
+	rules     int
+}
+
+// NewBlocklist creates an empty blocklist.
+func NewBlocklist() *Blocklist {
+	return &Blocklist{block: newTrie(), allow: newTrie()}
+}
+
+// Len returns the number of rules in the blocklist.
+func (b *Blocklist) Len() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.rules
+}
+
+// Load adds the rules of a list, one per line, and returns the number of
+// rules added. Comments, blank lines and rules that cannot be used for DNS
+// are skipped, as lists are written for all kinds of content blockers.
+func (b *Blocklist) Load(r io.Reader) (int, error) {
+	n := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		added, _ := b.AddRule(scanner.Text())
+		n += added
+	}
+	return n, scanner.Err()
+}
+
+// AddRule adds a single line of a list and returns the number of rules it
+// holds, several for hosts file lines listing several names and none for
+// comments and blank lines.
+func (b *Blocklist) AddRule(rule string) (int, error) {
+	rule = strings.TrimSpace(rule)
+	if rule == "" || rule[0] == '!' || rule[0] == '#' || rule[0] == '[' {
+		return 0, nil
+	}
+	if strings.Contains(rule, "##") || strings.Contains(rule, "#@#") {
+		return 0, fmt.Errorf("%w: cosmetic rule %q", ErrUnsupportedRule, rule)
+	}
+	// Hosts files may have trailing comments.
+	if i := strings.Index(rule, " #"); i >= 0 {
+		rule = strings.TrimSpace(rule[:i])
+	}
+
+	if rule[0] == '/' {
+		return 0, fmt.Errorf("%w: regular expression %q", ErrUnsupportedRule, rule)
+	}
+	if rule[0] == '|' || strings.HasPrefix(rule, "@@") || strings.HasSuffix(rule, "^") || strings.Contains(rule, "$") {
+		return added(b.addAdblockRule(rule))
+	}
+
+	fields := strings.Fields(rule)
+	if len(fields) > 1 {
+		if net.ParseIP(fields[0]) == nil {
+			return 0, fmt.Errorf("%w: %q", ErrUnsupportedRule, rule)
+		}
+		n := 0
+		for _, name := range fields[1:] {
+			if localNames[strings.ToLower(name)] {
+				continue
+			}
+			if err := b.add(false, name, true, false); err != nil {
+				return n, err
+			}
+			n++
+		}
+		return n, nil
+	}
+
+	if n := parseNet(rule); n != nil {
+		return added(b.addNet(false, n))
+	}
+	if strings.HasPrefix(rule, "*.") {
+		return added(b.add(false, rule[2:], false, true))
+	}
+	return added(b.add(false, rule, true, false))
+}
+
+// added counts the rules added by a single rule line.
+func added(err error) (int, error) {
+	if err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// addAdblockRule adds a rule in adblock syntax.
+func (b *Blocklist) addAdblockRule(rule string) error {
+	allow := strings.HasPrefix(rule, "@@")
+	pattern := strings.TrimPrefix(rule, "@@")
+
+	if i := strings.IndexByte(pattern, '$'); i >= 0 {
+		// Modifiers restricting the rule to some clients or content types
+		// can't be honoured, so the rule is better left out.
+		for _, modifier := range strings.Split(pattern[i+1:], ",") {
+			if modifier != "important" {
+				return fmt.Errorf("%w: modifier %q in %q", ErrUnsupportedRule, modifier, rule)
+			}
+		}
+		pattern = pattern[:i]
+	}
+
+	subdomains := strings.HasPrefix(pattern, "||")
+	if subdomains {
+		pattern = pattern[2:]
+	} else if strings.HasPrefix(pattern, "|") {
+		pattern = pattern[1:]
+	}
+	pattern = strings.TrimSuffix(pattern, "^")
+	pattern = strings.TrimSuffix(pattern, "|")
+	if pattern == "" || (strings.ContainsAny(pattern, "/:^|") && parseNet(pattern) == nil) {
+		return fmt.Errorf("%w: %q", ErrUnsupportedRule, rule)
+	}
+	if n := parseNet(pattern); n != nil {
+		return b.addNet(allow, n)
+	}
+	if strings.HasPrefix(pattern, "*.") && !strings.Contains(pattern[2:], "*") {
+		return b.add(allow, pattern[2:], false, true)
+	}
+	return b.add(allow, pattern, true, subdomains)
+}
+
+// add adds a rule matching domain itself if exact is set, and its
+// subdomains if subdomains is set.
+func (b *Blocklist) add(allow bool, domain string, exact, subdomains bool) error {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if strings.Contains(domain, "*") {
+		re, err := wildcardRegexp(domain, subdomains)
+		if err != nil {
+			return err
+		}
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if allow {
+			b.allowRe = append(b.allowRe, re)
+		} else {
+			b.blockRe = append(b.blockRe, re)
+		}
+		b.rules++
+		return nil
+	}
+	if _, ok := dns.IsDomainName(domain); !ok || domain == "" {
+		return fmt.Errorf("invalid domain %q", domain)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t := b.block
+	if allow {
+		t = b.allow
+	}
+	t.insert(domain, exact, subdomains)
+	b.rules++
+	return nil
+}
+
+// addNet adds a rule matching the addresses in n.
+func (b *Blocklist) addNet(allow bool, n *net.IPNet) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if allow {
+		b.allowNets = append(b.allowNets, n)
+	} else {
+		b.blockNets = append(b.blockNets, n)
+	}
+	b.rules++
+	return nil
+}
+
+// parseNet parses an address or CIDR range rule, or returns nil.
+func parseNet(rule string) *net.IPNet {
+	if ip := net.ParseIP(rule); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	}
+	if _, n, err := net.ParseCIDR(rule); err == nil {
+		return n
+	}
+	return nil
+}
+
+// MatchIP reports whether answers holding ip are blocked.
+func (b *Blocklist) MatchIP(ip net.IP) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return containsIP(b.blockNets, ip) && !containsIP(b.allowNets, ip)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match reports whether domain is blocked.
+func (b *Blocklist) Match(domain string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return matches(b.block, b.blockRe, domain) && !matches(b.allow, b.allowRe, domain)
+}
+
+func matches(t *trie, res []*regexp.Regexp, domain string) bool {
+	if t.match(domain) {
+		return true
+	}
+	for _, re := range res {
+		if re.MatchString(domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// wildcardRegexp compiles a domain pattern where * matches any characters.
+func wildcardRegexp(pattern string, subdomains bool) (*regexp.Regexp, error) {
+	parts := strings.Split(pattern, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	expr := strings.Join(parts, ".*") + "$"
+	if subdomains {
+		expr = `(^|\.)` + expr
+	} else {
+		expr = "^" + expr
+	}
+	return regexp.Compile(expr)
+}
+
+// trie is a suffix trie of domains, keyed by labels from the root down.
+type trie struct {
+	children map[string]*trie
+	// exact matches the domain of the node, subdomains its subdomains.
+	exact      bool
+	subdomains bool
+}
+
+func newTrie() *trie {
+	return &trie{children: map[string]*trie{}}
+}
+
+func (t *trie) insert(domain string, exact, subdomains bool) {
+	node := t
+	labels := dns.SplitDomainName(domain)
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := node.children[labels[i]]
+		if !ok {
+			child = newTrie()
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+	node.exact = node.exact || exact
+	node.subdomains = node.subdomains || subdomains
+}
+
+func (t *trie) match(domain string) bool {
+	node := t
+	labels := dns.SplitDomainName(domain)
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := node.children[labels[i]]
+		if !ok {
+			return false
+		}
+		node = child
+		if i > 0 && node.subdomains {
+			return true
+		}
+	}
+	return node.exact
+}
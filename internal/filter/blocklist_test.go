@@ -0,0 +1,66 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testList = `! Title: test list
+[Adblock Plus 2.0]
+# hosts file
+127.0.0.1 localhost
+0.0.0.0 tracker.example.com tracker.example.net # trailing comment
+plain.example.org
+*.wild.example.org
+||adblock.example.com^
+||ad*.example.io^
+@@||ok.adblock.example.com^
+||important.example.com^$important
+||client.example.com^$client=127.0.0.1
+example.com##.banner
+/ads[0-9]+\.example\.com/
+`
+
+func TestBlocklistLoad(t *testing.T) {
+	b := NewBlocklist()
+	n, err := b.Load(strings.NewReader(testList))
+	assert.Nil(t, err)
+	assert.Equal(t, 8, n)
+	assert.Equal(t, 8, b.Len())
+}
+
+func TestBlocklistMatch(t *testing.T) {
+	b := NewBlocklist()
+	_, _ = b.Load(strings.NewReader(testList))
+
+	tests := []struct {
+		domain string
+		exp    bool
+	}{
+		{"localhost.", false},
+		{"tracker.example.com.", true},
+		{"Tracker.Example.NET", true},
+		{"sub.tracker.example.com.", false},
+		{"plain.example.org.", true},
+		{"sub.plain.example.org.", false},
+		{"wild.example.org.", false},
+		{"a.b.wild.example.org.", true},
+		{"adblock.example.com.", true},
+		{"x.adblock.example.com.", true},
+		{"notadblock.example.com.", false},
+		{"ok.adblock.example.com.", false},
+		{"sub.ok.adblock.example.com.", false},
+		{"ads.example.io.", true},
+		{"cdn.adserver.example.io.", true},
+		{"bad.example.io.", false},
+		{"important.example.com.", true},
+		{"client.example.com.", false},
+		{"ads1.example.com.", false},
+		{"example.com.", false},
+	}
+	for i, test := range tests {
+		assert.Equal(t, test.exp, b.Match(test.domain), "test %d", i)
+	}
+}
@@ -0,0 +1,115 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/bepass-org/dnsutils/internal/statute"
+	"github.com/miekg/dns"
+)
+
+// ErrRebinding is returned when a public name resolves to a private address
+// and the rebinding filter rejects such answers.
+var ErrRebinding = errors.New("possible DNS rebinding: private address in answer")
+
+// thisNetwork is 0.0.0.0/8, which reaches the local host on most systems.
+var thisNetwork = &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(8, 32)}
+
+// Rebinding protects against DNS rebinding by keeping private, loopback and
+// link-local addresses out of the answers for public names.
+type Rebinding struct {
+	nets    []*net.IPNet
+	allowed []string
+	reject  bool
+}
+
+// NewRebinding creates a rebinding filter blocking the internal address
+// ranges and nets, except for allowed domains and their subdomains. With
+// reject, answers holding blocked addresses fail with ErrRebinding instead
+// of having the addresses stripped.
+func NewRebinding(nets []*net.IPNet, allowed []string, reject bool) *Rebinding {
+	f := &Rebinding{nets: append([]*net.IPNet{thisNetwork}, nets...), reject: reject}
+	for _, domain := range allowed {
+		f.allowed = append(f.allowed, dns.CanonicalName(domain))
+	}
+	return f
+}
+
+// Allowed reports whether domain may resolve to internal addresses.
+func (f *Rebinding) Allowed(domain string) bool {
+	domain = dns.CanonicalName(domain)
+	for _, allowed := range f.allowed {
+		if dns.IsSubDomain(allowed, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Blocked reports whether ip must not be served for public names.
+func (f *Rebinding) Blocked(ip net.IP) bool {
+	if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, n := range f.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterIPs removes the blocked addresses from the ips domain resolved to.
+func (f *Rebinding) FilterIPs(domain string, ips []string) ([]string, error) {
+	if f.Allowed(domain) {
+		return ips, nil
+	}
+	kept := make([]string, 0, len(ips))
+	for _, s := range ips {
+		ip := net.ParseIP(s)
+		if err := f.check(domain, ip); err != nil {
+			return nil, err
+		}
+		if ip != nil && f.Blocked(ip) {
+			continue
+		}
+		kept = append(kept, s)
+	}
+	return kept, nil
+}
+
+// FilterResponse removes the A and AAAA records holding blocked addresses
+// from the response for domain.
+func (f *Rebinding) FilterResponse(domain string, rsp statute.Response) (statute.Response, error) {
+	if f.Allowed(domain) {
+		return rsp, nil
+	}
+	answers := make([]statute.Answer, 0, len(rsp.Answers))
+	for _, a := range rsp.Answers {
+		if a.Type == "A" || a.Type == "AAAA" {
+			ip := net.ParseIP(a.Address)
+			if err := f.check(domain, ip); err != nil {
+				return rsp, err
+			}
+			if ip != nil && f.Blocked(ip) {
+				continue
+			}
+		}
+		answers = append(answers, a)
+	}
+	rsp.Answers = answers
+
+	rsp.Msg = stripAddresses(rsp.Msg, f.Blocked)
+	return rsp, nil
+}
+
+// check returns ErrRebinding if ip is blocked and the filter rejects.
+func (f *Rebinding) check(domain string, ip net.IP) error {
+	if f.reject && ip != nil && f.Blocked(ip) {
+		return fmt.Errorf("%s: %w %s", strings.TrimSuffix(domain, "."), ErrRebinding, ip)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package filter
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRebindingFilterIPs(t *testing.T) {
+	_, extra, _ := net.ParseCIDR("203.0.113.0/24")
+
+	tests := []struct {
+		domain string
+		ips    []string
+		reject bool
+		exp    []string
+		err    bool
+	}{
+		{"example.com.", []string{"93.184.216.34"}, false, []string{"93.184.216.34"}, false},
+		{"example.com.", []string{"127.0.0.1", "93.184.216.34"}, false, []string{"93.184.216.34"}, false},
+		{"example.com.", []string{"192.168.1.1", "10.0.0.1", "172.16.0.1"}, false, []string{}, false},
+		{"example.com.", []string{"169.254.169.254", "0.0.0.0", "::1", "fe80::1", "fd00::1"}, false, []string{}, false},
+		{"example.com.", []string{"203.0.113.7"}, false, []string{}, false},
+		{"example.com.", []string{"93.184.216.34", "10.0.0.1"}, true, nil, true},
+		{"router.lan.", []string{"192.168.1.1"}, true, []string{"192.168.1.1"}, false},
+		{"NAS.Router.LAN", []string{"192.168.1.2"}, true, []string{"192.168.1.2"}, false},
+		{"notrouter.lan.", []string{"192.168.1.1"}, false, []string{}, false},
+	}
+	for i, test := range tests {
+		f := NewRebinding([]*net.IPNet{extra}, []string{"router.lan"}, test.reject)
+		ips, err := f.FilterIPs(test.domain, test.ips)
+		if test.err {
+			assert.ErrorIs(t, err, ErrRebinding, "test %d", i)
+			continue
+		}
+		assert.Nil(t, err, "test %d", i)
+		assert.Equal(t, test.exp, ips, "test %d", i)
+	}
+}
@@ -0,0 +1,170 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// rewriteTTL is the TTL of the records synthesized by rewrites.
+const rewriteTTL = 300
+
+// maxRewriteChain is the longest chain of CNAME rewrites followed.
+const maxRewriteChain = 8
+
+// ErrRewriteLoop is returned for CNAME rewrites leading back to themselves or
+// chaining too deep.
+var ErrRewriteLoop = errors.New("rewrite loop")
+
+// rewrite is the rule for one name: either a redirection to another name or
+// static records.
+type rewrite struct {
+	cname string
+	rrs   []dns.RR
+}
+
+// Rewrites answers queries from rules instead of the upstreams. Names may be
+// wildcards like *.example.com, matching all the subdomains of example.com;
+// the rule of the closest name applies. It is safe for concurrent use.
+type Rewrites struct {
+	mu    sync.RWMutex
+	rules map[string]*rewrite
+}
+
+// Rewrite is the answer of a rewrite.
+type Rewrite struct {
+	// Answer holds the CNAME records of the redirections, followed by the
+	// static records of the question type.
+	Answer []dns.RR
+	// Target is the name left to resolve upstream at the end of the
+	// redirections, or empty if Answer is complete.
+	Target string
+}
+
+// NewRewrites creates an empty rule set.
+func NewRewrites() *Rewrites {
+	return &Rewrites{rules: map[string]*rewrite{}}
+}
+
+// Add adds a rule answering the queries for name. answer is either an IP
+// address, a domain name to redirect to, or a record of any type without
+// the owner, like "MX 10 mail.example.com.". Several static records may be
+// added for the same name, but a redirection excludes any other record.
+func (r *Rewrites) Add(name, answer string) error {
+	name = dns.CanonicalName(name)
+	if _, ok := dns.IsDomainName(name); !ok {
+		return fmt.Errorf("invalid rewrite name %q", name)
+	}
+	answer = strings.TrimSpace(answer)
+
+	var (
+		cname string
+		rr    dns.RR
+		err   error
+	)
+	if ip := net.ParseIP(answer); ip != nil {
+		if ip.To4() != nil {
+			rr = &dns.A{A: ip.To4(), Hdr: dns.RR_Header{Rrtype: dns.TypeA}}
+		} else {
+			rr = &dns.AAAA{AAAA: ip, Hdr: dns.RR_Header{Rrtype: dns.TypeAAAA}}
+		}
+	} else if !strings.ContainsAny(answer, " \t") {
+		if _, ok := dns.IsDomainName(answer); !ok || answer == "" {
+			return fmt.Errorf("invalid rewrite target %q", answer)
+		}
+		cname = dns.CanonicalName(answer)
+	} else {
+		// The owner is replaced by the query name when answering.
+		rr, err = dns.NewRR(fmt.Sprintf("rewrite. %d IN %s", rewriteTTL, answer))
+		if err != nil || rr == nil {
+			return fmt.Errorf("invalid rewrite record %q: %v", answer, err)
+		}
+	}
+	if rr != nil {
+		rr.Header().Class = dns.ClassINET
+		rr.Header().Ttl = rewriteTTL
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rule, ok := r.rules[name]
+	if !ok {
+		rule = &rewrite{}
+	}
+	switch {
+	case cname != "" && (rule.cname != "" || len(rule.rrs) > 0),
+		rr != nil && rule.cname != "":
+		return fmt.Errorf("rewrite of %s: a redirection can't be mixed with other records", name)
+	case cname != "":
+		rule.cname = cname
+	default:
+		rule.rrs = append(rule.rrs, rr)
+	}
+	r.rules[name] = rule
+	return nil
+}
+
+// Rewrite answers q from the rules. It returns nil if no rule applies.
+// Questions for names with static records but none of the question type
+// get an empty answer.
+func (r *Rewrites) Rewrite(q dns.Question) (*Rewrite, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var (
+		rw   = &Rewrite{}
+		name = q.Name
+		seen = map[string]bool{}
+	)
+	for {
+		rule := r.match(name)
+		if rule == nil {
+			if len(rw.Answer) == 0 {
+				return nil, nil
+			}
+			rw.Target = name
+			return rw, nil
+		}
+		if rule.cname == "" {
+			for _, rr := range rule.rrs {
+				if rr.Header().Rrtype == q.Qtype || q.Qtype == dns.TypeANY {
+					rr = dns.Copy(rr)
+					rr.Header().Name = name
+					rw.Answer = append(rw.Answer, rr)
+				}
+			}
+			return rw, nil
+		}
+
+		seen[dns.CanonicalName(name)] = true
+		if seen[rule.cname] || len(seen) > maxRewriteChain {
+			return nil, fmt.Errorf("%s: %w", q.Name, ErrRewriteLoop)
+		}
+		rw.Answer = append(rw.Answer, &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: rewriteTTL},
+			Target: rule.cname,
+		})
+		if q.Qtype == dns.TypeCNAME {
+			return rw, nil
+		}
+		name = rule.cname
+	}
+}
+
+// match returns the rule of name, or of its closest wildcard.
+func (r *Rewrites) match(name string) *rewrite {
+	name = dns.CanonicalName(name)
+	if rule, ok := r.rules[name]; ok {
+		return rule
+	}
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		if rule, ok := r.rules["*."+name[off:]]; ok {
+			return rule
+		}
+	}
+	return nil
+}
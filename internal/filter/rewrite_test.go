@@ -0,0 +1,71 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRewrites(t *testing.T) {
+	r := NewRewrites()
+	for _, rule := range [][2]string{
+		{"static.test", "192.0.2.1"},
+		{"static.test", "2001:db8::1"},
+		{"static.test", `TXT "hello world"`},
+		{"static.test", "MX 10 mail.static.test."},
+		{"*.wild.test", "192.0.2.2"},
+		{"deep.wild.test", "192.0.2.3"},
+		{"alias.test", "static.test"},
+		{"external.test", "example.com"},
+		{"loop1.test", "loop2.test"},
+		{"loop2.test", "loop1.test"},
+	} {
+		assert.Nil(t, r.Add(rule[0], rule[1]), rule[0])
+	}
+	assert.NotNil(t, r.Add("alias.test", "192.0.2.9"))
+	assert.NotNil(t, r.Add("static.test", "other.test"))
+	assert.NotNil(t, r.Add("bad.test", "SRV broken"))
+
+	tests := []struct {
+		name   string
+		qtype  uint16
+		exp    []string
+		target string
+		err    bool
+	}{
+		{"static.test.", dns.TypeA, []string{"static.test.\t300\tIN\tA\t192.0.2.1"}, "", false},
+		{"Static.Test.", dns.TypeAAAA, []string{"Static.Test.\t300\tIN\tAAAA\t2001:db8::1"}, "", false},
+		{"static.test.", dns.TypeTXT, []string{"static.test.\t300\tIN\tTXT\t\"hello world\""}, "", false},
+		{"static.test.", dns.TypeMX, []string{"static.test.\t300\tIN\tMX\t10 mail.static.test."}, "", false},
+		{"static.test.", dns.TypeSRV, nil, "", false},
+		{"a.b.wild.test.", dns.TypeA, []string{"a.b.wild.test.\t300\tIN\tA\t192.0.2.2"}, "", false},
+		{"deep.wild.test.", dns.TypeA, []string{"deep.wild.test.\t300\tIN\tA\t192.0.2.3"}, "", false},
+		{"alias.test.", dns.TypeA, []string{
+			"alias.test.\t300\tIN\tCNAME\tstatic.test.",
+			"static.test.\t300\tIN\tA\t192.0.2.1",
+		}, "", false},
+		{"external.test.", dns.TypeA, []string{"external.test.\t300\tIN\tCNAME\texample.com."}, "example.com.", false},
+		{"loop1.test.", dns.TypeA, nil, "", true},
+	}
+	for i, test := range tests {
+		rw, err := r.Rewrite(dns.Question{Name: test.name, Qtype: test.qtype, Qclass: dns.ClassINET})
+		if test.err {
+			assert.ErrorIs(t, err, ErrRewriteLoop, "test %d", i)
+			continue
+		}
+		if !assert.Nil(t, err, "test %d", i) || !assert.NotNil(t, rw, "test %d", i) {
+			continue
+		}
+		var answer []string
+		for _, rr := range rw.Answer {
+			answer = append(answer, rr.String())
+		}
+		assert.Equal(t, test.exp, answer, "test %d", i)
+		assert.Equal(t, test.target, rw.Target, "test %d", i)
+	}
+
+	rw, err := r.Rewrite(dns.Question{Name: "wild.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	assert.Nil(t, err)
+	assert.Nil(t, rw)
+}
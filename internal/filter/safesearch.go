@@ -0,0 +1,62 @@
+package filter
+
+// googleDomains are the country domains of Google Search redirected to
+// SafeSearch, besides google.com.
+var googleDomains = []string{
+	"google.ad", "google.ae", "google.al", "google.am", "google.at", "google.az",
+	"google.ba", "google.be", "google.bg", "google.by", "google.ca", "google.ch",
+	"google.cl", "google.cn", "google.co.id", "google.co.il", "google.co.in",
+	"google.co.jp", "google.co.kr", "google.co.nz", "google.co.th", "google.co.uk",
+	"google.co.za", "google.com.ar", "google.com.au", "google.com.br",
+	"google.com.co", "google.com.eg", "google.com.hk", "google.com.mx",
+	"google.com.my", "google.com.ng", "google.com.pe", "google.com.ph",
+	"google.com.pk", "google.com.sa", "google.com.sg", "google.com.tr",
+	"google.com.tw", "google.com.ua", "google.com.vn", "google.cz", "google.de",
+	"google.dk", "google.ee", "google.es", "google.fi", "google.fr", "google.gr",
+	"google.hr", "google.hu", "google.ie", "google.is", "google.it", "google.kz",
+	"google.lt", "google.lu", "google.lv", "google.md", "google.mk", "google.nl",
+	"google.no", "google.pl", "google.pt", "google.ro", "google.rs", "google.ru",
+	"google.se", "google.si", "google.sk",
+}
+
+// youtubeDomains are the names YouTube is served from.
+var youtubeDomains = []string{
+	"www.youtube.com", "m.youtube.com", "youtubei.googleapis.com",
+	"youtube.googleapis.com", "www.youtube-nocookie.com",
+}
+
+// AddSafeSearch adds the rewrites enforcing SafeSearch on Google, Bing,
+// DuckDuckGo and Yandex, and the restricted mode of YouTube, moderate or
+// strict.
+func (r *Rewrites) AddSafeSearch(strictYouTube bool) error {
+	rules := [][2]string{
+		{"google.com", "forcesafesearch.google.com"},
+		{"www.google.com", "forcesafesearch.google.com"},
+		{"www.bing.com", "strict.bing.com"},
+		{"duckduckgo.com", "safe.duckduckgo.com"},
+		{"www.duckduckgo.com", "safe.duckduckgo.com"},
+		{"yandex.com", "familysearch.yandex.ru"},
+		{"www.yandex.com", "familysearch.yandex.ru"},
+		{"yandex.ru", "familysearch.yandex.ru"},
+		{"www.yandex.ru", "familysearch.yandex.ru"},
+	}
+	for _, domain := range googleDomains {
+		rules = append(rules,
+			[2]string{domain, "forcesafesearch.google.com"},
+			[2]string{"www." + domain, "forcesafesearch.google.com"})
+	}
+	youtube := "restrictmoderate.youtube.com"
+	if strictYouTube {
+		youtube = "restrict.youtube.com"
+	}
+	for _, domain := range youtubeDomains {
+		rules = append(rules, [2]string{domain, youtube})
+	}
+
+	for _, rule := range rules {
+		if err := r.Add(rule[0], rule[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bepass-org/dnsutils/internal/dialer"
+)
+
+// httpConnect dials through an HTTP proxy using the CONNECT method. Only
+// stream connections can be carried.
+type httpConnect struct {
+	addr     string
+	user     string
+	password string
+	forward  dialer.TDialerFunc
+}
+
+// DialContext connects to addr through the proxy.
+func (h *httpConnect) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil, ErrUDPNotSupported
+	}
+
+	conn, err := h.forward(ctx, "tcp", h.addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if h.user != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(h.user + ":" + h.password))
+		req += "Proxy-Authorization: Basic " + auth + "\r\n"
+	}
+	if _, err = conn.Write([]byte(req + "\r\n")); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("proxy: CONNECT %s: %s", addr, resp.Status)
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	// The proxy may have sent data from the target along with its reply.
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a net.Conn whose reads go through a bufio.Reader holding
+// bytes that were read ahead.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/bepass-org/dnsutils/internal/dialer"
+)
+
+var (
+	// ErrUnsupportedScheme is returned for proxy URLs with an unknown scheme.
+	ErrUnsupportedScheme = errors.New("proxy: unsupported scheme")
+
+	// ErrUDPNotSupported is returned when dialing UDP through a proxy that
+	// can only carry streams.
+	ErrUDPNotSupported = errors.New("proxy: udp is not supported")
+)
+
+// Parse returns a dialer function tunnelling every connection through the
+// proxy at proxyURL. Supported schemes are socks5 (or socks5h, both letting
+// the proxy resolve hostnames) and http for HTTP CONNECT. forward is used to
+// reach the proxy itself; if nil, a net.Dialer is used.
+func Parse(proxyURL string, forward dialer.TDialerFunc) (dialer.TDialerFunc, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	return FromURL(u, forward)
+}
+
+// FromURL is like Parse but takes an already parsed URL.
+func FromURL(u *url.URL, forward dialer.TDialerFunc) (dialer.TDialerFunc, error) {
+	if forward == nil {
+		forward = (&net.Dialer{}).DialContext
+	}
+
+	var user, password string
+	if u.User != nil {
+		user = u.User.Username()
+		password, _ = u.User.Password()
+	}
+
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		s := &socks5{
+			addr:     hostPort(u, "1080"),
+			user:     user,
+			password: password,
+			forward:  forward,
+		}
+		return s.DialContext, nil
+	case "http":
+		h := &httpConnect{
+			addr:     hostPort(u, "80"),
+			user:     user,
+			password: password,
+			forward:  forward,
+		}
+		return h.DialContext, nil
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnsupportedScheme, u.Scheme)
+	}
+}
+
+// hostPort returns the proxy address of u, adding defaultPort if missing.
+func hostPort(u *url.URL, defaultPort string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), defaultPort)
+}
@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/dnsutils/internal/proxy/proxytest"
+	"github.com/bepass-org/dnsutils/internal/proxy/socks"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// startEchoServer starts a TCP server echoing back everything it reads.
+func startEchoServer(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// startDNSServer starts a UDP DNS server answering every A query.
+func startDNSServer(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 192.0.2.1")
+		m.Answer = append(m.Answer, rr)
+		_ = w.WriteMsg(m)
+	})}
+	go func() { _ = server.ActivateAndServe() }()
+	t.Cleanup(func() { _ = server.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func TestProxyTCP(t *testing.T) {
+	echo := startEchoServer(t)
+	socks := proxytest.NewSOCKS5(t, "", "").Addr
+	socksAuth := proxytest.NewSOCKS5(t, "user", "secret").Addr
+	httpProxy := proxytest.NewHTTP(t, "user", "secret").Addr
+
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"socks5://" + socks, true},
+		{"socks5h://user:secret@" + socksAuth, true},
+		{"socks5://user:wrong@" + socksAuth, false},
+		{"http://user:secret@" + httpProxy, true},
+		{"http://" + httpProxy, false},
+	}
+	for i, test := range tests {
+		dial, err := Parse(test.url, nil)
+		if !assert.Nil(t, err, "test %d", i) {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		conn, err := dial(ctx, "tcp", echo)
+		cancel()
+		if !test.ok {
+			assert.NotNil(t, err, "test %d", i)
+			continue
+		}
+		if !assert.Nil(t, err, "test %d", i) {
+			continue
+		}
+
+		_, err = conn.Write([]byte("ping"))
+		assert.Nil(t, err, "test %d", i)
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(conn, buf)
+		assert.Nil(t, err, "test %d", i)
+		assert.Equal(t, "ping", string(buf), "test %d", i)
+		_ = conn.Close()
+	}
+}
+
+func TestProxyUDP(t *testing.T) {
+	server := startDNSServer(t)
+
+	dial, err := Parse("socks5://"+proxytest.NewSOCKS5(t, "", "").Addr, nil)
+	assert.Nil(t, err)
+	conn, err := dial(context.Background(), "udp", server)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	// DNS clients only treat packet connections as UDP.
+	_, ok := conn.(net.PacketConn)
+	assert.True(t, ok)
+
+	co := &dns.Conn{Conn: conn}
+	_ = co.SetDeadline(time.Now().Add(2 * time.Second))
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	assert.Nil(t, co.WriteMsg(msg))
+	in, err := co.ReadMsg()
+	if assert.Nil(t, err) && assert.Len(t, in.Answer, 1) {
+		assert.Equal(t, "192.0.2.1", in.Answer[0].(*dns.A).A.String())
+	}
+
+	dial, err = Parse("http://"+proxytest.NewHTTP(t, "", "").Addr, nil)
+	assert.Nil(t, err)
+	_, err = dial(context.Background(), "udp", server)
+	assert.True(t, errors.Is(err, ErrUDPNotSupported))
+
+	_, err = Parse("ftp://127.0.0.1", nil)
+	assert.True(t, errors.Is(err, ErrUnsupportedScheme))
+}
+
+func TestSOCKSUDPConnRead(t *testing.T) {
+	relay, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	udp, err := net.Dial("udp", relay.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctrl, _ := net.Pipe()
+	tests := []struct {
+		target string
+		from   []string
+	}{
+		{"192.0.2.1:53", []string{"192.0.2.2:53", "192.0.2.1:5353", "192.0.2.1:53"}},
+		{"dns.test:53", []string{"192.0.2.1:5353", "192.0.2.9:53"}},
+	}
+	for i, test := range tests {
+		conn := &socksUDPConn{Conn: udp, ctrl: ctrl, target: proxyAddr{network: "udp", addr: test.target}}
+
+		// Only the last datagram comes from the target, after an empty one.
+		for j, from := range test.from {
+			header, err := socks.AppendAddr([]byte{0, 0, 0}, from)
+			assert.Nil(t, err, "test %d", i)
+			if j == len(test.from)-1 {
+				_, _ = relay.WriteTo(header, udp.LocalAddr())
+			}
+			_, _ = relay.WriteTo(append(header, from...), udp.LocalAddr())
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		b := make([]byte, 512)
+		n, err := conn.Read(b)
+		assert.Nil(t, err, "test %d", i)
+		assert.Equal(t, test.from[len(test.from)-1], string(b[:n]), "test %d", i)
+	}
+}
@@ -0,0 +1,204 @@
+// Package proxytest provides minimal SOCKS5 and HTTP CONNECT proxies for
+// tests, recording the targets they are asked to reach.
+package proxytest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/dnsutils/internal/proxy/socks"
+)
+
+// Proxy is a running test proxy.
+type Proxy struct {
+	// Addr is the address the proxy listens on.
+	Addr string
+
+	mu      sync.Mutex
+	targets []string
+}
+
+// Targets returns the addresses the proxy connected to or relayed datagrams
+// to, in order.
+func (p *Proxy) Targets() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.targets...)
+}
+
+func (p *Proxy) addTarget(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.targets = append(p.targets, addr)
+}
+
+// serve accepts connections on a new listener until the test ends.
+func (p *Proxy) serve(t testing.TB, handle func(net.Conn)) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	p.Addr = ln.Addr().String()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+}
+
+// NewSOCKS5 starts a SOCKS5 proxy supporting CONNECT and UDP ASSOCIATE,
+// requiring a password if user is not empty.
+func NewSOCKS5(t testing.TB, user, password string) *Proxy {
+	p := &Proxy{}
+	p.serve(t, func(conn net.Conn) { p.serveSOCKS5(conn, user, password) })
+	return p
+}
+
+func (p *Proxy) serveSOCKS5(conn net.Conn, user, password string) {
+	defer conn.Close()
+
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return
+	}
+	methods := make([]byte, buf[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+
+	if user == "" {
+		_, _ = conn.Write([]byte{socks.Version, socks.AuthNone})
+	} else {
+		_, _ = conn.Write([]byte{socks.Version, socks.AuthPassword})
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		u := make([]byte, buf[1])
+		_, _ = io.ReadFull(conn, u)
+		_, _ = io.ReadFull(conn, buf[:1])
+		pw := make([]byte, buf[0])
+		_, _ = io.ReadFull(conn, pw)
+		if string(u) != user || string(pw) != password {
+			_, _ = conn.Write([]byte{socks.PasswordVersion, 1})
+			return
+		}
+		_, _ = conn.Write([]byte{socks.PasswordVersion, 0})
+	}
+
+	req := make([]byte, 3)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return
+	}
+	addr, err := socks.ReadAddr(conn)
+	if err != nil {
+		return
+	}
+
+	switch req[1] {
+	case socks.CmdConnect:
+		p.addTarget(addr)
+		target, err := net.Dial("tcp", addr)
+		if err != nil {
+			_, _ = conn.Write([]byte{socks.Version, 5, 0, socks.AtypIPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer target.Close()
+		reply, _ := socks.AppendAddr([]byte{socks.Version, 0, 0}, target.LocalAddr().String())
+		_, _ = conn.Write(reply)
+		go func() { _, _ = io.Copy(target, conn) }()
+		_, _ = io.Copy(conn, target)
+	case socks.CmdUDPAssociate:
+		relay, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return
+		}
+		defer relay.Close()
+		_, port, _ := net.SplitHostPort(relay.LocalAddr().String())
+		reply, _ := socks.AppendAddr([]byte{socks.Version, 0, 0}, net.JoinHostPort("0.0.0.0", port))
+		_, _ = conn.Write(reply)
+		go p.relayUDP(relay)
+		// The association lasts as long as the control connection.
+		_, _ = io.Copy(io.Discard, conn)
+	default:
+		_, _ = conn.Write([]byte{socks.Version, 7, 0, socks.AtypIPv4, 0, 0, 0, 0, 0, 0})
+	}
+}
+
+// relayUDP forwards datagrams between a single client and its targets.
+func (p *Proxy) relayUDP(relay net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, client, err := relay.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if n < 4 {
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		addr, err := socks.ReadAddr(r)
+		if err != nil {
+			continue
+		}
+		payload, _ := io.ReadAll(r)
+		p.addTarget(addr)
+
+		target, err := net.Dial("udp", addr)
+		if err != nil {
+			continue
+		}
+		_, _ = target.Write(payload)
+		_ = target.SetReadDeadline(time.Now().Add(time.Second))
+		resp := make([]byte, 65535)
+		m, err := target.Read(resp)
+		_ = target.Close()
+		if err != nil {
+			continue
+		}
+		header, _ := socks.AppendAddr([]byte{0, 0, 0}, addr)
+		_, _ = relay.WriteTo(append(header, resp[:m]...), client)
+	}
+}
+
+// NewHTTP starts an HTTP CONNECT proxy, requiring basic auth if user is not
+// empty.
+func NewHTTP(t testing.TB, user, password string) *Proxy {
+	p := &Proxy{}
+	p.serve(t, func(conn net.Conn) {
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil || req.Method != http.MethodConnect {
+			return
+		}
+		if user != "" {
+			want := "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+			if req.Header.Get("Proxy-Authorization") != want {
+				_, _ = conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+				return
+			}
+		}
+		p.addTarget(req.Host)
+		target, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			_, _ = conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+			return
+		}
+		defer target.Close()
+		_, _ = conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+		go func() { _, _ = io.Copy(target, conn) }()
+		_, _ = io.Copy(conn, target)
+	})
+	return p
+}
@@ -0,0 +1,99 @@
+// Package socks encodes and decodes the SOCKS5 wire format, shared by the
+// proxy dialers and the test proxies so that they can't drift apart.
+package socks
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// SOCKS5 protocol constants, see RFC 1928 and RFC 1929.
+const (
+	Version = 0x05
+
+	AuthNone         = 0x00
+	AuthPassword     = 0x02
+	AuthNoAcceptable = 0xff
+
+	PasswordVersion = 0x01
+
+	CmdConnect      = 0x01
+	CmdUDPAssociate = 0x03
+
+	AtypIPv4   = 0x01
+	AtypDomain = 0x03
+	AtypIPv6   = 0x04
+)
+
+// AppendAddr appends the SOCKS5 encoding of addr to b.
+func AppendAddr(b []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: invalid port in %s", addr)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, AtypIPv4)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, AtypIPv6)
+			b = append(b, ip.To16()...)
+		}
+	} else {
+		host = strings.TrimSuffix(host, ".")
+		if len(host) > 255 {
+			return nil, fmt.Errorf("proxy: hostname too long: %s", host)
+		}
+		b = append(b, AtypDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return append(b, byte(port>>8), byte(port)), nil
+}
+
+// ReadAddr reads a SOCKS5 encoded address from r.
+func ReadAddr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch atyp[0] {
+	case AtypIPv4, AtypIPv6:
+		size := net.IPv4len
+		if atyp[0] == AtypIPv6 {
+			size = net.IPv6len
+		}
+		ip := make(net.IP, size)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case AtypDomain:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(r, size); err != nil {
+			return "", err
+		}
+		name := make([]byte, size[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("proxy: unknown SOCKS5 address type %d", atyp[0])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), nil
+}
@@ -0,0 +1,282 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/bepass-org/dnsutils/internal/dialer"
+	"github.com/bepass-org/dnsutils/internal/proxy/socks"
+)
+
+// maxUDPHeaderSize is the size of the largest UDP request header, with a 255
+// bytes long domain name.
+const maxUDPHeaderSize = 3 + 1 + 1 + 255 + 2
+
+// socksReplies describes the SOCKS5 reply codes.
+var socksReplies = []string{
+	"succeeded",
+	"general SOCKS server failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+// socks5 dials through a SOCKS5 proxy, using CONNECT for TCP and UDP
+// ASSOCIATE for UDP.
+type socks5 struct {
+	addr     string
+	user     string
+	password string
+	forward  dialer.TDialerFunc
+}
+
+// DialContext connects to addr through the proxy.
+func (s *socks5) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		conn, err := s.handshake(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = s.request(conn, socks.CmdConnect, addr); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		_ = conn.SetDeadline(time.Time{})
+		return conn, nil
+	case "udp", "udp4", "udp6":
+		return s.associate(ctx, network, addr)
+	default:
+		return nil, fmt.Errorf("proxy: unsupported network %s", network)
+	}
+}
+
+// associate sets up a UDP relay for addr. The control connection is kept
+// open for as long as the relay is used, as required by the protocol.
+func (s *socks5) associate(ctx context.Context, network, addr string) (net.Conn, error) {
+	header, err := socks.AppendAddr([]byte{0, 0, 0}, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctrl, err := s.handshake(ctx)
+	if err != nil {
+		return nil, err
+	}
+	bound, err := s.request(ctrl, socks.CmdUDPAssociate, "0.0.0.0:0")
+	if err != nil {
+		_ = ctrl.Close()
+		return nil, err
+	}
+	_ = ctrl.SetDeadline(time.Time{})
+
+	// An unspecified relay address means the proxy's own address.
+	host, port, _ := net.SplitHostPort(bound)
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host, _, _ = net.SplitHostPort(ctrl.RemoteAddr().String())
+	}
+
+	relay, err := s.forward(ctx, network, net.JoinHostPort(host, port))
+	if err != nil {
+		_ = ctrl.Close()
+		return nil, err
+	}
+
+	return &socksUDPConn{
+		Conn:   relay,
+		ctrl:   ctrl,
+		header: header,
+		target: proxyAddr{network: network, addr: addr},
+	}, nil
+}
+
+// handshake connects to the proxy and authenticates.
+func (s *socks5) handshake(ctx context.Context) (net.Conn, error) {
+	conn, err := s.forward(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if err = s.authenticate(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// authenticate negotiates the authentication method with the proxy.
+func (s *socks5) authenticate(conn net.Conn) error {
+	methods := []byte{socks.AuthNone}
+	if s.user != "" {
+		methods = append(methods, socks.AuthPassword)
+	}
+	greeting := append([]byte{socks.Version, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks.Version {
+		return fmt.Errorf("proxy: unexpected SOCKS version %d", reply[0])
+	}
+
+	switch reply[1] {
+	case socks.AuthNone:
+		return nil
+	case socks.AuthPassword:
+		if len(s.user) > 255 || len(s.password) > 255 {
+			return errors.New("proxy: SOCKS5 credentials too long")
+		}
+		req := []byte{socks.PasswordVersion, byte(len(s.user))}
+		req = append(req, s.user...)
+		req = append(req, byte(len(s.password)))
+		req = append(req, s.password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("proxy: SOCKS5 authentication failed")
+		}
+		return nil
+	case socks.AuthNoAcceptable:
+		return errors.New("proxy: no acceptable SOCKS5 authentication method")
+	default:
+		return fmt.Errorf("proxy: unsupported SOCKS5 authentication method %d", reply[1])
+	}
+}
+
+// request sends a SOCKS5 command and returns the bound address of the reply.
+func (s *socks5) request(conn net.Conn, cmd byte, addr string) (string, error) {
+	req, err := socks.AppendAddr([]byte{socks.Version, cmd, 0}, addr)
+	if err != nil {
+		return "", err
+	}
+	if _, err = conn.Write(req); err != nil {
+		return "", err
+	}
+
+	reply := make([]byte, 3)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return "", err
+	}
+	if reply[0] != socks.Version {
+		return "", fmt.Errorf("proxy: unexpected SOCKS version %d", reply[0])
+	}
+	if reply[1] != 0 {
+		msg := "unknown error"
+		if int(reply[1]) < len(socksReplies) {
+			msg = socksReplies[reply[1]]
+		}
+		return "", fmt.Errorf("proxy: SOCKS5 request for %s failed: %s", addr, msg)
+	}
+	return socks.ReadAddr(conn)
+}
+
+// socksUDPConn carries datagrams to a single target through a SOCKS5 UDP
+// relay. It implements net.PacketConn so that DNS clients treat it as a
+// datagram connection.
+type socksUDPConn struct {
+	net.Conn
+	ctrl   net.Conn
+	header []byte
+	target net.Addr
+}
+
+// Write sends b to the target, prefixed with the relay request header.
+func (c *socksUDPConn) Write(b []byte) (int, error) {
+	packet := make([]byte, 0, len(c.header)+len(b))
+	packet = append(packet, c.header...)
+	packet = append(packet, b...)
+	if _, err := c.Conn.Write(packet); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Read receives a datagram of the target from the relay and strips its
+// header. Fragmented and empty datagrams are dropped, as allowed by RFC 1928,
+// and so are those relayed from other sources.
+func (c *socksUDPConn) Read(b []byte) (int, error) {
+	buf := make([]byte, len(b)+maxUDPHeaderSize)
+	for {
+		n, err := c.Conn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		if n < 4 || buf[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		src, err := socks.ReadAddr(r)
+		if err != nil || r.Len() == 0 || !c.fromTarget(src) {
+			continue
+		}
+		return r.Read(b)
+	}
+}
+
+// fromTarget reports whether src, the source of a relayed datagram, is the
+// target. The relay reports the address a hostname target resolved to, so
+// only the port is compared then.
+func (c *socksUDPConn) fromTarget(src string) bool {
+	host, port, err := net.SplitHostPort(src)
+	if err != nil {
+		return false
+	}
+	targetHost, targetPort, _ := net.SplitHostPort(c.target.String())
+	if port != targetPort {
+		return false
+	}
+	targetIP := net.ParseIP(targetHost)
+	return targetIP == nil || targetIP.Equal(net.ParseIP(host))
+}
+
+// ReadFrom implements net.PacketConn.
+func (c *socksUDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := c.Read(b)
+	return n, c.target, err
+}
+
+// WriteTo implements net.PacketConn. The datagram always goes to the target
+// the connection was dialed for.
+func (c *socksUDPConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	return c.Write(b)
+}
+
+// RemoteAddr returns the address of the target rather than of the relay.
+func (c *socksUDPConn) RemoteAddr() net.Addr {
+	return c.target
+}
+
+// Close closes both the relay and the control connection.
+func (c *socksUDPConn) Close() error {
+	_ = c.ctrl.Close()
+	return c.Conn.Close()
+}
+
+// proxyAddr is the address of a target reached through a proxy.
+type proxyAddr struct {
+	network string
+	addr    string
+}
+
+func (a proxyAddr) Network() string { return a.network }
+func (a proxyAddr) String() string  { return a.addr }
@@ -0,0 +1,115 @@
+package resolvers
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// caseFoldingThreshold is the number of confirmed case folding responses
+	// in a row after which case randomization is turned off.
+	caseFoldingThreshold = 3
+	// caseFoldingPeriod is how long case randomization stays off.
+	caseFoldingPeriod = time.Hour
+)
+
+// ErrCaseMismatch is wrapped by CaseMismatchError.
+var ErrCaseMismatch = fmt.Errorf("%w: question casing differs", ErrMismatch)
+
+// CaseMismatchError is returned when the question of a response does not
+// carry the random capitalisation of the query, meaning the response was
+// most likely forged by someone who never saw the query.
+type CaseMismatchError struct {
+	Sent     string
+	Received string
+}
+
+func (e *CaseMismatchError) Error() string {
+	return fmt.Sprintf("%s: sent %q, received %q", ErrCaseMismatch, e.Sent, e.Received)
+}
+
+func (e *CaseMismatchError) Unwrap() error {
+	return ErrCaseMismatch
+}
+
+// randomizeCase flips the case of a random half of the letters of name, as
+// described in draft-vixie-dnsext-dns0x20.
+func randomizeCase(name string) string {
+	b := []byte(name)
+	bits := make([]byte, (len(b)+7)/8)
+	if _, err := rand.Read(bits); err != nil {
+		return name
+	}
+	for i, c := range b {
+		if bits[i/8]&(1<<(i%8)) == 0 {
+			continue
+		}
+		switch {
+		case 'a' <= c && c <= 'z':
+			b[i] = c - 'a' + 'A'
+		case 'A' <= c && c <= 'Z':
+			b[i] = c - 'A' + 'a'
+		}
+	}
+	return string(b)
+}
+
+// checkCase verifies that in echoes the exact casing of the question of msg.
+// Upstreams that answer with the name lowercased don't preserve case, which
+// is reported with preserved set to false rather than an error. Such
+// responses are just as easily forged, so they must be confirmed over a
+// transport off-path attackers can't spoof before being accepted.
+func checkCase(msg, in *dns.Msg) (preserved bool, err error) {
+	sent := msg.Question[0].Name
+	if len(in.Question) == 0 {
+		return false, &CaseMismatchError{Sent: sent}
+	}
+	received := in.Question[0].Name
+	switch {
+	case received == sent:
+		return true, nil
+	case received == strings.ToLower(received) && strings.EqualFold(received, sent):
+		return false, nil
+	}
+	return false, &CaseMismatchError{Sent: sent, Received: received}
+}
+
+// caseFolding tracks whether an upstream lowercases the questions of its
+// responses, which makes case randomization cost a confirmation per query.
+type caseFolding struct {
+	mu sync.Mutex
+	// folded counts the confirmed case folding responses in a row.
+	folded int
+	// until is when case randomization is turned back on.
+	until time.Time
+}
+
+// disabled reports whether case randomization is currently turned off.
+func (f *caseFolding) disabled() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return time.Now().Before(f.until)
+}
+
+// observe records whether a confirmed response preserved the case of its
+// question, and reports whether case randomization was turned off by it.
+func (f *caseFolding) observe(preserved bool) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if preserved {
+		f.folded = 0
+		return false
+	}
+	f.folded++
+	if f.folded < caseFoldingThreshold {
+		return false
+	}
+	f.folded = 0
+	f.until = time.Now().Add(caseFoldingPeriod)
+	return true
+}
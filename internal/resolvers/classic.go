@@ -1,9 +1,14 @@
 package resolvers
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/bepass-org/dnsutils/internal/dialer"
 	"github.com/bepass-org/dnsutils/internal/statute"
+	"net"
 	"net/url"
 	"strings"
 	"time"
@@ -16,6 +21,10 @@ type ClassicResolver struct {
 	client *dns.Client
 	server string
 	opts   statute.ResolverOptions
+
+	// caseFolding turns case randomization off for a while once the server
+	// is confirmed to lowercase questions.
+	caseFolding caseFolding
 }
 
 // ClassicResolverOpts holds options for setting up a Classic resolver.
@@ -48,16 +57,30 @@ func NewClassicResolver(server string, classicOpts ClassicResolverOpts, resolver
 	// if the both use ipv4 and ipv6, then destNet will be just udp or tcp
 	destNet = strings.Replace(destNet, "46", "", -1)
 
+	defaultPort := ":53"
 	if classicOpts.UseTLS {
 		destNet = destNet + "-tls"
+		defaultPort = ":853"
 		// Provide extra TLS config for doing/skipping hostname verification.
 		client.TLSConfig = &tls.Config{
 			ServerName:         resolverOpts.TLSHostname,
 			InsecureSkipVerify: resolverOpts.InsecureSkipVerify,
 		}
+		// The TLS dialer does the handshake itself, so hand it the hostname to verify.
+		if resolverOpts.TLSHostname != "" && resolverOpts.TLSDialer != nil {
+			tlsDialer := *resolverOpts.TLSDialer
+			tlsDialer.DialFunc = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return resolverOpts.TLSDialer.DialContext(dialer.WithServerName(ctx, resolverOpts.TLSHostname), network, addr)
+			}
+			client.TLSDialer = &tlsDialer
+		}
 	}
 
 	client.Net = destNet
+	// TLS authenticates the responses, leaving nothing to randomize against.
+	if classicOpts.UseTLS {
+		resolverOpts.CaseRandomization = false
+	}
 
 	u, err := url.Parse(server)
 	if err != nil {
@@ -66,11 +89,12 @@ func NewClassicResolver(server string, classicOpts ClassicResolverOpts, resolver
 
 	_, err = netutil.ParseHostPort(u.Host)
 	if err != nil {
-		server = server + ":53"
+		server = server + defaultPort
 	}
 
 	srv := strings.Replace(server, "udp://", "", -1)
 	srv = strings.Replace(srv, "tcp://", "", -1)
+	srv = strings.Replace(srv, "tls://", "", -1)
 
 	return &ClassicResolver{
 		client: client,
@@ -82,9 +106,14 @@ func NewClassicResolver(server string, classicOpts ClassicResolverOpts, resolver
 // Lookup takes a dns.Question and sends them to DNS Server.
 // It parses the Response from the server in a custom output format.
 func (r *ClassicResolver) Lookup(question dns.Question) (statute.Response, error) {
+	opts := r.opts
+	if r.caseFolding.disabled() {
+		opts.CaseRandomization = false
+	}
 	var (
 		rsp      statute.Response
-		messages = PrepareMessages(question, r.opts.Ndots, r.opts.SearchList)
+		rspErr   error
+		messages = prepareMessages(question, opts)
 	)
 	for _, msg := range messages {
 
@@ -93,32 +122,65 @@ func (r *ClassicResolver) Lookup(question dns.Question) (statute.Response, error
 			r.server,
 			r.opts.Ndots,
 		)
+		if strings.HasSuffix(r.client.Net, "-tls") {
+			PadQuery(&msg)
+		}
 
 		// Since the library doesn't include tcp.Dial time,
 		// it's better to not rely on `rtt` provided here and calculate it ourselves.
 		now := time.Now()
-		in, _, err := r.client.Exchange(&msg, r.server)
+		var (
+			in       *dns.Msg
+			poisoned bool
+			err      error
+		)
+		if r.opts.InjectionFilter != nil && strings.HasPrefix(r.client.Net, "udp") {
+			in, poisoned, err = r.exchangeFiltered(&msg)
+		} else {
+			in, _, err = r.client.Exchange(&msg, r.server)
+		}
 		if err != nil {
 			return rsp, err
 		}
 
 		// In case the response size exceeds 512 bytes (can happen with a lot of TXT records),
 		// fallback to TCP as with UDP the response is truncated. Fallback mechanism is in-line with `dig`.
+		if in.Truncated && strings.HasPrefix(r.client.Net, "udp") {
+			r.opts.Logger.Debug("response truncated; retrying over TCP")
+			in, err = r.exchangeTCP(&msg)
+			if err != nil {
+				return rsp, err
+			}
+		}
 		if in.Truncated {
-			switch r.client.Net {
-			case "udp":
-				r.client.Net = "tcp"
-			case "udp4":
-				r.client.Net = "tcp4"
-			case "udp6":
-				r.client.Net = "tcp6"
-			default:
-				r.client.Net = "tcp"
+			return rsp, fmt.Errorf("%s: truncated response from %s", msg.Question[0].Name, r.server)
+		}
+		// A lowercased question might as well be an off-path forger's guess,
+		// so confirm it over TCP, which they can't spoof.
+		if opts.CaseRandomization && strings.HasPrefix(r.client.Net, "udp") {
+			if preserved, err := checkCase(&msg, in); err == nil && !preserved {
+				r.opts.Logger.Debug("question lowercased; confirming over TCP")
+				in, err = r.exchangeTCP(&msg)
+				if err != nil {
+					return rsp, err
+				}
+			}
+		}
+
+		rspErr = validateResponse(&msg, in)
+		if rspErr != nil && !errors.Is(rspErr, ErrNXDomain) {
+			return rsp, rspErr
+		}
+		if opts.CaseRandomization {
+			preserved, err := checkCase(&msg, in)
+			if err != nil {
+				return rsp, err
+			}
+			if r.caseFolding.observe(preserved) {
+				r.opts.Logger.Debug("%s does not preserve the case of questions; disabling case randomization",
+					r.server,
+				)
 			}
-			r.opts.Logger.Debug("response truncated; retrying now, protocol: %s",
-				r.client.Net,
-			)
-			return r.Lookup(question)
 		}
 
 		// Pack questions in output.
@@ -136,11 +198,22 @@ func (r *ClassicResolver) Lookup(question dns.Question) (statute.Response, error
 		output := ParseMessage(in, rtt, r.server)
 		rsp.Authorities = output.Authorities
 		rsp.Answers = output.Answers
+		rsp.Msg = output.Msg
+		rsp.Poisoned = poisoned
 
 		if len(output.Answers) > 0 {
 			// Stop iterating the searchlist.
 			break
 		}
 	}
-	return rsp, nil
+	return rsp, rspErr
+}
+
+// exchangeTCP sends msg over TCP instead of UDP. The client is shared
+// between concurrent lookups, so a copy of it is used.
+func (r *ClassicResolver) exchangeTCP(msg *dns.Msg) (*dns.Msg, error) {
+	client := *r.client
+	client.Net = strings.Replace(r.client.Net, "udp", "tcp", 1)
+	in, _, err := client.Exchange(msg, r.server)
+	return in, err
 }
@@ -1,23 +1,55 @@
 package resolvers
 
 import (
+	"errors"
+	"fmt"
 	"github.com/bepass-org/dnsutils/internal/dnscrypt"
 	"github.com/bepass-org/dnsutils/internal/statute"
 	"github.com/miekg/dns"
+	"sync"
 	"time"
 )
 
+// Certificate refresh settings of DNSCryptResolver.
+const (
+	// certRefreshMargin is how long before its expiry a certificate is
+	// fetched again, at most half its validity.
+	certRefreshMargin = time.Hour
+	// certRefreshRetry is how long certificates are not fetched again for
+	// after a failed fetch.
+	certRefreshRetry = 10 * time.Second
+)
+
 // DNSCryptResolver represents the config options for setting up a IResolver.
 type DNSCryptResolver struct {
 	client       *dnscrypt.Client
+	stamp        string
 	server       string
-	resolverInfo *dnscrypt.ResolverInfo
 	opts         statute.ResolverOptions
+	dnscryptOpts DNSCryptResolverOpts
+
+	mu           sync.Mutex
+	resolverInfo *dnscrypt.ResolverInfo
+	fetched      time.Time
+	fetchFailed  time.Time
+	rekeyed      time.Time
+	// fetching is closed when the certificate fetch in progress is done.
+	fetching chan struct{}
 }
 
 // DNSCryptResolverOpts holds options for setting up a DNSCrypt resolver.
 type DNSCryptResolverOpts struct {
+	// UseTCP sends queries over TCP only, instead of over UDP with the
+	// truncated responses retried over TCP.
 	UseTCP bool
+	// RotateKey replaces the client key pair every KeyRotationInterval,
+	// or for every query if it is zero, so that the server can't link
+	// queries by the key.
+	RotateKey           bool
+	KeyRotationInterval time.Duration
+	// Relay is the stamp or address of an Anonymized DNSCrypt relay the
+	// queries are sent through.
+	Relay string
 }
 
 // NewDNSCryptResolver accepts a list of nameservers and configures a DNS resolver.
@@ -33,24 +65,139 @@ func NewDNSCryptResolver(server string, dnscryptOpts DNSCryptResolverOpts, resol
 		UDPSize:    4096,
 		DialerFunc: resolverOpts.RawDialerFunc,
 	}
+	if dnscryptOpts.Relay != "" {
+		relay, err := dnscrypt.RelayAddress(dnscryptOpts.Relay)
+		if err != nil {
+			return nil, fmt.Errorf("dnscrypt relay: %w", err)
+		}
+		client.RelayAddr = relay
+	}
 	resolverInfo, err := client.Dial(server)
 	if err != nil {
 		return nil, err
 	}
+	resolverOpts.CaseRandomization = false
 	return &DNSCryptResolver{
 		client:       client,
+		stamp:        server,
 		resolverInfo: resolverInfo,
+		fetched:      time.Now(),
+		rekeyed:      time.Now(),
 		server:       resolverInfo.ServerAddress,
 		opts:         resolverOpts,
+		dnscryptOpts: dnscryptOpts,
 	}, nil
 }
 
+// info returns the resolver information to encrypt the next query with,
+// fetching the certificate again when it is about to expire and rotating
+// the client key as configured.
+func (r *DNSCryptResolver) info() *dnscrypt.ResolverInfo {
+	r.mu.Lock()
+	cert := r.resolverInfo.ResolverCert
+	notAfter := time.Unix(int64(cert.NotAfter), 0)
+	margin := notAfter.Sub(time.Unix(int64(cert.NotBefore), 0)) / 2
+	if margin > certRefreshMargin {
+		margin = certRefreshMargin
+	}
+	refresh := time.Until(notAfter) < margin && time.Since(r.fetched) >= certRefreshRetry
+	r.mu.Unlock()
+	// Servers may keep serving an expiring certificate until it expires.
+	if refresh {
+		r.refetch(cert)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	interval := r.dnscryptOpts.KeyRotationInterval
+	if r.dnscryptOpts.RotateKey && (interval <= 0 || time.Since(r.rekeyed) >= interval) {
+		if info, err := r.resolverInfo.Rekey(); err == nil {
+			r.resolverInfo = info
+			r.rekeyed = time.Now()
+		}
+	}
+	return r.resolverInfo
+}
+
+// refetch replaces old, the certificate in use, by fetching it again unless
+// that failed recently. It reports whether the certificate changed, possibly
+// by a concurrent fetch. Concurrent calls share a single fetch, which is
+// made without holding r.mu.
+func (r *DNSCryptResolver) refetch(old *dnscrypt.Cert) bool {
+	r.mu.Lock()
+	if r.resolverInfo.ResolverCert != old {
+		r.mu.Unlock()
+		return true
+	}
+	if wait := r.fetching; wait != nil {
+		r.mu.Unlock()
+		<-wait
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.resolverInfo.ResolverCert != old
+	}
+	if time.Since(r.fetchFailed) < certRefreshRetry {
+		r.mu.Unlock()
+		return false
+	}
+	r.fetched = time.Now()
+	done := make(chan struct{})
+	r.fetching = done
+	r.mu.Unlock()
+
+	info, err := r.client.Dial(r.stamp)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fetching = nil
+	close(done)
+	if err != nil {
+		r.fetchFailed = time.Now()
+		r.opts.Logger.Debug("fetching dnscrypt certificate of %s: %v", r.server, err)
+		return false
+	}
+	if info.ResolverCert.Serial == old.Serial && info.ResolverCert.ClientMagic == old.ClientMagic {
+		return false
+	}
+	r.resolverInfo = info
+	r.rekeyed = time.Now()
+	return true
+}
+
+// exchange sends msg encrypted with info. Responses failing to decrypt, such
+// as from a server that rotated its certificate, make the certificate
+// fetched again and the query retried with the new one.
+func (r *DNSCryptResolver) exchange(msg *dns.Msg, info *dnscrypt.ResolverInfo) (*dns.Msg, error) {
+	in, err := r.client.Exchange(msg, info)
+	if err == nil || !isCertError(err) {
+		return in, err
+	}
+	if !r.refetch(info.ResolverCert) {
+		return nil, err
+	}
+	return r.client.Exchange(msg, r.info())
+}
+
+// isCertError reports whether err means a response was not encrypted with
+// the certificate the query was sent with.
+func isCertError(err error) bool {
+	return errors.Is(err, dnscrypt.ErrInvalidResolverMagic) ||
+		errors.Is(err, dnscrypt.ErrInvalidResponse) ||
+		errors.Is(err, dnscrypt.ErrInvalidPadding)
+}
+
+// Close closes the idle connections to the server.
+func (r *DNSCryptResolver) Close() error {
+	return r.client.Close()
+}
+
 // Lookup takes a dns.Question and sends them to DNS Server.
 // It parses the Response from the server in a custom output format.
 func (r *DNSCryptResolver) Lookup(question dns.Question) (statute.Response, error) {
 	var (
 		rsp      statute.Response
-		messages = PrepareMessages(question, r.opts.Ndots, r.opts.SearchList)
+		rspErr   error
+		messages = prepareMessages(question, r.opts)
 	)
 	for _, msg := range messages {
 		r.opts.Logger.Debug("attempting to resolve %s, ns: %s, ndots: %d",
@@ -59,10 +206,17 @@ func (r *DNSCryptResolver) Lookup(question dns.Question) (statute.Response, erro
 			r.opts.Ndots,
 		)
 		now := time.Now()
-		in, err := r.client.Exchange(&msg, r.resolverInfo)
+		in, err := r.exchange(&msg, r.info())
 		if err != nil {
 			return rsp, err
 		}
+		if in.Truncated {
+			return rsp, fmt.Errorf("%s: truncated response from %s", msg.Question[0].Name, r.server)
+		}
+		rspErr = validateResponse(&msg, in)
+		if rspErr != nil && !errors.Is(rspErr, ErrNXDomain) {
+			return rsp, rspErr
+		}
 		rtt := time.Since(now)
 		// pack questions in output.
 		for _, q := range msg.Question {
@@ -77,11 +231,12 @@ func (r *DNSCryptResolver) Lookup(question dns.Question) (statute.Response, erro
 		output := ParseMessage(in, rtt, r.server)
 		rsp.Authorities = output.Authorities
 		rsp.Answers = output.Answers
+		rsp.Msg = output.Msg
 
 		if len(output.Answers) > 0 {
 			// stop iterating the searchlist.
 			break
 		}
 	}
-	return rsp, nil
+	return rsp, rspErr
 }
@@ -0,0 +1,229 @@
+package resolvers
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/dnsutils/internal/dnscrypt"
+	"github.com/bepass-org/dnsutils/internal/statute"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// echoHandler answers every A query with 192.0.2.1.
+type echoHandler struct{}
+
+func (echoHandler) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(192, 0, 2, 1),
+	})
+	return resp, nil
+}
+
+// startDNSCryptServer starts a DNSCrypt server with certs on addr over TCP,
+// and returns it with its address.
+func startDNSCryptServer(t *testing.T, addr string, rc dnscrypt.ResolverConfig, certs ...*dnscrypt.Cert) (*dnscrypt.Server, string) {
+	s := &dnscrypt.Server{ProviderName: rc.ProviderName, Handler: echoHandler{}}
+	for _, cert := range certs {
+		s.AddCert(cert)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = s.ServeTCP(l) }()
+	t.Cleanup(func() { _ = s.Shutdown(context.Background()) })
+	return s, l.Addr().String()
+}
+
+// newCert creates a certificate of rc with a new short-term key, valid from
+// notBefore to notAfter.
+func newCert(t *testing.T, rc dnscrypt.ResolverConfig, serial uint32, notBefore, notAfter time.Time) *dnscrypt.Cert {
+	rc.ResolverSk, rc.ResolverPk = "", ""
+	cert, err := rc.CreateCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert.Serial = serial
+	cert.NotBefore = uint32(notBefore.Unix())
+	cert.NotAfter = uint32(notAfter.Unix())
+	key, _ := dnscrypt.HexDecodeKey(rc.PrivateKey)
+	cert.Sign(key)
+	return cert
+}
+
+func TestDNSCryptResolverCertRefresh(t *testing.T) {
+	rc, err := dnscrypt.GenerateResolverConfig("example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	expiring := newCert(t, rc, 1, now.Add(-time.Hour), now.Add(time.Minute))
+	s, addr := startDNSCryptServer(t, "127.0.0.1:0", rc, expiring)
+	stamp, _ := rc.CreateStamp(addr)
+
+	opts := statute.ResolverOptions{Logger: nopLogger{}, Timeout: time.Second}
+	resolver, err := NewDNSCryptResolver(stamp.String(), DNSCryptResolverOpts{UseTCP: true}, opts)
+	if !assert.Nil(t, err) {
+		return
+	}
+	r := resolver.(*DNSCryptResolver)
+	question := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	// The expiring certificate is replaced before it expires.
+	next := newCert(t, rc, 2, now, now.Add(time.Hour))
+	s.AddCert(next)
+	r.fetched = time.Time{}
+	_, err = r.Lookup(question)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), r.resolverInfo.ResolverCert.Serial)
+}
+
+// startMangler relays UDP packets to addr, passing the responses through
+// mangle, which may return nil to drop them, and returns its address.
+func startMangler(t *testing.T, addr string, mangle func([]byte) []byte) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			n, client, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn, err := net.Dial("udp", addr)
+			if err != nil {
+				continue
+			}
+			_, _ = conn.Write(buf[:n])
+			_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+			n, err = conn.Read(buf)
+			_ = conn.Close()
+			if err != nil {
+				continue
+			}
+			if resp := mangle(buf[:n]); resp != nil {
+				_, _ = pc.WriteTo(resp, client)
+			}
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestDNSCryptResolverCertRefetch(t *testing.T) {
+	rc, err := dnscrypt.GenerateResolverConfig("example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	s := &dnscrypt.Server{ProviderName: rc.ProviderName, Handler: echoHandler{}}
+	s.AddCert(newCert(t, rc, 1, now, now.Add(time.Hour)))
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = s.ServeUDP(pc) }()
+	t.Cleanup(func() { _ = s.Shutdown(context.Background()) })
+
+	var (
+		mu      sync.Mutex
+		mode    string
+		fetches int
+	)
+	addr := startMangler(t, pc.LocalAddr().String(), func(resp []byte) []byte {
+		mu.Lock()
+		defer mu.Unlock()
+		// Certificates are served in plain DNS.
+		if new(dns.Msg).Unpack(resp) == nil {
+			fetches++
+			return resp
+		}
+		switch mode {
+		case "drop":
+			return nil
+		case "corrupt":
+			mode = ""
+			resp[0] ^= 0xff
+		}
+		return resp
+	})
+	stamp, _ := rc.CreateStamp(addr)
+
+	opts := statute.ResolverOptions{Logger: nopLogger{}, Timeout: 200 * time.Millisecond}
+	resolver, err := NewDNSCryptResolver(stamp.String(), DNSCryptResolverOpts{}, opts)
+	if !assert.Nil(t, err) {
+		return
+	}
+	r := resolver.(*DNSCryptResolver)
+	question := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	tests := []struct {
+		mode    string
+		ok      bool
+		fetches int
+		serial  uint32
+	}{
+		// Timeouts don't make the certificate fetched again.
+		{"drop", false, 1, 1},
+		// Responses not decrypting with the certificate do, and the query
+		// is retried with the new one.
+		{"corrupt", true, 2, 2},
+	}
+	s.AddCert(newCert(t, rc, 2, now, now.Add(time.Hour)))
+	for i, test := range tests {
+		mu.Lock()
+		mode = test.mode
+		mu.Unlock()
+
+		_, err = r.Lookup(question)
+		assert.Equal(t, test.ok, err == nil, "test %d: %v", i, err)
+		mu.Lock()
+		assert.Equal(t, test.fetches, fetches, "test %d", i)
+		mu.Unlock()
+		assert.Equal(t, test.serial, r.info().ResolverCert.Serial, "test %d", i)
+	}
+}
+
+func TestDNSCryptResolverKeyRotation(t *testing.T) {
+	rc, err := dnscrypt.GenerateResolverConfig("example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	_, addr := startDNSCryptServer(t, "127.0.0.1:0", rc, newCert(t, rc, 1, now, now.Add(time.Hour)))
+	stamp, _ := rc.CreateStamp(addr)
+	question := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	tests := []struct {
+		opts    DNSCryptResolverOpts
+		rotated bool
+	}{
+		{DNSCryptResolverOpts{UseTCP: true}, false},
+		{DNSCryptResolverOpts{UseTCP: true, RotateKey: true}, true},
+		{DNSCryptResolverOpts{UseTCP: true, RotateKey: true, KeyRotationInterval: time.Hour}, false},
+	}
+	for i, test := range tests {
+		opts := statute.ResolverOptions{Logger: nopLogger{}, Timeout: time.Second}
+		resolver, err := NewDNSCryptResolver(stamp.String(), test.opts, opts)
+		if !assert.Nil(t, err, "test %d", i) {
+			continue
+		}
+		r := resolver.(*DNSCryptResolver)
+		var keys [][32]byte
+		for j := 0; j < 2; j++ {
+			_, err = r.Lookup(question)
+			assert.Nil(t, err, "test %d", i)
+			keys = append(keys, r.resolverInfo.PublicKey)
+		}
+		assert.Equal(t, test.rotated, keys[0] != keys[1], "test %d", i)
+	}
+}
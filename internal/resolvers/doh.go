@@ -3,6 +3,7 @@ package resolvers
 import (
 	"bytes"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"github.com/bepass-org/dnsutils/internal/statute"
 	"io"
@@ -30,6 +31,7 @@ func NewDOHResolver(server string, resolverOpts statute.ResolverOptions) (statut
 	if u.Scheme != "https" {
 		return nil, fmt.Errorf("missing https in %s", server)
 	}
+	resolverOpts.CaseRandomization = false
 	return &DOHResolver{
 		client: resolverOpts.HttpClient,
 		server: server,
@@ -42,7 +44,8 @@ func NewDOHResolver(server string, resolverOpts statute.ResolverOptions) (statut
 func (r *DOHResolver) Lookup(question dns.Question) (statute.Response, error) {
 	var (
 		rsp      statute.Response
-		messages = PrepareMessages(question, r.opts.Ndots, r.opts.SearchList)
+		rspErr   error
+		messages = prepareMessages(question, r.opts)
 	)
 
 	for _, msg := range messages {
@@ -51,6 +54,7 @@ func (r *DOHResolver) Lookup(question dns.Question) (statute.Response, error) {
 			r.server,
 			r.opts.Ndots,
 		)
+		PadQuery(&msg)
 		// get the DNS Message in wire format.
 		b, err := msg.Pack()
 		if err != nil {
@@ -63,6 +67,7 @@ func (r *DOHResolver) Lookup(question dns.Question) (statute.Response, error) {
 			return rsp, err
 		}
 		if resp.StatusCode == http.StatusMethodNotAllowed {
+			_ = resp.Body.Close()
 			targetUrl, err := url.Parse(r.server)
 			if err != nil {
 				return rsp, err
@@ -74,19 +79,28 @@ func (r *DOHResolver) Lookup(question dns.Question) (statute.Response, error) {
 			}
 		}
 		if resp.StatusCode != http.StatusOK {
+			_ = resp.Body.Close()
 			return rsp, fmt.Errorf("error from nameserver %s", resp.Status)
 		}
 		rtt := time.Since(now)
 		// extract the binary response in DNS Message.
 		body, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
 		if err != nil {
 			return rsp, err
 		}
 
-		err = msg.Unpack(body)
-		if err != nil {
+		in := new(dns.Msg)
+		if err = in.Unpack(body); err != nil {
 			return rsp, err
 		}
+		if in.Truncated {
+			return rsp, fmt.Errorf("%s: truncated response from %s", msg.Question[0].Name, r.server)
+		}
+		rspErr = validateResponse(&msg, in)
+		if rspErr != nil && !errors.Is(rspErr, ErrNXDomain) {
+			return rsp, rspErr
+		}
 		// pack questions in output.
 		for _, q := range msg.Question {
 			ques := statute.Question{
@@ -97,14 +111,15 @@ func (r *DOHResolver) Lookup(question dns.Question) (statute.Response, error) {
 			rsp.Questions = append(rsp.Questions, ques)
 		}
 		// get the authorities and answers.
-		output := ParseMessage(&msg, rtt, r.server)
+		output := ParseMessage(in, rtt, r.server)
 		rsp.Authorities = output.Authorities
 		rsp.Answers = output.Answers
+		rsp.Msg = output.Msg
 
 		if len(output.Answers) > 0 {
 			// stop iterating the searchlist.
 			break
 		}
 	}
-	return rsp, nil
+	return rsp, rspErr
 }
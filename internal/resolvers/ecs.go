@@ -0,0 +1,84 @@
+package resolvers
+
+import (
+	"net"
+
+	"github.com/bepass-org/dnsutils/internal/statute"
+	"github.com/miekg/dns"
+)
+
+// ApplyClientSubnet adds, replaces or removes the EDNS Client Subnet option
+// of msg according to policy. A nil policy leaves msg as it is.
+func ApplyClientSubnet(msg *dns.Msg, policy *statute.ClientSubnet) {
+	if policy == nil {
+		return
+	}
+	opt := msg.IsEdns0()
+	if opt != nil {
+		existing := false
+		options := opt.Option[:0]
+		for _, o := range opt.Option {
+			if o.Option() == dns.EDNS0SUBNET {
+				existing = true
+				if policy.Mode != statute.ClientSubnetAdd {
+					continue
+				}
+			}
+			options = append(options, o)
+		}
+		opt.Option = options
+		if existing && policy.Mode == statute.ClientSubnetAdd {
+			return
+		}
+	}
+	if policy.Mode == statute.ClientSubnetRemove || policy.Subnet == nil {
+		return
+	}
+
+	if opt == nil {
+		msg.SetEdns0(ednsUDPSize, false)
+		opt = msg.IsEdns0()
+	}
+	ones, _ := policy.Subnet.Mask.Size()
+	subnet := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: uint8(ones),
+		Address:       policy.Subnet.IP.Mask(policy.Subnet.Mask),
+	}
+	if subnet.Address.To4() == nil {
+		subnet.Family = 2
+	}
+	opt.Option = append(opt.Option, subnet)
+}
+
+// ClientSubnetScope returns the network an answer applies to according to
+// the EDNS Client Subnet option of the response msg: the subnet it was sent
+// for, cut to the scope prefix of the upstream. ok is false for responses
+// without the option, or with a zero scope, valid for all clients.
+func ClientSubnetScope(msg *dns.Msg) (scope *net.IPNet, ok bool) {
+	if msg == nil {
+		return nil, false
+	}
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return nil, false
+	}
+	for _, o := range opt.Option {
+		subnet, isSubnet := o.(*dns.EDNS0_SUBNET)
+		if !isSubnet || subnet.SourceScope == 0 {
+			continue
+		}
+		bits := 8 * net.IPv4len
+		ip := subnet.Address.To4()
+		if subnet.Family == 2 || ip == nil {
+			bits, ip = 8*net.IPv6len, subnet.Address.To16()
+		}
+		if ip == nil || int(subnet.SourceScope) > bits {
+			return nil, false
+		}
+		mask := net.CIDRMask(int(subnet.SourceScope), bits)
+		return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, true
+	}
+	return nil, false
+}
@@ -0,0 +1,56 @@
+package resolvers
+
+import (
+	"net"
+	"testing"
+
+	"github.com/bepass-org/dnsutils/internal/statute"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyClientSubnet(t *testing.T) {
+	_, ours, _ := net.ParseCIDR("198.51.100.0/24")
+	_, ours6, _ := net.ParseCIDR("2001:db8:1200::/40")
+	theirs := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("192.0.2.0").To4()}
+
+	tests := []struct {
+		policy *statute.ClientSubnet
+		query  bool
+		exp    string
+	}{
+		{nil, true, "192.0.2.0/24"},
+		{nil, false, ""},
+		{&statute.ClientSubnet{Mode: statute.ClientSubnetRemove}, true, ""},
+		{&statute.ClientSubnet{Mode: statute.ClientSubnetAdd, Subnet: ours}, true, "192.0.2.0/24"},
+		{&statute.ClientSubnet{Mode: statute.ClientSubnetAdd, Subnet: ours}, false, "198.51.100.0/24"},
+		{&statute.ClientSubnet{Mode: statute.ClientSubnetOverride, Subnet: ours}, true, "198.51.100.0/24"},
+		{&statute.ClientSubnet{Mode: statute.ClientSubnetOverride, Subnet: ours6}, false, "2001:db8:1200::/40"},
+	}
+	for i, test := range tests {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		if test.query {
+			msg.SetEdns0(1232, false)
+			msg.IsEdns0().Option = append(msg.IsEdns0().Option, theirs)
+		}
+		ApplyClientSubnet(msg, test.policy)
+
+		var subnets []string
+		if opt := msg.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if s, ok := o.(*dns.EDNS0_SUBNET); ok {
+					subnets = append(subnets, (&net.IPNet{
+						IP:   s.Address,
+						Mask: net.CIDRMask(int(s.SourceNetmask), 8*len(s.Address)),
+					}).String())
+				}
+			}
+		}
+		if test.exp == "" {
+			assert.Empty(t, subnets, "test %d", i)
+		} else {
+			assert.Equal(t, []string{test.exp}, subnets, "test %d", i)
+		}
+	}
+}
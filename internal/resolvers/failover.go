@@ -0,0 +1,50 @@
+package resolvers
+
+import (
+	"errors"
+
+	"github.com/bepass-org/dnsutils/internal/statute"
+	"github.com/miekg/dns"
+)
+
+// FailoverResolver queries a list of resolvers in order, moving on to the
+// next one whenever a lookup fails.
+type FailoverResolver struct {
+	resolvers []statute.IResolver
+}
+
+// NewFailoverResolver accepts a list of resolvers ordered by preference.
+func NewFailoverResolver(resolvers ...statute.IResolver) (statute.IResolver, error) {
+	if len(resolvers) == 0 {
+		return nil, errors.New("no resolvers to fail over between")
+	}
+	return &FailoverResolver{resolvers: resolvers}, nil
+}
+
+// Lookup takes a dns.Question and sends it to the first resolver able to
+// answer it. The error of the last resolver is returned if all of them fail.
+// A non-existent domain is an answer, not a failure.
+func (r *FailoverResolver) Lookup(question dns.Question) (statute.Response, error) {
+	var (
+		rsp statute.Response
+		err error
+	)
+	for _, resolver := range r.resolvers {
+		rsp, err = resolver.Lookup(question)
+		if err == nil || errors.Is(err, ErrNXDomain) {
+			return rsp, err
+		}
+	}
+	return rsp, err
+}
+
+// Close closes the resolvers failed over between.
+func (r *FailoverResolver) Close() error {
+	var err error
+	for _, resolver := range r.resolvers {
+		if closeErr := statute.Close(resolver); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
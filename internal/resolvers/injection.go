@@ -0,0 +1,204 @@
+package resolvers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// maxCandidates is the most responses collected for a single query.
+	maxCandidates = 8
+
+	// maxSaneTTL is the longest TTL genuine resolvers are expected to serve.
+	maxSaneTTL = 7 * 24 * 60 * 60
+)
+
+// ErrInjected is returned when every response to a query looked forged.
+var ErrInjected = errors.New("all responses look forged")
+
+// exchangeFiltered sends msg over plain UDP and keeps listening for the
+// filter window after the first response, since forged responses are raced
+// ahead of the genuine one. Of all the responses matching the query, the
+// ones looking forged are discarded. poisoned reports whether any forgery
+// was detected.
+func (r *ClassicResolver) exchangeFiltered(msg *dns.Msg) (in *dns.Msg, poisoned bool, err error) {
+	// Genuine resolvers echo EDNS, most injectors don't bother.
+	query := msg.Copy()
+	if query.IsEdns0() == nil {
+		query.SetEdns0(dns.DefaultMsgSize, false)
+	}
+
+	timeout := r.client.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	var conn net.Conn
+	if r.client.Dialer != nil {
+		conn, err = r.client.Dialer.DialContext(ctx, r.client.Net, r.server)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, r.client.Net, r.server)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	co := &dns.Conn{Conn: conn, UDPSize: query.IsEdns0().UDPSize()}
+	defer co.Close()
+
+	_ = co.SetWriteDeadline(deadline)
+	if err = co.WriteMsg(query); err != nil {
+		return nil, false, err
+	}
+
+	var candidates []*dns.Msg
+	for len(candidates) < maxCandidates {
+		_ = co.SetReadDeadline(deadline)
+		resp, err := co.ReadMsg()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) {
+				if len(candidates) > 0 && netErr.Timeout() {
+					break
+				}
+				return nil, false, err
+			}
+			// Garbage is not worth giving up on the genuine response.
+			continue
+		}
+		if resp.Id != query.Id || !sameQuestion(resp, query) {
+			continue
+		}
+		candidates = append(candidates, resp)
+		if len(candidates) == 1 {
+			if end := time.Now().Add(r.opts.InjectionFilter.Window); end.Before(deadline) {
+				deadline = end
+			}
+		}
+	}
+
+	return r.pick(query, candidates)
+}
+
+// pick chooses the genuine response among candidates.
+func (r *ClassicResolver) pick(query *dns.Msg, candidates []*dns.Msg) (*dns.Msg, bool, error) {
+	signed := false
+	for _, c := range candidates {
+		if hasSignatures(c) {
+			signed = true
+		}
+	}
+
+	var clean []*dns.Msg
+	for _, c := range candidates {
+		reasons := r.suspicious(query, c)
+		if signed && !hasSignatures(c) {
+			reasons = append(reasons, "unsigned while another response is signed")
+		}
+		if len(reasons) > 0 {
+			r.opts.Logger.Debug("discarding forged response for %s from %s: %s",
+				query.Question[0].Name, r.server, strings.Join(reasons, ", "))
+			continue
+		}
+		clean = append(clean, c)
+	}
+
+	poisoned := len(clean) < len(candidates)
+	for i := 1; i < len(clean); i++ {
+		if answerKey(clean[i]) != answerKey(clean[0]) {
+			poisoned = true
+		}
+	}
+	if poisoned {
+		r.opts.Logger.Error("possible DNS poisoning of %s from %s: %d responses, %d genuine",
+			query.Question[0].Name, r.server, len(candidates), len(clean))
+	}
+
+	if len(clean) == 0 {
+		return nil, true, fmt.Errorf("%s: %w", query.Question[0].Name, ErrInjected)
+	}
+	// Forgeries arrive first, so the last response is the most trustworthy.
+	return clean[len(clean)-1], poisoned, nil
+}
+
+// suspicious returns the reasons why resp looks forged.
+func (r *ClassicResolver) suspicious(query, resp *dns.Msg) []string {
+	var reasons []string
+	if query.IsEdns0() != nil && resp.IsEdns0() == nil {
+		reasons = append(reasons, "EDNS not echoed")
+	}
+	if query.RecursionDesired && !resp.RecursionDesired {
+		reasons = append(reasons, "RD flag not echoed")
+	}
+	if !resp.RecursionAvailable {
+		reasons = append(reasons, "recursion not available")
+	}
+	if _, err := checkCase(query, resp); errors.Is(err, ErrCaseMismatch) {
+		reasons = append(reasons, "question casing not echoed")
+	}
+
+	ttls := map[string]uint32{}
+	for _, rr := range resp.Answer {
+		h := rr.Header()
+		if h.Ttl > maxSaneTTL {
+			reasons = append(reasons, fmt.Sprintf("TTL %d of %s is too long", h.Ttl, h.Name))
+		}
+		key := strings.ToLower(h.Name) + "/" + dns.TypeToString[h.Rrtype]
+		if ttl, ok := ttls[key]; ok && ttl != h.Ttl {
+			reasons = append(reasons, fmt.Sprintf("inconsistent TTLs for %s", key))
+		}
+		ttls[key] = h.Ttl
+
+		var ip net.IP
+		switch v := rr.(type) {
+		case *dns.A:
+			ip = v.A
+		case *dns.AAAA:
+			ip = v.AAAA
+		}
+		if ip != nil && r.opts.InjectionFilter.IsBogus(ip) {
+			reasons = append(reasons, fmt.Sprintf("known bogus address %s", ip))
+		}
+	}
+	return reasons
+}
+
+// sameQuestion reports whether resp answers the question of query.
+func sameQuestion(resp, query *dns.Msg) bool {
+	if len(resp.Question) != 1 || len(query.Question) != 1 {
+		return false
+	}
+	a, b := resp.Question[0], query.Question[0]
+	return a.Qtype == b.Qtype && a.Qclass == b.Qclass && strings.EqualFold(a.Name, b.Name)
+}
+
+// hasSignatures reports whether the answer of msg carries DNSSEC signatures.
+func hasSignatures(msg *dns.Msg) bool {
+	for _, rr := range msg.Answer {
+		if rr.Header().Rrtype == dns.TypeRRSIG {
+			return true
+		}
+	}
+	return false
+}
+
+// answerKey summarizes the answer of msg, ignoring TTLs and order.
+func answerKey(msg *dns.Msg) string {
+	rrs := make([]string, 0, len(msg.Answer))
+	for _, rr := range msg.Answer {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = 0
+		rrs = append(rrs, strings.ToLower(rr.String()))
+	}
+	sort.Strings(rrs)
+	return fmt.Sprintf("%d|%s", msg.Rcode, strings.Join(rrs, "\n"))
+}
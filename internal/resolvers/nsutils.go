@@ -35,6 +35,33 @@ func PrepareMessages(q dns.Question, ndots int, searchList []string) []dns.Msg {
 	return messages
 }
 
+// ednsUDPSize is the EDNS buffer size advertised by queries, as recommended
+// by DNS Flag Day 2020.
+const ednsUDPSize = 1232
+
+// prepareMessages is PrepareMessages with the options shared by every
+// resolver applied to the messages.
+func prepareMessages(q dns.Question, opts statute.ResolverOptions) []dns.Msg {
+	messages := PrepareMessages(q, opts.Ndots, opts.SearchList)
+	if opts.DNSSEC {
+		for i := range messages {
+			// Ask for the signatures, and for data failing the upstream's own
+			// validation as well since it is validated here.
+			messages[i].SetEdns0(ednsUDPSize, true)
+			messages[i].CheckingDisabled = true
+		}
+	}
+	for i := range messages {
+		ApplyClientSubnet(&messages[i], opts.ClientSubnet)
+	}
+	if opts.CaseRandomization {
+		for i := range messages {
+			messages[i].Question[0].Name = randomizeCase(messages[i].Question[0].Name)
+		}
+	}
+	return messages
+}
+
 // NameList returns all of the names that should be queried based on the
 // config. It is based off of go's net/dns name building, but it does not
 // check the length of the resulting names.
@@ -72,7 +99,7 @@ func constructPossibleQuestions(name string, ndots int, searchList []string) []s
 // ParseMessage takes a `dns.Message` and returns a custom
 // Response data struct.
 func ParseMessage(msg *dns.Msg, rtt time.Duration, server string) statute.Response {
-	var resp statute.Response
+	resp := statute.Response{Msg: msg}
 	timeTaken := fmt.Sprintf("%dms", rtt.Milliseconds())
 
 	// Parse Authorities section.
@@ -109,6 +136,10 @@ func ParseMessage(msg *dns.Msg, rtt time.Duration, server string) statute.Respon
 	}
 	// Parse Answers section.
 	for _, a := range msg.Answer {
+		// Signatures are only of use to the validator, which reads them from Msg.
+		if a.Header().Rrtype == dns.TypeRRSIG {
+			continue
+		}
 		var (
 			h = a.Header()
 			// Source https://github.com/jvns/dns-lookup/blob/main/dns.go#L121.
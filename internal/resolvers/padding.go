@@ -0,0 +1,61 @@
+package resolvers
+
+import "github.com/miekg/dns"
+
+// Block lengths of the padding policy recommended by RFC 8467.
+const (
+	queryPaddingBlock    = 128
+	responsePaddingBlock = 468
+)
+
+// PadQuery pads msg with the EDNS(0) padding option of RFC 7830, so that its
+// length is a multiple of 128 octets and doesn't give the query name away
+// on encrypted transports. It must be the last change to msg before it is
+// sent.
+func PadQuery(msg *dns.Msg) {
+	pad(msg, queryPaddingBlock)
+}
+
+// PadResponse pads resp to a multiple of 468 octets if its query req was
+// padded, as servers must not pad otherwise.
+func PadResponse(req, resp *dns.Msg) {
+	if !isPadded(req) {
+		return
+	}
+	pad(resp, responsePaddingBlock)
+}
+
+// isPadded reports whether msg carries the padding option.
+func isPadded(msg *dns.Msg) bool {
+	if opt := msg.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if o.Option() == dns.EDNS0PADDING {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pad pads msg to a multiple of block octets, replacing any padding it
+// already had.
+func pad(msg *dns.Msg, block int) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		opt = msg.IsEdns0()
+	}
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0PADDING {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+
+	// The option header takes 4 octets.
+	size := msg.Len() + 4
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{
+		Padding: make([]byte, (block-size%block)%block),
+	})
+}
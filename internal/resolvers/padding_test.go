@@ -0,0 +1,95 @@
+package resolvers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bepass-org/dnsutils/internal/statute"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// nopLogger discards all log messages.
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+func TestPadding(t *testing.T) {
+	tests := []struct {
+		name string
+		edns bool
+	}{
+		{"a.", false},
+		{"example.com.", false},
+		{"example.com.", true},
+		{strings.Repeat("a", 63) + "." + strings.Repeat("b", 63) + ".example.com.", false},
+	}
+	for i, test := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(test.name, dns.TypeA)
+		if test.edns {
+			req.SetEdns0(1232, true)
+		}
+		PadQuery(req)
+		b, err := req.Pack()
+		assert.Nil(t, err, "test %d", i)
+		assert.Zero(t, len(b)%queryPaddingBlock, "test %d", i)
+
+		// Padding again replaces the previous padding.
+		size := len(b)
+		PadQuery(req)
+		b, _ = req.Pack()
+		assert.Equal(t, size, len(b), "test %d", i)
+
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Answer = append(resp.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: test.name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+			Txt: []string{strings.Repeat("x", 100*i)},
+		})
+		PadResponse(req, resp)
+		b, _ = resp.Pack()
+		assert.Zero(t, len(b)%responsePaddingBlock, "test %d", i)
+	}
+
+	// Unpadded queries get unpadded responses.
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	PadResponse(req, resp)
+	assert.Nil(t, resp.IsEdns0())
+}
+
+func TestDOHResolverPadding(t *testing.T) {
+	var size int
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		size = len(body)
+		req := new(dns.Msg)
+		if err := req.Unpack(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		b, _ := resp.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(b)
+	}))
+	defer ts.Close()
+
+	r, err := NewDOHResolver(ts.URL, statute.ResolverOptions{
+		Logger:     nopLogger{},
+		HttpClient: ts.Client(),
+		Ndots:      1,
+	})
+	assert.Nil(t, err)
+	_, err = r.Lookup(dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	assert.Nil(t, err)
+	assert.Equal(t, queryPaddingBlock, size)
+}
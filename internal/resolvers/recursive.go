@@ -0,0 +1,581 @@
+package resolvers
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/dnsutils/internal/statute"
+	"github.com/miekg/dns"
+)
+
+// Limits of RecursiveResolver.
+const (
+	// maxReferrals bounds the referrals followed to resolve a name.
+	maxReferrals = 32
+	// maxDepth bounds the nested resolutions of name server addresses.
+	maxDepth = 8
+	// maxCNAMEChain is the longest CNAME chain followed.
+	maxCNAMEChain = 16
+	// maxMinimiseCount is how many labels QNAME minimisation adds one at a
+	// time before sending the full name, as MAX_MINIMISE_COUNT of RFC 9156.
+	maxMinimiseCount = 10
+	// maxInfraTTL caps how long delegations and name server addresses are
+	// cached.
+	maxInfraTTL = 24 * time.Hour
+	// lameTTL is how long a server failing for a zone is left out.
+	lameTTL = 10 * time.Minute
+	// maxInfraEntries is the size above which the expired delegations,
+	// addresses and lame servers are pruned.
+	maxInfraEntries = 4096
+)
+
+// errLame is returned for responses of servers not authoritative for the
+// zone they are asked about.
+var errLame = errors.New("lame delegation")
+
+// nameServer is a name server of a zone, with its addresses if known.
+type nameServer struct {
+	name  string
+	addrs []net.IP
+}
+
+// delegation is a zone with its name servers.
+type delegation struct {
+	zone    string
+	servers []nameServer
+	expires time.Time
+}
+
+// cachedAddrs are the addresses of a name server.
+type cachedAddrs struct {
+	addrs   []net.IP
+	expires time.Time
+}
+
+// RecursiveResolver resolves names itself, without upstream: starting from
+// the root servers, it follows the referrals down to the servers
+// authoritative for the name. The delegations and name server addresses met
+// along the way are cached.
+type RecursiveResolver struct {
+	client        *dns.Client
+	hints         []nameServer
+	opts          statute.ResolverOptions
+	recursiveOpts RecursiveResolverOpts
+
+	mu          sync.Mutex
+	delegations map[string]*delegation
+	addrs       map[string]cachedAddrs
+	lame        map[string]time.Time
+}
+
+// RecursiveResolverOpts holds options for setting up a recursive resolver.
+type RecursiveResolverOpts struct {
+	// Hints are the root name servers, each a name followed by its
+	// addresses. DefaultRootHints are used if empty.
+	Hints []string
+	// QNameMinimisation sends each server only the labels of the name
+	// below the zone it serves, plus one, as in RFC 9156.
+	QNameMinimisation bool
+}
+
+// NewRecursiveResolver creates a resolver starting from the root hints.
+// Servers are reached on port 53 with the dialer of resolverOpts.
+func NewRecursiveResolver(recursiveOpts RecursiveResolverOpts, resolverOpts statute.ResolverOptions) (statute.IResolver, error) {
+	hints := recursiveOpts.Hints
+	if len(hints) == 0 {
+		hints = DefaultRootHints
+	}
+	servers, err := parseRootHints(hints)
+	if err != nil {
+		return nil, err
+	}
+	client := &dns.Client{Net: "udp", Timeout: resolverOpts.Timeout}
+	if resolverOpts.Dialer != nil {
+		client.Dialer = resolverOpts.Dialer
+	}
+	return &RecursiveResolver{
+		client:        client,
+		hints:         servers,
+		opts:          resolverOpts,
+		recursiveOpts: recursiveOpts,
+		delegations:   map[string]*delegation{},
+		addrs:         map[string]cachedAddrs{},
+		lame:          map[string]time.Time{},
+	}, nil
+}
+
+// Lookup takes a dns.Question and resolves it from the root servers.
+// It parses the final response in a custom output format.
+func (r *RecursiveResolver) Lookup(question dns.Question) (statute.Response, error) {
+	var (
+		rsp      statute.Response
+		rspErr   error
+		messages = PrepareMessages(question, r.opts.Ndots, r.opts.SearchList)
+	)
+	for _, msg := range messages {
+		r.opts.Logger.Debug("attempting to resolve %s recursively, ndots: %d",
+			msg.Question[0].Name,
+			r.opts.Ndots,
+		)
+		now := time.Now()
+		in, server, err := r.resolve(msg.Question[0], 0)
+		if err != nil {
+			// The next name of the search list may still resolve.
+			rspErr = err
+			continue
+		}
+		rspErr = nil
+		if in.Rcode == dns.RcodeNameError {
+			rspErr = fmt.Errorf("%s: %w", msg.Question[0].Name, ErrNXDomain)
+		}
+		rtt := time.Since(now)
+		for _, q := range msg.Question {
+			ques := statute.Question{
+				Name:  q.Name,
+				Class: dns.ClassToString[q.Qclass],
+				Type:  dns.TypeToString[q.Qtype],
+			}
+			rsp.Questions = append(rsp.Questions, ques)
+		}
+		output := ParseMessage(in, rtt, server)
+		rsp.Authorities = output.Authorities
+		rsp.Answers = output.Answers
+		rsp.Msg = output.Msg
+
+		if len(output.Answers) > 0 {
+			// stop iterating the searchlist.
+			break
+		}
+	}
+	return rsp, rspErr
+}
+
+// resolve resolves q and the CNAME chain it leads to, and returns the final
+// response with the whole chain in its answer, along with the server that
+// sent it.
+func (r *RecursiveResolver) resolve(q dns.Question, depth int) (*dns.Msg, string, error) {
+	var (
+		chain []dns.RR
+		name  = dns.CanonicalName(q.Name)
+		seen  = map[string]bool{}
+	)
+	for i := 0; i <= maxCNAMEChain; i++ {
+		seen[name] = true
+		in, server, err := r.iterate(dns.Question{Name: name, Qtype: q.Qtype, Qclass: q.Qclass}, depth)
+		if err != nil {
+			return nil, "", err
+		}
+		target := cnameTarget(in.Answer, name, q.Qtype)
+		in.Question = []dns.Question{q}
+		in.Answer = append(chain, in.Answer...)
+		if target == "" || q.Qtype == dns.TypeCNAME || in.Rcode != dns.RcodeSuccess {
+			return in, server, nil
+		}
+		if seen[target] {
+			return nil, "", fmt.Errorf("%s: %w: CNAME loop at %s", q.Name, ErrServFail, target)
+		}
+		chain, name = in.Answer, target
+	}
+	return nil, "", fmt.Errorf("%s: %w: CNAME chain too long", q.Name, ErrServFail)
+}
+
+// iterate resolves q from the closest known delegation, following the
+// referrals, without chasing CNAMEs.
+func (r *RecursiveResolver) iterate(q dns.Question, depth int) (*dns.Msg, string, error) {
+	d := r.closest(q.Name, q.Qtype == dns.TypeDS)
+	var (
+		minimise = r.recursiveOpts.QNameMinimisation
+		labels   = dns.CountLabel(d.zone)
+		total    = dns.CountLabel(q.Name)
+		steps    = 0
+	)
+	for i := 0; i < maxReferrals; i++ {
+		sent := q
+		minimised := minimise && steps < maxMinimiseCount && labels+1 < total
+		if minimised {
+			labels++
+			steps++
+			// A queries are answered as expected by more servers than NS
+			// ones, as recommended by RFC 9156.
+			sent = dns.Question{Name: ancestor(q.Name, labels), Qtype: dns.TypeA, Qclass: q.Qclass}
+		}
+		in, server, err := r.query(d, sent, !minimised, depth)
+		if err != nil {
+			if minimised {
+				// Some servers fail for names they don't expect, such as
+				// empty non-terminals: the full name is sent instead.
+				minimise = false
+				continue
+			}
+			return nil, "", err
+		}
+		if child := r.referral(d, sent, in); child != nil {
+			d = child
+			labels = dns.CountLabel(d.zone)
+			continue
+		}
+		if !minimised {
+			return in, server, nil
+		}
+		switch {
+		case in.Rcode == dns.RcodeNameError:
+			// Nothing exists below a name that doesn't (RFC 8020).
+			return in, server, nil
+		case len(in.Answer) > 0:
+			// Such as a CNAME, which is followed by the full query.
+			minimise = false
+		}
+		// Otherwise the name exists in the zone, and the next label is
+		// asked to the same servers.
+	}
+	return nil, "", fmt.Errorf("%s: %w: too many referrals", q.Name, ErrServFail)
+}
+
+// closest returns the cached delegation closest to name, or the root one.
+// The DS records of a zone are served by its parent.
+func (r *RecursiveResolver) closest(name string, ds bool) *delegation {
+	name = dns.CanonicalName(name)
+	if ds && name != "." {
+		name = parent(name)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for ; name != "."; name = parent(name) {
+		if d, ok := r.delegations[name]; ok && now.Before(d.expires) {
+			return d
+		}
+	}
+	return &delegation{zone: ".", servers: r.hints}
+}
+
+// query sends q to the servers of d until one of them answers as
+// authoritative for the zone or refers to a zone below it. With markLame,
+// the failing servers are left out of the next queries for the zone.
+func (r *RecursiveResolver) query(d *delegation, q dns.Question, markLame bool, depth int) (*dns.Msg, string, error) {
+	lastErr := fmt.Errorf("%s: %w: no name server of %s answered", q.Name, ErrServFail, d.zone)
+	for _, ns := range d.servers {
+		addrs := ns.addrs
+		if len(addrs) == 0 {
+			// A name server inside the zone can't be resolved without it.
+			if dns.IsSubDomain(d.zone, ns.name) {
+				continue
+			}
+			var err error
+			if addrs, err = r.nsAddrs(ns.name, depth+1); err != nil {
+				lastErr = err
+				continue
+			}
+		}
+		for _, ip := range r.filterAddrs(addrs) {
+			server := net.JoinHostPort(ip.String(), "53")
+			if r.isLame(d.zone, server) {
+				continue
+			}
+			in, err := r.exchange(q, server)
+			if err == nil {
+				in.Answer = inBailiwick(d.zone, in.Answer)
+				err = checkAuthority(d.zone, q, in)
+			}
+			if err != nil {
+				r.opts.Logger.Debug("%s failed for %s: %v", server, d.zone, err)
+				if markLame {
+					r.setLame(d.zone, server)
+				}
+				lastErr = err
+				continue
+			}
+			return in, server, nil
+		}
+	}
+	return nil, "", lastErr
+}
+
+// exchange sends q to server, over TCP if the response is truncated.
+func (r *RecursiveResolver) exchange(q dns.Question, server string) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	msg.Id = dns.Id()
+	msg.Question = []dns.Question{q}
+	msg.SetEdns0(ednsUDPSize, r.opts.DNSSEC)
+
+	in, _, err := r.client.Exchange(msg, server)
+	if err == nil && in.Truncated {
+		client := *r.client
+		client.Net = "tcp"
+		in, _, err = client.Exchange(msg, server)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = validateResponse(msg, in); err != nil && !errors.Is(err, ErrNXDomain) {
+		return nil, err
+	}
+	return in, nil
+}
+
+// checkAuthority checks that in answers q, refers to a zone below zone,
+// or is an authoritative denial. Other responses, such as referrals back up
+// the tree, come from lame servers.
+func checkAuthority(zone string, q dns.Question, in *dns.Msg) error {
+	if in.Rcode == dns.RcodeNameError || len(in.Answer) > 0 || in.Authoritative {
+		return nil
+	}
+	if child := referralZone(zone, q, in); child != "" {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", errLame, zone)
+}
+
+// inBailiwick returns the records of answer in zone. The servers of zone have
+// no authority over the others, such as an address forged for the target of
+// a CNAME, which is resolved through its own delegation instead.
+func inBailiwick(zone string, answer []dns.RR) []dns.RR {
+	filtered := answer[:0]
+	for _, rr := range answer {
+		if dns.IsSubDomain(zone, dns.CanonicalName(rr.Header().Name)) {
+			filtered = append(filtered, rr)
+		}
+	}
+	return filtered
+}
+
+// referralZone returns the zone below zone in is a referral to, if any.
+func referralZone(zone string, q dns.Question, in *dns.Msg) string {
+	if in.Rcode != dns.RcodeSuccess || len(in.Answer) > 0 {
+		return ""
+	}
+	for _, rr := range in.Ns {
+		if rr.Header().Rrtype != dns.TypeNS {
+			continue
+		}
+		child := dns.CanonicalName(rr.Header().Name)
+		switch {
+		case child == zone, !dns.IsSubDomain(zone, child), !dns.IsSubDomain(child, dns.CanonicalName(q.Name)):
+		case q.Qtype == dns.TypeDS && child == dns.CanonicalName(q.Name):
+			// The parent side of the cut answers for DS records.
+		default:
+			return child
+		}
+	}
+	return ""
+}
+
+// referral returns the delegation in refers to from d, and caches it. The
+// glue addresses outside the zone of d are ignored, as its servers have no
+// authority over them.
+func (r *RecursiveResolver) referral(d *delegation, q dns.Question, in *dns.Msg) *delegation {
+	zone := referralZone(d.zone, q, in)
+	if zone == "" {
+		return nil
+	}
+	child := &delegation{zone: zone}
+	ttl := maxInfraTTL
+	for _, rr := range in.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok || dns.CanonicalName(ns.Hdr.Name) != zone {
+			continue
+		}
+		ttl = minTTL(ttl, ns.Hdr.Ttl)
+		server := nameServer{name: dns.CanonicalName(ns.Ns)}
+		if dns.IsSubDomain(d.zone, server.name) {
+			server.addrs = glue(in.Extra, server.name)
+		}
+		child.servers = append(child.servers, server)
+	}
+	child.expires = time.Now().Add(ttl)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pruneLocked()
+	r.delegations[zone] = child
+	return child
+}
+
+// nsAddrs resolves the addresses of the name server name.
+func (r *RecursiveResolver) nsAddrs(name string, depth int) ([]net.IP, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("%s: %w: name server resolution too deep", name, ErrServFail)
+	}
+	r.mu.Lock()
+	cached, ok := r.addrs[name]
+	r.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.addrs, nil
+	}
+
+	var (
+		addrs   []net.IP
+		ttl     = maxInfraTTL
+		lastErr error
+	)
+	for _, qtype := range r.addrTypes() {
+		in, _, err := r.resolve(dns.Question{Name: name, Qtype: qtype, Qclass: dns.ClassINET}, depth)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, rr := range in.Answer {
+			switch v := rr.(type) {
+			case *dns.A:
+				addrs = append(addrs, v.A)
+			case *dns.AAAA:
+				addrs = append(addrs, v.AAAA)
+			default:
+				continue
+			}
+			ttl = minTTL(ttl, rr.Header().Ttl)
+		}
+		if len(addrs) > 0 {
+			break
+		}
+	}
+	if len(addrs) == 0 {
+		if lastErr != nil {
+			return nil, lastErr
+		}
+		return nil, fmt.Errorf("%s: %w: name server without address", name, ErrServFail)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pruneLocked()
+	r.addrs[name] = cachedAddrs{addrs: addrs, expires: time.Now().Add(ttl)}
+	return addrs, nil
+}
+
+// addrTypes returns the address types of the name servers to use.
+func (r *RecursiveResolver) addrTypes() []uint16 {
+	switch {
+	case r.opts.UseIPv4 && !r.opts.UseIPv6:
+		return []uint16{dns.TypeA}
+	case r.opts.UseIPv6 && !r.opts.UseIPv4:
+		return []uint16{dns.TypeAAAA}
+	}
+	return []uint16{dns.TypeA, dns.TypeAAAA}
+}
+
+// filterAddrs returns the addresses of addrs to use, IPv4 ones first.
+func (r *RecursiveResolver) filterAddrs(addrs []net.IP) []net.IP {
+	var filtered []net.IP
+	for _, qtype := range r.addrTypes() {
+		for _, ip := range addrs {
+			if (ip.To4() != nil) == (qtype == dns.TypeA) {
+				filtered = append(filtered, ip)
+			}
+		}
+	}
+	return filtered
+}
+
+// isLame reports whether server failed for zone recently.
+func (r *RecursiveResolver) isLame(zone, server string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	expires, ok := r.lame[zone+" "+server]
+	return ok && time.Now().Before(expires)
+}
+
+// setLame leaves server out of the servers of zone for a while.
+func (r *RecursiveResolver) setLame(zone, server string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pruneLocked()
+	r.lame[zone+" "+server] = time.Now().Add(lameTTL)
+}
+
+// pruneLocked removes the expired entries of the caches when they grow too
+// large; r.mu must be held.
+func (r *RecursiveResolver) pruneLocked() {
+	if len(r.delegations)+len(r.addrs)+len(r.lame) < maxInfraEntries {
+		return
+	}
+	now := time.Now()
+	for zone, d := range r.delegations {
+		if !now.Before(d.expires) {
+			delete(r.delegations, zone)
+		}
+	}
+	for name, a := range r.addrs {
+		if !now.Before(a.expires) {
+			delete(r.addrs, name)
+		}
+	}
+	for key, expires := range r.lame {
+		if !now.Before(expires) {
+			delete(r.lame, key)
+		}
+	}
+}
+
+// cnameTarget returns the name the CNAME chain of answer leads to from
+// name, if the records of qtype for it are missing.
+func cnameTarget(answer []dns.RR, name string, qtype uint16) string {
+	target := name
+	for i := 0; i < len(answer); i++ {
+		next := ""
+		for _, rr := range answer {
+			if c, ok := rr.(*dns.CNAME); ok && dns.CanonicalName(c.Hdr.Name) == target {
+				next = dns.CanonicalName(c.Target)
+			}
+		}
+		if next == "" {
+			break
+		}
+		target = next
+	}
+	if target == name {
+		return ""
+	}
+	for _, rr := range answer {
+		if rr.Header().Rrtype == qtype && dns.CanonicalName(rr.Header().Name) == target {
+			return ""
+		}
+	}
+	return target
+}
+
+// glue returns the addresses of name in extra.
+func glue(extra []dns.RR, name string) []net.IP {
+	var addrs []net.IP
+	for _, rr := range extra {
+		if dns.CanonicalName(rr.Header().Name) != name {
+			continue
+		}
+		switch v := rr.(type) {
+		case *dns.A:
+			addrs = append(addrs, v.A)
+		case *dns.AAAA:
+			addrs = append(addrs, v.AAAA)
+		}
+	}
+	return addrs
+}
+
+// parent returns the name one label above name.
+func parent(name string) string {
+	i, end := dns.NextLabel(name, 0)
+	if end {
+		return "."
+	}
+	return name[i:]
+}
+
+// ancestor returns the last labels of name.
+func ancestor(name string, labels int) string {
+	idx := dns.Split(name)
+	if labels >= len(idx) {
+		return name
+	}
+	return name[idx[len(idx)-labels]:]
+}
+
+// minTTL returns the smaller of d and ttl seconds.
+func minTTL(d time.Duration, ttl uint32) time.Duration {
+	if t := time.Duration(ttl) * time.Second; t < d {
+		return t
+	}
+	return d
+}
@@ -0,0 +1,307 @@
+package resolvers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/dnsutils/internal/dialer"
+	"github.com/bepass-org/dnsutils/internal/statute"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// authServer stands in for the authoritative servers of zone, referring to
+// the zones delegated by its NS records. Refusing servers are lame.
+type authServer struct {
+	zone   string
+	rrs    []dns.RR
+	refuse bool
+	// forged records are added to every answer.
+	forged []dns.RR
+
+	mu      sync.Mutex
+	queries []dns.Question
+}
+
+func newAuthServer(t *testing.T, zone string, records ...string) *authServer {
+	s := &authServer{zone: zone}
+	records = append(records, zone+" 3600 SOA ns.invalid. hostmaster.invalid. 1 7200 3600 86400 300")
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.rrs = append(s.rrs, rr)
+	}
+	return s
+}
+
+func (s *authServer) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	q := req.Question[0]
+	name := dns.CanonicalName(q.Name)
+	s.mu.Lock()
+	s.queries = append(s.queries, q)
+	s.mu.Unlock()
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	defer func() { _ = w.WriteMsg(m) }()
+	if s.refuse {
+		m.Rcode = dns.RcodeRefused
+		return
+	}
+	for _, rr := range s.rrs {
+		owner := rr.Header().Name
+		if rr.Header().Rrtype != dns.TypeNS || owner == s.zone || !dns.IsSubDomain(owner, name) ||
+			q.Qtype == dns.TypeDS && owner == name {
+			continue
+		}
+		for _, rr := range s.rrs {
+			if ns, ok := rr.(*dns.NS); ok && ns.Hdr.Name == owner {
+				m.Ns = append(m.Ns, ns)
+				m.Extra = append(m.Extra, s.records(ns.Ns, dns.TypeA)...)
+			}
+		}
+		return
+	}
+
+	m.Authoritative = true
+	exists := false
+	for _, rr := range s.rrs {
+		owner := rr.Header().Name
+		if dns.IsSubDomain(name, owner) {
+			exists = true
+		}
+		if owner == name && (rr.Header().Rrtype == q.Qtype || rr.Header().Rrtype == dns.TypeCNAME) {
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+	if len(m.Answer) > 0 {
+		m.Answer = append(m.Answer, s.forged...)
+	} else {
+		if !exists {
+			m.Rcode = dns.RcodeNameError
+		}
+		m.Ns = s.records(s.zone, dns.TypeSOA)
+	}
+}
+
+// records returns the records of name and type.
+func (s *authServer) records(name string, qtype uint16) []dns.RR {
+	var rrs []dns.RR
+	for _, rr := range s.rrs {
+		if rr.Header().Name == name && rr.Header().Rrtype == qtype {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+// names returns the names queried, and forgets them.
+func (s *authServer) names() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for _, q := range s.queries {
+		names = append(names, q.Name)
+	}
+	s.queries = nil
+	return names
+}
+
+// startAuthServers starts the servers on UDP, and returns a dialer reaching
+// each of them on port 53 of its IP.
+func startAuthServers(t *testing.T, servers map[string]*authServer) *dialer.AppDialer {
+	addrs := map[string]string{}
+	for ip, s := range servers {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := &dns.Server{PacketConn: pc, Handler: s}
+		go func() { _ = srv.ActivateAndServe() }()
+		t.Cleanup(func() { _ = srv.Shutdown() })
+		addrs[net.JoinHostPort(ip, "53")] = pc.LocalAddr().String()
+	}
+	return dialer.NewAppDialer(time.Second, func(ctx context.Context, network, addr string) (net.Conn, error) {
+		local, ok := addrs[addr]
+		if !ok {
+			return nil, fmt.Errorf("no server at %s", addr)
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, local)
+	})
+}
+
+func TestRecursiveResolver(t *testing.T) {
+	root := newAuthServer(t, ".",
+		"test. 3600 NS ns.test.",
+		"ns.test. 3600 A 192.0.2.2",
+	)
+	tld := newAuthServer(t, "test.",
+		"example.test. 3600 NS ns1.example.test.",
+		"example.test. 3600 NS ns2.example.test.",
+		"ns1.example.test. 3600 A 192.0.2.3",
+		"ns2.example.test. 3600 A 192.0.2.4",
+		// Glueless, as its name server is in another zone.
+		"other.test. 3600 NS ns.example.test.",
+	)
+	lame := &authServer{refuse: true}
+	example := newAuthServer(t, "example.test.",
+		"www.example.test. 300 CNAME web.other.test.",
+		"a.b.example.test. 300 A 198.51.100.2",
+		"ns.example.test. 300 A 192.0.2.5",
+	)
+	other := newAuthServer(t, "other.test.",
+		"web.other.test. 300 A 198.51.100.1",
+	)
+	servers := map[string]*authServer{
+		"192.0.2.1": root,
+		"192.0.2.2": tld,
+		"192.0.2.3": lame,
+		"192.0.2.4": example,
+		"192.0.2.5": other,
+	}
+	d := startAuthServers(t, servers)
+
+	tests := []struct {
+		name    string
+		answers []string
+		err     error
+	}{
+		{"www.example.test.", []string{"web.other.test.", "198.51.100.1"}, nil},
+		{"a.b.example.test.", []string{"198.51.100.2"}, nil},
+		{"b.example.test.", nil, nil},
+		{"missing.example.test.", nil, ErrNXDomain},
+		{"missing.test.", nil, ErrNXDomain},
+	}
+	for _, minimise := range []bool{false, true} {
+		opts := statute.ResolverOptions{Logger: nopLogger{}, Timeout: time.Second, Ndots: 1, Dialer: d}
+		resolver, err := NewRecursiveResolver(RecursiveResolverOpts{
+			Hints:             []string{"ns.root. 192.0.2.1"},
+			QNameMinimisation: minimise,
+		}, opts)
+		if !assert.Nil(t, err) {
+			return
+		}
+		for i, test := range tests {
+			rsp, err := resolver.Lookup(dns.Question{Name: test.name, Qtype: dns.TypeA, Qclass: dns.ClassINET})
+			assert.True(t, errors.Is(err, test.err), "test %d: %v", i, err)
+			var answers []string
+			for _, a := range rsp.Answers {
+				answers = append(answers, a.Address)
+			}
+			assert.Equal(t, test.answers, answers, "test %d", i)
+		}
+
+		// Servers only see the labels of the names below their zone, plus
+		// one, with minimisation.
+		for _, name := range root.names() {
+			assert.Equal(t, minimise, name == "test.", "%v: %s", minimise, name)
+		}
+		for _, name := range tld.names() {
+			if minimise {
+				assert.Equal(t, 2, dns.CountLabel(name), name)
+			}
+		}
+
+		// Delegations are cached, and the lame server is left out.
+		for _, s := range servers {
+			s.names()
+		}
+		_, err = resolver.Lookup(dns.Question{Name: "www.example.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+		assert.Nil(t, err)
+		assert.Empty(t, root.names())
+		assert.Empty(t, tld.names())
+		assert.Empty(t, lame.names())
+		assert.Equal(t, []string{"www.example.test."}, example.names())
+	}
+}
+
+func TestRecursiveResolverLameDelegation(t *testing.T) {
+	root := newAuthServer(t, ".",
+		"test. 3600 NS ns1.test.",
+		"test. 3600 NS ns2.test.",
+		"ns1.test. 3600 A 192.0.2.2",
+		"ns2.test. 3600 A 192.0.2.3",
+	)
+	// A server referring back to the zone it is asked about is lame too.
+	upward := newAuthServer(t, ".", "test. 3600 NS ns1.test.")
+	tld := newAuthServer(t, "test.",
+		"www.test. 300 A 198.51.100.1",
+		"broken.test. 3600 NS ns.broken.test.",
+		"ns.broken.test. 3600 A 192.0.2.4",
+	)
+	broken := &authServer{refuse: true}
+	d := startAuthServers(t, map[string]*authServer{
+		"192.0.2.1": root,
+		"192.0.2.2": upward,
+		"192.0.2.3": tld,
+		"192.0.2.4": broken,
+	})
+
+	opts := statute.ResolverOptions{
+		Logger:     nopLogger{},
+		Timeout:    time.Second,
+		Ndots:      1,
+		SearchList: []string{"broken.test", "test"},
+		Dialer:     d,
+	}
+	resolver, err := NewRecursiveResolver(RecursiveResolverOpts{Hints: []string{"ns.root. 192.0.2.1"}}, opts)
+	if !assert.Nil(t, err) {
+		return
+	}
+	rsp, err := resolver.Lookup(dns.Question{Name: "www.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	if assert.Nil(t, err) && assert.Len(t, rsp.Answers, 1) {
+		assert.Equal(t, "198.51.100.1", rsp.Answers[0].Address)
+		assert.True(t, strings.HasSuffix(rsp.Answers[0].Nameserver, ":53"))
+	}
+
+	// The names of the search list failing to resolve are skipped.
+	rsp, err = resolver.Lookup(dns.Question{Name: "www", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	if assert.Nil(t, err) && assert.Len(t, rsp.Answers, 1) {
+		assert.Equal(t, "www.test.", rsp.Questions[len(rsp.Questions)-1].Name)
+		assert.Equal(t, "198.51.100.1", rsp.Answers[0].Address)
+	}
+	assert.Equal(t, []string{"www.broken.test."}, broken.names())
+}
+
+func TestRecursiveResolverBailiwick(t *testing.T) {
+	root := newAuthServer(t, ".",
+		"test. 3600 NS ns.test.",
+		"ns.test. 3600 A 192.0.2.2",
+	)
+	tld := newAuthServer(t, "test.",
+		"evil.test. 3600 NS ns.evil.test.",
+		"ns.evil.test. 3600 A 192.0.2.3",
+		"bank.test. 300 A 198.51.100.1",
+	)
+	evil := newAuthServer(t, "evil.test.", "www.evil.test. 300 CNAME bank.test.")
+	forged, err := dns.NewRR("bank.test. 300 A 203.0.113.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	evil.forged = []dns.RR{forged}
+	d := startAuthServers(t, map[string]*authServer{"192.0.2.1": root, "192.0.2.2": tld, "192.0.2.3": evil})
+
+	opts := statute.ResolverOptions{Logger: nopLogger{}, Timeout: time.Second, Ndots: 1, Dialer: d}
+	resolver, err := NewRecursiveResolver(RecursiveResolverOpts{Hints: []string{"ns.root. 192.0.2.1"}}, opts)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// The address of the CNAME target comes from its own zone, not from
+	// the server of the alias.
+	rsp, err := resolver.Lookup(dns.Question{Name: "www.evil.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	assert.Nil(t, err)
+	var answers []string
+	for _, a := range rsp.Answers {
+		answers = append(answers, a.Address)
+	}
+	assert.Equal(t, []string{"bank.test.", "198.51.100.1"}, answers)
+}
@@ -0,0 +1,52 @@
+package resolvers
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultRootHints are the root name servers and their addresses, from the
+// named.root file published by IANA.
+var DefaultRootHints = []string{
+	"a.root-servers.net. 198.41.0.4 2001:503:ba3e::2:30",
+	"b.root-servers.net. 170.247.170.2 2801:1b8:10::b",
+	"c.root-servers.net. 192.33.4.12 2001:500:2::c",
+	"d.root-servers.net. 199.7.91.13 2001:500:2d::d",
+	"e.root-servers.net. 192.203.230.10 2001:500:a8::e",
+	"f.root-servers.net. 192.5.5.241 2001:500:2f::f",
+	"g.root-servers.net. 192.112.36.4 2001:500:12::d0d",
+	"h.root-servers.net. 198.97.190.53 2001:500:1::53",
+	"i.root-servers.net. 192.36.148.17 2001:7fe::53",
+	"j.root-servers.net. 192.58.128.30 2001:503:c27::2:30",
+	"k.root-servers.net. 193.0.14.129 2001:7fd::1",
+	"l.root-servers.net. 199.7.83.42 2001:500:9f::42",
+	"m.root-servers.net. 202.12.27.33 2001:dc3::35",
+}
+
+// parseRootHints parses hints made of a name server name followed by its
+// addresses.
+func parseRootHints(hints []string) ([]nameServer, error) {
+	servers := make([]nameServer, 0, len(hints))
+	for _, hint := range hints {
+		fields := strings.Fields(hint)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("root hint without addresses: %q", hint)
+		}
+		if _, ok := dns.IsDomainName(fields[0]); !ok {
+			return nil, fmt.Errorf("invalid root hint name: %q", hint)
+		}
+		ns := nameServer{name: dns.CanonicalName(fields[0])}
+		for _, addr := range fields[1:] {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid root hint address: %q", hint)
+			}
+			ns.addrs = append(ns.addrs, ip)
+		}
+		servers = append(servers, ns)
+	}
+	return servers, nil
+}
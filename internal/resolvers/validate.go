@@ -0,0 +1,132 @@
+package resolvers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	// ErrServFail is returned when the server failed to process the query.
+	ErrServFail = errors.New("server failure")
+
+	// ErrNXDomain is returned when the queried name does not exist. The
+	// response is returned along with it, for its authority section.
+	ErrNXDomain = errors.New("non-existent domain")
+
+	// ErrRefused is returned when the server refused to answer the query.
+	ErrRefused = errors.New("query refused")
+
+	// ErrMismatch is returned when a response does not belong to the query
+	// it was received for, or is malformed.
+	ErrMismatch = errors.New("response does not match the query")
+)
+
+// validateResponse checks that in is a sane response to msg and maps its
+// rcode to an error. The question name is compared case-insensitively,
+// checkCase takes care of the exact casing.
+func validateResponse(msg, in *dns.Msg) error {
+	q := msg.Question[0]
+	switch {
+	case in.Id != msg.Id:
+		return fmt.Errorf("%w: id %d, expected %d", ErrMismatch, in.Id, msg.Id)
+	case !in.Response:
+		return fmt.Errorf("%w: not a response", ErrMismatch)
+	case in.Opcode != msg.Opcode:
+		return fmt.Errorf("%w: opcode %s, expected %s", ErrMismatch,
+			dns.OpcodeToString[in.Opcode], dns.OpcodeToString[msg.Opcode])
+	case len(in.Question) != 1:
+		return fmt.Errorf("%w: %d questions", ErrMismatch, len(in.Question))
+	}
+	if rq := in.Question[0]; !strings.EqualFold(rq.Name, q.Name) || rq.Qtype != q.Qtype || rq.Qclass != q.Qclass {
+		return fmt.Errorf("%w: question %s, expected %s", ErrMismatch, questionString(rq), questionString(q))
+	}
+
+	switch in.Rcode {
+	case dns.RcodeSuccess:
+	case dns.RcodeNameError:
+		// The answer may still hold the CNAME chain leading to the name.
+		if err := checkSections(q, in); err != nil {
+			return err
+		}
+		return fmt.Errorf("%s: %w", q.Name, ErrNXDomain)
+	case dns.RcodeServerFailure:
+		return fmt.Errorf("%s: %w", q.Name, ErrServFail)
+	case dns.RcodeRefused:
+		return fmt.Errorf("%s: %w", q.Name, ErrRefused)
+	default:
+		return fmt.Errorf("%s: error from nameserver: %s", q.Name, dns.RcodeToString[in.Rcode])
+	}
+	return checkSections(q, in)
+}
+
+// checkSections verifies that every answer record belongs to the question,
+// directly or through the CNAME and DNAME chain, and that the sections are
+// of the class of the question.
+func checkSections(q dns.Question, in *dns.Msg) error {
+	for _, section := range [][]dns.RR{in.Answer, in.Ns} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				return fmt.Errorf("%w: OPT record outside of the additional section", ErrMismatch)
+			}
+			if rr.Header().Class != q.Qclass {
+				return fmt.Errorf("%w: record of class %s", ErrMismatch, dns.ClassToString[rr.Header().Class])
+			}
+		}
+	}
+	opts := 0
+	for _, rr := range in.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			opts++
+		}
+	}
+	if opts > 1 {
+		return fmt.Errorf("%w: %d OPT records", ErrMismatch, opts)
+	}
+
+	// Collect the names the chain leads to, and the DNAMEs used along the
+	// way. Chains are usually in order, but nothing requires it.
+	var (
+		names  = map[string]bool{strings.ToLower(q.Name): true}
+		dnames = map[string]bool{}
+	)
+	for changed := true; changed; {
+		changed = false
+		for _, rr := range in.Answer {
+			var target string
+			switch v := rr.(type) {
+			case *dns.CNAME:
+				if names[strings.ToLower(v.Hdr.Name)] {
+					target = v.Target
+				}
+			case *dns.DNAME:
+				for name := range names {
+					if dns.IsSubDomain(v.Hdr.Name, name) && !strings.EqualFold(v.Hdr.Name, name) {
+						target = name[:len(name)-len(v.Hdr.Name)] + v.Target
+						dnames[strings.ToLower(v.Hdr.Name)] = true
+						break
+					}
+				}
+			}
+			if target = strings.ToLower(target); target != "" && !names[target] {
+				names[target] = true
+				changed = true
+			}
+		}
+	}
+	for _, rr := range in.Answer {
+		owner := strings.ToLower(rr.Header().Name)
+		if names[owner] || dnames[owner] {
+			continue
+		}
+		return fmt.Errorf("%w: unrelated answer record for %s", ErrMismatch, rr.Header().Name)
+	}
+	return nil
+}
+
+// questionString formats q as in the question section of dig.
+func questionString(q dns.Question) string {
+	return fmt.Sprintf("%s %s %s", q.Name, dns.ClassToString[q.Qclass], dns.TypeToString[q.Qtype])
+}
@@ -0,0 +1,68 @@
+package resolvers
+
+import (
+	"errors"
+
+	"github.com/bepass-org/dnsutils/internal/dnssec"
+	"github.com/bepass-org/dnsutils/internal/statute"
+	"github.com/miekg/dns"
+)
+
+// ValidatingResolver checks the DNSSEC signatures of the responses of
+// another resolver, which must be created with the DNSSEC option so that the
+// signatures are requested.
+type ValidatingResolver struct {
+	upstream  statute.IResolver
+	validator *dnssec.Validator
+}
+
+// NewValidatingResolver wraps upstream with a validator trusting anchors,
+// or the root zone anchors if there are none.
+func NewValidatingResolver(upstream statute.IResolver, anchors []dns.RR) (statute.IResolver, error) {
+	r := &ValidatingResolver{upstream: upstream}
+	validator, err := dnssec.NewValidator(r.exchange, anchors)
+	if err != nil {
+		return nil, err
+	}
+	r.validator = validator
+	return r, nil
+}
+
+// Lookup resolves question with the upstream and sets the security status of
+// the response. Bogus responses are returned along with an error wrapping
+// dnssec.ErrBogus.
+func (r *ValidatingResolver) Lookup(question dns.Question) (statute.Response, error) {
+	rsp, err := r.upstream.Lookup(question)
+	if err != nil && !errors.Is(err, ErrNXDomain) {
+		return rsp, err
+	}
+	if rsp.Msg == nil {
+		// Such as the system resolver, which has no DNSSEC records to offer.
+		rsp.Security = statute.Indeterminate
+		return rsp, err
+	}
+	// Denials of existence are validated too, and keep their error.
+	security, verr := r.validator.Validate(rsp.Msg)
+	rsp.Security = security
+	if verr != nil {
+		return rsp, verr
+	}
+	return rsp, err
+}
+
+// Close closes the upstream.
+func (r *ValidatingResolver) Close() error {
+	return statute.Close(r.upstream)
+}
+
+// exchange sends the queries of the validator to the upstream.
+func (r *ValidatingResolver) exchange(q dns.Question) (*dns.Msg, error) {
+	rsp, err := r.upstream.Lookup(q)
+	if err != nil && !errors.Is(err, ErrNXDomain) {
+		return nil, err
+	}
+	if rsp.Msg == nil {
+		return nil, errors.New("upstream does not return DNS messages")
+	}
+	return rsp.Msg, nil
+}
@@ -0,0 +1,133 @@
+package sources
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+var (
+	// ErrInvalidSignature is returned for data not matching its signature.
+	ErrInvalidSignature = errors.New("invalid signature")
+
+	// ErrKeyMismatch is returned for signatures made with another key.
+	ErrKeyMismatch = errors.New("signature made with another key")
+)
+
+// Minisign signature algorithms: Ed25519 of the data, or of its BLAKE2b-512
+// hash for the current, prehashed signatures.
+const (
+	algEd25519       = "Ed"
+	algHashedEd25519 = "ED"
+)
+
+// PublicKey is a minisign public key.
+type PublicKey struct {
+	KeyID [8]byte
+	Key   ed25519.PublicKey
+}
+
+// ParsePublicKey parses a minisign public key, either its base64 form or the
+// contents of a .pub file.
+func ParsePublicKey(s string) (PublicKey, error) {
+	var pk PublicKey
+	lines := nonEmptyLines(s)
+	if len(lines) == 0 {
+		return pk, errors.New("empty public key")
+	}
+	b, err := base64.StdEncoding.DecodeString(lines[len(lines)-1])
+	if err != nil {
+		return pk, fmt.Errorf("public key: %w", err)
+	}
+	if len(b) != 2+8+ed25519.PublicKeySize || string(b[:2]) != algEd25519 {
+		return pk, errors.New("public key: unsupported format")
+	}
+	copy(pk.KeyID[:], b[2:10])
+	pk.Key = ed25519.PublicKey(b[10:])
+	return pk, nil
+}
+
+// Signature is a minisign signature, as found in .minisig files.
+type Signature struct {
+	Algorithm       string
+	KeyID           [8]byte
+	Signature       []byte
+	TrustedComment  string
+	GlobalSignature []byte
+}
+
+// ParseSignature parses the contents of a .minisig file:
+//
+//	untrusted comment: <comment>
+//	<base64 of algorithm, key ID and signature>
+//	trusted comment: <comment>
+//	<base64 of global signature>
+func ParseSignature(data []byte) (Signature, error) {
+	var sig Signature
+	lines := nonEmptyLines(string(data))
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], "untrusted comment:") {
+		return sig, errors.New("signature: unsupported format")
+	}
+	b, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil {
+		return sig, fmt.Errorf("signature: %w", err)
+	}
+	if len(b) != 2+8+ed25519.SignatureSize {
+		return sig, errors.New("signature: unsupported format")
+	}
+	sig.Algorithm = string(b[:2])
+	if sig.Algorithm != algEd25519 && sig.Algorithm != algHashedEd25519 {
+		return sig, fmt.Errorf("signature: unsupported algorithm %q", sig.Algorithm)
+	}
+	copy(sig.KeyID[:], b[2:10])
+	sig.Signature = b[10:]
+
+	comment, ok := strings.CutPrefix(lines[2], "trusted comment: ")
+	if !ok {
+		return sig, errors.New("signature: missing trusted comment")
+	}
+	sig.TrustedComment = comment
+	if sig.GlobalSignature, err = base64.StdEncoding.DecodeString(lines[3]); err != nil {
+		return sig, fmt.Errorf("global signature: %w", err)
+	}
+	if len(sig.GlobalSignature) != ed25519.SignatureSize {
+		return sig, errors.New("global signature: unsupported format")
+	}
+	return sig, nil
+}
+
+// Verify checks that sig is a signature of data by pk, trusted comment
+// included.
+func (pk PublicKey) Verify(data []byte, sig Signature) error {
+	if sig.KeyID != pk.KeyID {
+		return ErrKeyMismatch
+	}
+	if sig.Algorithm == algHashedEd25519 {
+		hash := blake2b.Sum512(data)
+		data = hash[:]
+	}
+	if !ed25519.Verify(pk.Key, data, sig.Signature) {
+		return ErrInvalidSignature
+	}
+	global := append(bytes.Clone(sig.Signature), sig.TrustedComment...)
+	if !ed25519.Verify(pk.Key, global, sig.GlobalSignature) {
+		return fmt.Errorf("trusted comment: %w", ErrInvalidSignature)
+	}
+	return nil
+}
+
+// nonEmptyLines returns the trimmed lines of s that are not empty.
+func nonEmptyLines(s string) []string {
+	var lines []string
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
@@ -0,0 +1,235 @@
+// Package sources reads DNSCrypt-proxy style resolver lists, such as
+// public-resolvers.md, signed with minisign.
+package sources
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/ameshkov/dnsstamps"
+	"github.com/bepass-org/dnsutils/internal/dnscrypt"
+)
+
+// Protocols of the list entries, as selected by Criteria.
+const (
+	ProtoPlain         = "plain"
+	ProtoDNSCrypt      = "dnscrypt"
+	ProtoDoH           = "doh"
+	ProtoDoT           = "dot"
+	ProtoDoQ           = "doq"
+	ProtoDNSCryptRelay = "dnscrypt-relay"
+)
+
+// Entry is a stamp of a list, with the metadata of the server. Servers with
+// several stamps, such as for IPv4 and IPv6, have an entry for each.
+type Entry struct {
+	Name        string
+	Description string
+	Stamp       string
+	Protocol    string
+	// Address is the server address the stamp stands for, in the form
+	// expected by the resolver: the stamp itself for DNSCrypt, a URL for
+	// DoH, tls:// and udp:// ones for DoT and plain DNS. It is empty for
+	// unsupported protocols.
+	Address string
+	// ServerIP is the IP address the stamp gives for the host of the
+	// Address of DoH and DoT servers, if any, so that it needs no
+	// resolution.
+	ServerIP string
+	// Hashes are the SHA-256 hashes of the TBS certificates one of which
+	// the chain of DoH and DoT servers must hold.
+	Hashes   [][]byte
+	IPv6     bool
+	DNSSEC   bool
+	NoLog    bool
+	NoFilter bool
+}
+
+// Load reads the list at listFile after verifying its minisign signature in
+// sigFile against key.
+func Load(listFile, sigFile string, key PublicKey) ([]Entry, error) {
+	data, err := os.ReadFile(listFile)
+	if err != nil {
+		return nil, err
+	}
+	sigData, err := os.ReadFile(sigFile)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := ParseSignature(sigData)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", sigFile, err)
+	}
+	if err = key.Verify(data, sig); err != nil {
+		return nil, fmt.Errorf("%s: %w", listFile, err)
+	}
+	return Parse(bytes.NewReader(data))
+}
+
+// Parse reads a list in markdown, where each server is a "## name" heading
+// followed by its description and its sdns:// stamps, one per line.
+func Parse(r io.Reader) ([]Entry, error) {
+	var (
+		entries     []Entry
+		name        string
+		description []string
+		stamps      int
+	)
+	// A server without stamps is probably a list in another format.
+	checkStamps := func(line int) error {
+		if name != "" && stamps == 0 {
+			return fmt.Errorf("line %d: %s: no stamps", line, name)
+		}
+		return nil
+	}
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "## "):
+			if err := checkStamps(n); err != nil {
+				return nil, err
+			}
+			name = strings.TrimSpace(line[3:])
+			description, stamps = nil, 0
+		case name == "":
+			// The title and introduction of the list.
+		case strings.HasPrefix(line, "sdns://"):
+			entry, err := parseStamp(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s: %w", n, name, err)
+			}
+			entry.Name = name
+			entry.Description = strings.TrimSpace(strings.Join(description, "\n"))
+			entries = append(entries, entry)
+			stamps++
+		case stamps == 0:
+			description = append(description, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := checkStamps(n); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// parseStamp returns the entry for stamp, without name and description.
+func parseStamp(stamp string) (Entry, error) {
+	entry := Entry{Stamp: stamp}
+	s, err := dnsstamps.NewServerStampFromString(stamp)
+	if err != nil {
+		// dnsstamps doesn't know about relay stamps.
+		relay, relayErr := dnscrypt.RelayAddress(stamp)
+		if relayErr != nil {
+			return entry, err
+		}
+		entry.Protocol = ProtoDNSCryptRelay
+		entry.Address = relay
+		entry.IPv6 = isIPv6(relay)
+		return entry, nil
+	}
+
+	entry.IPv6 = isIPv6(s.ServerAddrStr)
+	entry.DNSSEC = s.Props&dnsstamps.ServerInformalPropertyDNSSEC != 0
+	entry.NoLog = s.Props&dnsstamps.ServerInformalPropertyNoLog != 0
+	entry.NoFilter = s.Props&dnsstamps.ServerInformalPropertyNoFilter != 0
+	switch s.Proto {
+	case dnsstamps.StampProtoTypePlain:
+		entry.Protocol = ProtoPlain
+		entry.Address = "udp://" + s.ServerAddrStr
+	case dnsstamps.StampProtoTypeDNSCrypt:
+		entry.Protocol = ProtoDNSCrypt
+		entry.Address = stamp
+	case dnsstamps.StampProtoTypeDoH:
+		entry.Protocol = ProtoDoH
+		entry.Address = "https://" + s.ProviderName + s.Path
+		entry.ServerIP, entry.Hashes = hostIP(s.ServerAddrStr), s.Hashes
+	case dnsstamps.StampProtoTypeTLS:
+		entry.Protocol = ProtoDoT
+		entry.Address = "tls://" + s.ProviderName
+		entry.ServerIP, entry.Hashes = hostIP(s.ServerAddrStr), s.Hashes
+	case dnsstamps.StampProtoTypeDoQ:
+		entry.Protocol = ProtoDoQ
+	}
+	return entry, nil
+}
+
+// isIPv6 reports whether the host of address is an IPv6 address.
+func isIPv6(address string) bool {
+	ip := net.ParseIP(hostIP(address))
+	return ip != nil && ip.To4() == nil
+}
+
+// hostIP returns the host of address, with or without port, if it is an IP
+// address.
+func hostIP(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	host = strings.Trim(host, "[]")
+	if net.ParseIP(host) == nil {
+		return ""
+	}
+	return host
+}
+
+// Criteria select list entries. The zero value selects every entry.
+type Criteria struct {
+	// Names are the servers to select, any if empty.
+	Names []string
+	// Protocols are the protocols to select, any if empty.
+	Protocols []string
+	// NoIPv6 leaves out the servers with an IPv6 address.
+	NoIPv6 bool
+	// DNSSEC, NoLog and NoFilter select the servers announcing the
+	// property.
+	DNSSEC   bool
+	NoLog    bool
+	NoFilter bool
+}
+
+// Match reports whether entry meets the criteria.
+func (c Criteria) Match(entry Entry) bool {
+	switch {
+	case len(c.Names) > 0 && !contains(c.Names, entry.Name),
+		len(c.Protocols) > 0 && !contains(c.Protocols, entry.Protocol),
+		c.NoIPv6 && entry.IPv6,
+		c.DNSSEC && !entry.DNSSEC,
+		c.NoLog && !entry.NoLog,
+		c.NoFilter && !entry.NoFilter:
+		return false
+	}
+	return true
+}
+
+// Select returns the entries meeting c, in order.
+func Select(entries []Entry, c Criteria) []Entry {
+	var selected []Entry
+	for _, entry := range entries {
+		if c.Match(entry) {
+			selected = append(selected, entry)
+		}
+	}
+	return selected
+}
+
+// contains reports whether values contains value, ignoring case.
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+package sources
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ameshkov/dnsstamps"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/blake2b"
+)
+
+// stamp returns the stamp of a server with props.
+func stamp(proto dnsstamps.StampProtoType, addr, provider, path string, props dnsstamps.ServerInformalProperties) string {
+	s := dnsstamps.ServerStamp{
+		ServerAddrStr: addr,
+		ProviderName:  provider,
+		Path:          path,
+		Props:         props,
+		Proto:         proto,
+	}
+	if proto == dnsstamps.StampProtoTypeDNSCrypt {
+		s.ServerPk = make([]byte, ed25519.PublicKeySize)
+	}
+	return s.String()
+}
+
+// relayStamp returns the stamp of an Anonymized DNSCrypt relay at addr.
+func relayStamp(addr string) string {
+	b := append([]byte{0x81, byte(len(addr))}, addr...)
+	return "sdns://" + base64.RawURLEncoding.EncodeToString(b)
+}
+
+// sign returns the public key in base64 and the minisign signature of data
+// made with a new key pair.
+func sign(t *testing.T, data []byte, alg string) (string, []byte) {
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID := []byte("01234567")
+	msg := data
+	if alg == algHashedEd25519 {
+		hash := blake2b.Sum512(data)
+		msg = hash[:]
+	}
+	sig := ed25519.Sign(sk, msg)
+	comment := "timestamp:1700000000"
+	global := ed25519.Sign(sk, append(append([]byte{}, sig...), comment...))
+
+	key := base64.StdEncoding.EncodeToString(append(append([]byte(algEd25519), keyID...), pk...))
+	minisig := "untrusted comment: signature\n" +
+		base64.StdEncoding.EncodeToString(append(append([]byte(alg), keyID...), sig...)) + "\n" +
+		"trusted comment: " + comment + "\n" +
+		base64.StdEncoding.EncodeToString(global) + "\n"
+	return key, []byte(minisig)
+}
+
+func TestParse(t *testing.T) {
+	all := dnsstamps.ServerInformalPropertyDNSSEC | dnsstamps.ServerInformalPropertyNoLog | dnsstamps.ServerInformalPropertyNoFilter
+	list := strings.Join([]string{
+		"# public-resolvers",
+		"",
+		"An introduction with sdns://AA in it.",
+		"",
+		"## crypt",
+		"",
+		"A DNSCrypt server.",
+		"",
+		stamp(dnsstamps.StampProtoTypeDNSCrypt, "192.0.2.1:443", "2.dnscrypt-cert.example", "", all),
+		stamp(dnsstamps.StampProtoTypeDNSCrypt, "[2001:db8::1]:443", "2.dnscrypt-cert.example", "", all),
+		"",
+		"## doh",
+		"",
+		stamp(dnsstamps.StampProtoTypeDoH, "192.0.2.2:443", "doh.example", "/dns-query", dnsstamps.ServerInformalPropertyNoLog),
+		"",
+		"## dot",
+		stamp(dnsstamps.StampProtoTypeTLS, "192.0.2.3:853", "dot.example", "", 0),
+		"",
+		"## plain",
+		stamp(dnsstamps.StampProtoTypePlain, "192.0.2.4:53", "", "", dnsstamps.ServerInformalPropertyDNSSEC),
+		"",
+		"## relay",
+		relayStamp("192.0.2.5:443"),
+	}, "\n")
+
+	entries, err := Parse(strings.NewReader(list))
+	if !assert.Nil(t, err) {
+		return
+	}
+	tests := []struct {
+		criteria Criteria
+		addrs    []string
+	}{
+		{Criteria{}, []string{entries[0].Stamp, entries[1].Stamp, "https://doh.example/dns-query", "tls://dot.example", "udp://192.0.2.4:53", "192.0.2.5:443"}},
+		{Criteria{NoIPv6: true, DNSSEC: true}, []string{entries[0].Stamp, "udp://192.0.2.4:53"}},
+		{Criteria{NoLog: true}, []string{entries[0].Stamp, entries[1].Stamp, "https://doh.example/dns-query"}},
+		{Criteria{Protocols: []string{ProtoDoT, ProtoDNSCryptRelay}}, []string{"tls://dot.example", "192.0.2.5:443"}},
+		{Criteria{Names: []string{"DoH"}, NoFilter: true}, nil},
+	}
+	for i, test := range tests {
+		var addrs []string
+		for _, entry := range Select(entries, test.criteria) {
+			addrs = append(addrs, entry.Address)
+		}
+		assert.Equal(t, test.addrs, addrs, "test %d", i)
+	}
+	assert.Equal(t, "crypt", entries[1].Name)
+	assert.Equal(t, "A DNSCrypt server.", entries[1].Description)
+	assert.True(t, entries[1].IPv6)
+	assert.Equal(t, "192.0.2.2", entries[2].ServerIP)
+	assert.Equal(t, "192.0.2.3", entries[3].ServerIP)
+	assert.Empty(t, entries[4].ServerIP)
+
+	_, err = Parse(strings.NewReader("## empty\n\nNo stamps.\n\n## next\n" + relayStamp("192.0.2.5")))
+	assert.NotNil(t, err)
+	_, err = Parse(strings.NewReader("## bad\nsdns://AQ\n"))
+	assert.NotNil(t, err)
+}
+
+func TestLoad(t *testing.T) {
+	list := []byte("## plain\n" + stamp(dnsstamps.StampProtoTypePlain, "192.0.2.4:53", "", "", 0) + "\n")
+	otherKey, _ := sign(t, list, algEd25519)
+	dir := t.TempDir()
+	listFile := filepath.Join(dir, "public-resolvers.md")
+	sigFile := listFile + ".minisig"
+
+	for i, alg := range []string{algEd25519, algHashedEd25519} {
+		key, sig := sign(t, list, alg)
+		if err := os.WriteFile(listFile, list, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(sigFile, sig, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		pk, err := ParsePublicKey("untrusted comment: minisign public key\n" + key + "\n")
+		if !assert.Nil(t, err, "test %d", i) {
+			continue
+		}
+		entries, err := Load(listFile, sigFile, pk)
+		assert.Nil(t, err, "test %d", i)
+		assert.Len(t, entries, 1, "test %d", i)
+
+		other, _ := ParsePublicKey(otherKey)
+		other.KeyID = pk.KeyID
+		_, err = Load(listFile, sigFile, other)
+		assert.ErrorIs(t, err, ErrInvalidSignature, "test %d", i)
+		other.KeyID[0]++
+		_, err = Load(listFile, sigFile, other)
+		assert.ErrorIs(t, err, ErrKeyMismatch, "test %d", i)
+
+		if err := os.WriteFile(listFile, append(list, '\n'), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		_, err = Load(listFile, sigFile, pk)
+		assert.ErrorIs(t, err, ErrInvalidSignature, "test %d", i)
+	}
+}
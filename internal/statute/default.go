@@ -1,8 +1,12 @@
 package statute
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"github.com/bepass-org/dnsutils/internal/cache"
 	"github.com/bepass-org/dnsutils/internal/dialer"
@@ -52,27 +56,51 @@ func DefaultDialerFunc(_ context.Context, network, addr string) (net.Conn, error
 
 // DefaultTLSDialerFunc is a custom TLS dialer function
 func DefaultTLSDialerFunc(ctx context.Context, network, addr string) (net.Conn, error) {
-	// Dial the raw connection using the default dialer
-	rawConn, err := DefaultDialerFunc(ctx, network, addr)
-	if err != nil {
-		return nil, err
-	}
+	return NewTLSDialerFunc(DefaultDialerFunc)(ctx, network, addr)
+}
 
-	// Initiate a TLS handshake over the connection
-	tlsConn := tls.Client(rawConn, &tls.Config{
-		ServerName: addr,
-	})
-	err = tlsConn.Handshake()
-	if err != nil {
-		err := rawConn.Close()
+// NewTLSDialerFunc returns a TLS dialer function that performs the handshake
+// over connections made by raw, such as ones tunnelled through a proxy.
+func NewTLSDialerFunc(raw dialer.TDialerFunc) dialer.TDialerFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		// Dial the raw connection using the given dialer
+		rawConn, err := raw(ctx, network, addr)
 		if err != nil {
 			return nil, err
 		}
-		return nil, err
+
+		// Initiate a TLS handshake over the connection
+		config := &tls.Config{ServerName: dialer.ServerName(ctx, addr)}
+		if pins := dialer.Pins(ctx); len(pins) > 0 {
+			config.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+				return verifyPins(pins, chains)
+			}
+		}
+		tlsConn := tls.Client(rawConn, config)
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			_ = rawConn.Close()
+			return nil, err
+		}
+
+		// Return the established TLS connection
+		return tlsConn, nil
 	}
+}
 
-	// Return the established TLS connection
-	return tlsConn, nil
+// verifyPins checks that one of the verified chains holds a certificate whose
+// TBS part has one of the pinned SHA-256 hashes.
+func verifyPins(pins [][]byte, chains [][]*x509.Certificate) error {
+	for _, chain := range chains {
+		for _, cert := range chain {
+			hash := sha256.Sum256(cert.RawTBSCertificate)
+			for _, pin := range pins {
+				if bytes.Equal(pin, hash[:]) {
+					return nil
+				}
+			}
+		}
+	}
+	return errors.New("tls: no pinned certificate in the chain of the server")
 }
 
 // default logger
@@ -100,22 +128,37 @@ type Cache interface {
 }
 
 type DefaultCache struct {
+	// TTL is the lifetime of cached items, DefaultTTL minutes if not set.
+	TTL time.Duration
+	// Disabled turns the cache into a no-op.
+	Disabled bool
+
 	co   *cache.Cache
 	once sync.Once
 }
 
 func (c *DefaultCache) prepareCache() {
 	c.once.Do(func() {
-		c.co = cache.NewCache(DefaultTTL * time.Minute)
+		ttl := c.TTL
+		if ttl <= 0 {
+			ttl = DefaultTTL * time.Minute
+		}
+		c.co = cache.NewCache(ttl)
 	})
 }
 
 func (c *DefaultCache) Set(key string, value interface{}) {
+	if c.Disabled {
+		return
+	}
 	c.prepareCache()
 	c.co.Set(key, value)
 }
 
 func (c *DefaultCache) Get(key string) (interface{}, bool) {
+	if c.Disabled {
+		return nil, false
+	}
 	c.prepareCache()
 	return c.co.Get(key)
 }
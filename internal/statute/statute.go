@@ -3,6 +3,7 @@ package statute
 import (
 	"github.com/bepass-org/dnsutils/internal/dialer"
 	"github.com/miekg/dns"
+	"io"
 	"net"
 	"net/http"
 	"strings"
@@ -12,10 +13,21 @@ import (
 // IResolver implements the configuration for a DNS
 // Client. Different types of providers can load
 // a DNS IResolver satisfying this interface.
+// Resolvers holding resources, such as idle connections, also implement
+// io.Closer.
 type IResolver interface {
 	Lookup(dns.Question) (Response, error)
 }
 
+// Close releases the resources of resolver if it implements io.Closer.
+// Lookups already running on it complete normally.
+func Close(resolver IResolver) error {
+	if c, ok := resolver.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
 // GetDNSType parse dns server uri returns the type of DNS server
 // based on its URI, handling common misspellings and case variations.
 func GetDNSType(uri string) string {
@@ -33,7 +45,7 @@ func GetDNSType(uri string) string {
 		return "tcp"
 	}
 	if strings.HasPrefix(normalized, "tls://") {
-		return "tls"
+		return "dot"
 	}
 	if strings.HasPrefix(normalized, "https://") {
 		return "doh"
@@ -41,6 +53,9 @@ func GetDNSType(uri string) string {
 	if strings.HasPrefix(normalized, "sdns://") {
 		return "crypt"
 	}
+	if normalized == "recursive" || strings.HasPrefix(normalized, "recursive://") {
+		return "recursive"
+	}
 	return "unknown"
 }
 
@@ -51,8 +66,30 @@ type Response struct {
 	Answers     []Answer    `json:"answers"`
 	Authorities []Authority `json:"authorities"`
 	Questions   []Question  `json:"questions"`
+	Security    Security    `json:"security,omitempty"`
+	Poisoned    bool        `json:"poisoned,omitempty"`
+	Blocked     bool        `json:"blocked,omitempty"`
+
+	// Msg is the raw DNS message the response was parsed from, if any.
+	Msg *dns.Msg `json:"-"`
 }
 
+// Security is the DNSSEC validation status of a response, as defined in
+// RFC 4033 section 5. It is empty when validation is disabled.
+type Security string
+
+const (
+	// Secure responses are signed by a chain of trust from a trust anchor.
+	Secure Security = "secure"
+	// Insecure responses are proven to come from an unsigned zone.
+	Insecure Security = "insecure"
+	// Bogus responses should be signed but failed validation.
+	Bogus Security = "bogus"
+	// Indeterminate responses could not be validated, for example because
+	// no trust anchor covers them.
+	Indeterminate Security = "indeterminate"
+)
+
 type Question struct {
 	Name  string `json:"name"`
 	Type  string `json:"type"`
@@ -101,4 +138,55 @@ type ResolverOptions struct {
 	RawDialerFunc      dialer.TDialerFunc
 	TLSDialerFunc      dialer.TDialerFunc
 	HttpClient         *http.Client
+	Bootstrap          *dialer.Bootstrap
+	DNSSEC             bool
+	TrustAnchors       []dns.RR
+	// InjectionFilter and CaseRandomization defend plain DNS upstreams
+	// against forged responses. Encrypted transports authenticate their
+	// responses, so resolvers for them ignore both.
+	InjectionFilter   *InjectionFilter
+	CaseRandomization bool
+	ClientSubnet      *ClientSubnet
+}
+
+// ClientSubnetMode is how the EDNS Client Subnet option of queries is
+// handled.
+type ClientSubnetMode int
+
+const (
+	// ClientSubnetRemove strips the option, so that upstreams never learn
+	// about the network of the client.
+	ClientSubnetRemove ClientSubnetMode = iota
+	// ClientSubnetAdd sends the subnet unless the query carries one already.
+	ClientSubnetAdd
+	// ClientSubnetOverride sends the subnet, replacing any the query carries.
+	ClientSubnetOverride
+)
+
+// ClientSubnet is the EDNS Client Subnet (RFC 7871) policy of the queries
+// sent to an upstream.
+type ClientSubnet struct {
+	Mode ClientSubnetMode
+	// Subnet is sent by the add and override modes.
+	Subnet *net.IPNet
+}
+
+// InjectionFilter configures the hardened plain UDP mode, which defends
+// against forged responses raced ahead of the genuine one by on-path
+// attackers.
+type InjectionFilter struct {
+	// Window is how long to keep listening for responses after the first.
+	Window time.Duration
+	// BogusNets are address ranges that forged responses are known to use.
+	BogusNets []*net.IPNet
+}
+
+// IsBogus reports whether ip is in one of the known bogus ranges.
+func (f *InjectionFilter) IsBogus(ip net.IP) bool {
+	for _, n := range f.BogusNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
@@ -1,24 +1,136 @@
 package dnsutils
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bepass-org/dnsutils/internal/dialer"
+	"github.com/bepass-org/dnsutils/internal/dnssec"
+	"github.com/bepass-org/dnsutils/internal/filter"
+	"github.com/bepass-org/dnsutils/internal/proxy"
 	"github.com/bepass-org/dnsutils/internal/resolvers"
 	"github.com/bepass-org/dnsutils/internal/statute"
 	"github.com/miekg/dns"
 )
 
-// Resolver handles DNS lookups and caching
+// bootstrapTimeout is the timeout for queries sent to bootstrap servers.
+const bootstrapTimeout = 5 * time.Second
+
+// errNoAnswers is returned by LookupIP for names without addresses.
+var errNoAnswers = errors.New("no answers found")
+
+var (
+	// ErrNoDNSServer is returned by lookups on a Resolver without a DNS server.
+	ErrNoDNSServer = errors.New("no dns server set")
+
+	// ErrDNSSECBogus is returned for responses failing DNSSEC validation.
+	ErrDNSSECBogus = dnssec.ErrBogus
+
+	// ErrServFail is returned when the upstream failed to process the query.
+	ErrServFail = resolvers.ErrServFail
+
+	// ErrNXDomain is returned when the queried name does not exist.
+	ErrNXDomain = resolvers.ErrNXDomain
+
+	// ErrRefused is returned when the upstream refused to answer the query.
+	ErrRefused = resolvers.ErrRefused
+
+	// ErrMismatch is returned for responses not matching their query, or
+	// malformed ones.
+	ErrMismatch = resolvers.ErrMismatch
+
+	// ErrCaseMismatch is wrapped by CaseMismatchError. It wraps ErrMismatch.
+	ErrCaseMismatch = resolvers.ErrCaseMismatch
+
+	// ErrRebinding is returned for answers rejected by the rebinding
+	// protection.
+	ErrRebinding = filter.ErrRebinding
+)
+
+// CaseMismatchError is returned when a response does not echo the random
+// capitalisation of the query name requested by WithCaseRandomization.
+type CaseMismatchError = resolvers.CaseMismatchError
+
+// BlockMode is how lookups of blocked domains are answered.
+type BlockMode = filter.BlockMode
+
+const (
+	// BlockNXDomain answers that blocked domains don't exist.
+	BlockNXDomain = filter.BlockNXDomain
+	// BlockZeroIP resolves blocked domains to 0.0.0.0 or ::.
+	BlockZeroIP = filter.BlockZeroIP
+	// BlockRefused refuses lookups of blocked domains.
+	BlockRefused = filter.BlockRefused
+)
+
+// ClientSubnetMode is how the EDNS Client Subnet option of queries is
+// handled.
+type ClientSubnetMode = statute.ClientSubnetMode
+
+const (
+	// ClientSubnetRemove strips the option from queries.
+	ClientSubnetRemove = statute.ClientSubnetRemove
+	// ClientSubnetAdd sends a subnet unless the query carries one already.
+	ClientSubnetAdd = statute.ClientSubnetAdd
+	// ClientSubnetOverride sends a subnet, replacing any the query carries.
+	ClientSubnetOverride = statute.ClientSubnetOverride
+)
+
+// Resolver handles DNS lookups and caching.
+// It is safe for concurrent use, including reconfiguration while lookups
+// are in flight: the upstreams and hosts are immutable snapshots that the
+// reconfiguration methods swap atomically.
 type Resolver struct {
-	options  statute.ResolverOptions
+	// mu serializes reconfiguration; lookups never take it.
+	mu      sync.Mutex
+	options statute.ResolverOptions
+	servers []string
+	routes  map[string]string
+
+	upstreams atomic.Pointer[upstreams]
+	hosts     atomic.Pointer[statute.Hosts]
+	cache     statute.DefaultCache
+	logger    statute.Logger
+	rebinding *filter.Rebinding
+	blocklist *filter.Blocklist
+	blockMode filter.BlockMode
+	// stripAnswers removes blocked addresses instead of blocking responses.
+	stripAnswers bool
+	rewrites     *filter.Rewrites
+	// subnets are the EDNS Client Subnet policies by upstream address, the
+	// empty address holding the default one.
+	subnets map[string]*statute.ClientSubnet
+	// dnscrypt configures the DNSCrypt upstreams.
+	dnscrypt resolvers.DNSCryptResolverOpts
+	// recursive configures the recursive upstreams.
+	recursive resolvers.RecursiveResolverOpts
+	// proxy is the URL of the proxy tunnelling the upstream connections.
+	proxy string
+	// dialFunc and tlsDialFunc are the dialers set by the user, before the
+	// proxy and the bootstrap are put in front of them.
+	dialFunc    dialer.TDialerFunc
+	tlsDialFunc dialer.TDialerFunc
+	// customHTTPClient is set when the HTTP client was given with
+	// WithHttpClient, so that changing the dialers keeps it.
+	customHTTPClient bool
+}
+
+// upstreams is a snapshot of the default resolver and the per-domain routes.
+type upstreams struct {
 	resolver statute.IResolver
-	cache    statute.DefaultCache
-	logger   statute.Logger
-	hosts    statute.Hosts
+	routes   map[string]statute.IResolver
+	// subnet and routeSubnets are the client subnet policies the default
+	// resolver and the routes were created with.
+	subnet       *statute.ClientSubnet
+	routeSubnets map[string]*statute.ClientSubnet
 }
 
 // NewResolver creates a new Resolver with default options
@@ -37,20 +149,30 @@ func NewResolver(options ...Option) *Resolver {
 			InsecureSkipVerify: true,
 			TLSHostname:        "",
 			Logger:             statute.DefaultLogger{},
-			Dialer:             dialer.NewAppDialer(1 * time.Minute),
-			TLSDialer:          dialer.NewAppTLSDialer(1 * time.Minute),
+			Dialer:             dialer.NewAppDialer(1*time.Minute, statute.DefaultDialerFunc),
+			TLSDialer:          dialer.NewAppTLSDialer(1*time.Minute, statute.DefaultTLSDialerFunc),
 			RawDialerFunc:      statute.DefaultDialerFunc,
 			TLSDialerFunc:      statute.DefaultTLSDialerFunc,
 			HttpClient:         statute.DefaultHTTPClient(nil, nil),
 		},
-		cache:  statute.DefaultCache{},
-		logger: statute.DefaultLogger{},
-		hosts:  statute.Hosts{},
+		routes:    map[string]string{},
+		cache:     statute.DefaultCache{},
+		logger:    statute.DefaultLogger{},
+		recursive: resolvers.RecursiveResolverOpts{QNameMinimisation: true},
 	}
+	p.upstreams.Store(&upstreams{
+		routes:       map[string]statute.IResolver{},
+		routeSubnets: map[string]*statute.ClientSubnet{},
+	})
+	p.hosts.Store(&statute.Hosts{})
 
 	for _, option := range options {
 		option(p)
 	}
+	p.dialFunc, p.tlsDialFunc = p.options.RawDialerFunc, p.options.TLSDialerFunc
+	if p.proxy != "" || p.options.Bootstrap != nil {
+		p.applyDialers()
+	}
 
 	return p
 }
@@ -96,30 +218,53 @@ func WithTLSHostname(tlsHostname string) Option {
 func WithDialer(d dialer.TDialerFunc) Option {
 	return func(r *Resolver) {
 		r.options.RawDialerFunc = d
-		r.options.HttpClient = statute.DefaultHTTPClient(r.options.RawDialerFunc, r.options.TLSDialerFunc)
-		dialer.RawDialFunc = d
-		r.options.Dialer = dialer.NewAppDialer(r.options.Timeout)
+		r.options.Dialer = dialer.NewAppDialer(r.options.Timeout, d)
+		r.resetHTTPClient()
 	}
 }
 
 func WithTLSDialer(t dialer.TDialerFunc) Option {
 	return func(r *Resolver) {
 		r.options.TLSDialerFunc = t
-		r.options.HttpClient = statute.DefaultHTTPClient(r.options.RawDialerFunc, r.options.TLSDialerFunc)
-		dialer.TLSDialFunc = t
-		r.options.TLSDialer = dialer.NewAppTLSDialer(r.options.Timeout)
+		r.options.TLSDialer = dialer.NewAppTLSDialer(r.options.Timeout, t)
+		r.resetHTTPClient()
 	}
 }
 
+// WithProxy tunnels every upstream connection through the proxy at proxyURL,
+// which is socks5://[user:password@]host[:port] or
+// http://[user:password@]host[:port]. SOCKS5 proxies carry UDP through UDP
+// ASSOCIATE; HTTP proxies only carry TCP based transports. The proxy itself is
+// reached with the dialer given by WithDialer, and the bootstrap servers are
+// queried through it. An invalid URL makes every lookup fail rather than
+// bypass the proxy.
+func WithProxy(proxyURL string) Option {
+	return func(r *Resolver) {
+		r.proxy = proxyURL
+	}
+}
+
+// WithHttpClient sets the HTTP client of DoH upstreams, which is then kept
+// as is: it doesn't use the dialers, the proxy or the bootstrap.
 func WithHttpClient(client *http.Client) Option {
 	return func(r *Resolver) {
 		r.options.HttpClient = client
+		r.customHTTPClient = client != nil
+	}
+}
+
+// resetHTTPClient recreates the HTTP client of DoH upstreams with the current
+// dialers, unless it was given with WithHttpClient.
+func (r *Resolver) resetHTTPClient() {
+	if !r.customHTTPClient {
+		r.options.HttpClient = statute.DefaultHTTPClient(r.options.RawDialerFunc, r.options.TLSDialerFunc)
 	}
 }
 
 func WithLogger(logger statute.Logger) Option {
 	return func(r *Resolver) {
 		r.options.Logger = logger
+		r.logger = logger
 	}
 }
 
@@ -135,62 +280,619 @@ func WithInsecureSkipVerify(insecureSkipVerify bool) Option {
 	}
 }
 
+// WithCacheTTL sets how long resolved addresses are cached for.
+func WithCacheTTL(ttl time.Duration) Option {
+	return func(r *Resolver) {
+		r.cache.TTL = ttl
+	}
+}
+
+// WithCacheDisabled turns off caching of resolved addresses.
+func WithCacheDisabled(disabled bool) Option {
+	return func(r *Resolver) {
+		r.cache.Disabled = disabled
+	}
+}
+
+// WithDNSSEC requests DNSSEC records from the upstreams and validates every
+// response against a chain of trust starting at the given trust anchors, DS
+// or DNSKEY records in zone file format. Without valid anchors, the root
+// zone ones are used. Lookups of bogus names fail with ErrDNSSECBogus.
+func WithDNSSEC(anchors ...string) Option {
+	return func(r *Resolver) {
+		rrs, err := dnssec.ParseTrustAnchors(anchors...)
+		if err != nil {
+			r.logger.Error("ignoring trust anchors: %s", err)
+		}
+		r.options.DNSSEC = true
+		r.options.TrustAnchors = rrs
+	}
+}
+
+// WithInjectionFilter hardens plain UDP upstreams against forged responses
+// raced ahead of the genuine one by on-path attackers. Every response
+// received within window of the first one is collected and those looking
+// forged are discarded, such as ones pointing at bogusIPs, given as
+// addresses or CIDR ranges. Responses where forgery was detected are flagged
+// as poisoned.
+func WithInjectionFilter(window time.Duration, bogusIPs ...string) Option {
+	return func(r *Resolver) {
+		filter := &statute.InjectionFilter{Window: window}
+		for _, s := range bogusIPs {
+			if !strings.Contains(s, "/") {
+				if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+					s += "/32"
+				} else {
+					s += "/128"
+				}
+			}
+			_, n, err := net.ParseCIDR(s)
+			if err != nil {
+				r.logger.Error("ignoring bogus IP: %s", err)
+				continue
+			}
+			filter.BogusNets = append(filter.BogusNets, n)
+		}
+		r.options.InjectionFilter = filter
+	}
+}
+
+// WithCaseRandomization randomly capitalises the query names sent to plain
+// UDP and TCP upstreams and rejects responses not echoing the exact casing
+// with a CaseMismatchError, making forged responses harder to get accepted.
+// Responses with the name lowercased are only accepted once confirmed over
+// TCP, and upstreams confirmed to lowercase names several times in a row are
+// sent unrandomized names for an hour.
+func WithCaseRandomization(enabled bool) Option {
+	return func(r *Resolver) {
+		r.options.CaseRandomization = enabled
+	}
+}
+
+// WithDNSCryptKeyRotation makes DNSCrypt upstreams use a new client key
+// pair every interval, or for every query if interval is zero, so that the
+// servers can't link queries together by the key.
+func WithDNSCryptKeyRotation(interval time.Duration) Option {
+	return func(r *Resolver) {
+		r.dnscrypt.RotateKey = true
+		r.dnscrypt.KeyRotationInterval = interval
+	}
+}
+
+// WithDNSCryptTCP makes DNSCrypt upstreams send queries over TCP only,
+// such as through dialers without UDP support. By default, they are sent
+// over UDP and retried over TCP when the response is truncated.
+func WithDNSCryptTCP(useTCP bool) Option {
+	return func(r *Resolver) {
+		r.dnscrypt.UseTCP = useTCP
+	}
+}
+
+// WithDNSCryptRelay sends the queries to DNSCrypt upstreams through the
+// Anonymized DNSCrypt relay given by its sdns:// stamp or host:port address,
+// so that the upstreams never see the client address.
+func WithDNSCryptRelay(relay string) Option {
+	return func(r *Resolver) {
+		r.dnscrypt.Relay = relay
+	}
+}
+
+// WithRootHints replaces the root servers "recursive" upstreams start from,
+// each given as a name followed by its addresses:
+//
+//	a.root-servers.net. 198.41.0.4 2001:503:ba3e::2:30
+func WithRootHints(hints ...string) Option {
+	return func(r *Resolver) {
+		r.recursive.Hints = hints
+	}
+}
+
+// WithQNameMinimisation sets whether "recursive" upstreams send each server
+// only the part of the names it needs to see (RFC 9156). It is enabled by
+// default.
+func WithQNameMinimisation(enabled bool) Option {
+	return func(r *Resolver) {
+		r.recursive.QNameMinimisation = enabled
+	}
+}
+
+// WithRebindingProtection keeps private, loopback and link-local addresses,
+// as well as the blockedNets CIDR ranges, out of the answers for names other
+// than the allowedDomains and their subdomains. Such addresses are stripped
+// from answers, or with reject the lookups fail with ErrRebinding. Addresses
+// from the hosts are always trusted.
+func WithRebindingProtection(reject bool, allowedDomains []string, blockedNets ...string) Option {
+	return func(r *Resolver) {
+		var nets []*net.IPNet
+		for _, s := range blockedNets {
+			_, n, err := net.ParseCIDR(s)
+			if err != nil {
+				r.logger.Error("ignoring blocked net: %s", err)
+				continue
+			}
+			nets = append(nets, n)
+		}
+		r.rebinding = filter.NewRebinding(nets, allowedDomains, reject)
+	}
+}
+
+// WithBlocklist blocks the domains matched by the rule lists, in hosts file,
+// plain domain or adblock format, answering their lookups according to mode
+// without contacting the upstreams. Lists of several calls are merged, and
+// the last mode is used. Hosts take precedence over the blocklist.
+func WithBlocklist(mode BlockMode, lists ...io.Reader) Option {
+	return func(r *Resolver) {
+		if r.blocklist == nil {
+			r.blocklist = filter.NewBlocklist()
+		}
+		r.blockMode = mode
+		for _, list := range lists {
+			n, err := r.blocklist.Load(list)
+			if err != nil {
+				r.logger.Error("failed to read blocklist: %s", err)
+			}
+			r.logger.Debug("loaded %d blocklist rules", n)
+		}
+	}
+}
+
+// WithAnswerStripping makes responses holding addresses matched by the
+// address rules of the blocklist get those addresses removed, instead of
+// being blocked as a whole. Responses left without addresses are blocked.
+func WithAnswerStripping(enabled bool) Option {
+	return func(r *Resolver) {
+		r.stripAnswers = enabled
+	}
+}
+
+// WithRewrite answers the lookups of name, which may be a wildcard like
+// *.example.com, with answers instead of asking the upstreams. Each answer
+// is an IP address, a domain name to redirect to, resolved through the
+// upstreams, or a record of any type without the owner, such as
+// "TXT \"v=spf1 -all\"" or "MX 10 mail.example.com.". Rewrites take
+// precedence over the blocklist, but not over the hosts.
+func WithRewrite(name string, answers ...string) Option {
+	return func(r *Resolver) {
+		if r.rewrites == nil {
+			r.rewrites = filter.NewRewrites()
+		}
+		for _, answer := range answers {
+			if err := r.rewrites.Add(name, answer); err != nil {
+				r.logger.Error("ignoring rewrite: %s", err)
+			}
+		}
+	}
+}
+
+// WithSafeSearch enforces SafeSearch on the major search engines, and the
+// restricted mode of YouTube, moderate or with strictYouTube strict, by
+// redirecting them to their safe variants.
+func WithSafeSearch(strictYouTube bool) Option {
+	return func(r *Resolver) {
+		if r.rewrites == nil {
+			r.rewrites = filter.NewRewrites()
+		}
+		if err := r.rewrites.AddSafeSearch(strictYouTube); err != nil {
+			r.logger.Error("failed to enable SafeSearch: %s", err)
+		}
+	}
+}
+
+// WithClientSubnet sets the EDNS Client Subnet (RFC 7871) policy of the
+// queries sent to the given upstream addresses, or to all upstreams without
+// a policy of their own if none are given. subnet is a CIDR range or an
+// address, which is cut to /24 or /56 for privacy, and is ignored by the
+// remove mode. Cached answers are only reused within the scope upstreams
+// return for the subnet.
+func WithClientSubnet(mode ClientSubnetMode, subnet string, upstreams ...string) Option {
+	return func(r *Resolver) {
+		policy := &statute.ClientSubnet{Mode: mode}
+		if mode != ClientSubnetRemove {
+			n, err := parseClientSubnet(subnet)
+			if err != nil {
+				r.logger.Error("ignoring client subnet: %s", err)
+				return
+			}
+			policy.Subnet = n
+		}
+		if r.subnets == nil {
+			r.subnets = map[string]*statute.ClientSubnet{}
+		}
+		if len(upstreams) == 0 {
+			upstreams = []string{""}
+		}
+		for _, upstream := range upstreams {
+			r.subnets[upstream] = policy
+		}
+	}
+}
+
 func WithHost(domain string, ips []string) Option {
 	return func(r *Resolver) {
-		r.hosts[domain] = ips
+		r.AddHost(domain, ips)
+	}
+}
+
+// WithBootstrap resolves the hostnames of upstream servers, such as the host of
+// a DoH URL, through the given plain DNS servers instead of the system
+// resolver.
+func WithBootstrap(servers ...string) Option {
+	return func(r *Resolver) {
+		b := r.bootstrap()
+		for _, server := range servers {
+			if err := b.AddServer(server); err != nil {
+				r.logger.Error("ignoring bootstrap server: %s", err)
+			}
+		}
+	}
+}
+
+// WithBootstrapHost statically maps an upstream server hostname to its IP
+// addresses, see WithBootstrap.
+func WithBootstrapHost(domain string, ips []string) Option {
+	return func(r *Resolver) {
+		if err := r.bootstrap().AddHost(domain, ips); err != nil {
+			r.logger.Error("ignoring bootstrap host: %s", err)
+		}
+	}
+}
+
+// bootstrap returns the resolver's bootstrap, creating it on first use.
+func (r *Resolver) bootstrap() *dialer.Bootstrap {
+	if r.options.Bootstrap == nil {
+		r.options.Bootstrap = dialer.NewBootstrap(bootstrapTimeout, nil)
+	}
+	return r.options.Bootstrap
+}
+
+// applyDialers installs the user's dialers as the upstream dialers, behind
+// the proxy and the bootstrap if configured.
+func (r *Resolver) applyDialers() {
+	d, t := r.dialFunc, r.tlsDialFunc
+	if r.proxy != "" {
+		pd, err := proxy.Parse(r.proxy, d)
+		if err != nil {
+			r.logger.Error("invalid proxy %s: %s", r.proxy, err)
+			pd = func(context.Context, string, string) (net.Conn, error) {
+				return nil, err
+			}
+		}
+		d, t = pd, statute.NewTLSDialerFunc(pd)
 	}
+	if b := r.options.Bootstrap; b != nil {
+		b.SetDialFunc(d)
+		d, t = b.Wrap(d), b.Wrap(t)
+	}
+	WithDialer(d)(r)
+	WithTLSDialer(t)(r)
+	if r.customHTTPClient && r.proxy != "" {
+		r.logger.Error("the HTTP client given with WithHttpClient bypasses the proxy %s", r.proxy)
+	}
+}
+
+// SetDialer replaces the raw dialer at runtime. The upstreams are rebuilt
+// with the new dialer and swapped in; lookups in flight finish on the old one.
+func (r *Resolver) SetDialer(d dialer.TDialerFunc) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.dialFunc = d
+	r.applyDialers()
+	return r.rebuild()
+}
+
+// SetTLSDialer replaces the TLS dialer at runtime, see SetDialer. With a
+// proxy, TLS connections are made over the proxy instead.
+func (r *Resolver) SetTLSDialer(t dialer.TDialerFunc) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.tlsDialFunc = t
+	r.applyDialers()
+	return r.rebuild()
+}
+
+// AddHost maps domain to a fixed list of IP addresses, replacing any
+// previous mapping.
+func (r *Resolver) AddHost(domain string, ips []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	hosts := r.copyHosts()
+	hosts[domain] = append([]string(nil), ips...)
+	r.hosts.Store(&hosts)
+}
+
+// RemoveHost removes the mapping of domain added with AddHost or WithHost.
+func (r *Resolver) RemoveHost(domain string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	hosts := r.copyHosts()
+	delete(hosts, domain)
+	r.hosts.Store(&hosts)
+}
+
+// copyHosts returns a copy of the current hosts; r.mu must be held.
+func (r *Resolver) copyHosts() statute.Hosts {
+	current := *r.hosts.Load()
+	hosts := make(statute.Hosts, len(current)+1)
+	for domain, ips := range current {
+		hosts[domain] = ips
+	}
+	return hosts
 }
 
 func (r *Resolver) SetDNSServer(address string) error {
-	nsSrvType := statute.GetDNSType(address)
+	return r.SetDNSServers(address)
+}
+
+// SetDNSServers sets a list of upstream servers which are tried in order
+// until one of them answers. The "recursive" address resolves the names
+// from the root servers instead, without upstream.
+func (r *Resolver) SetDNSServers(addresses ...string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	resolver, err := r.newDefaultUpstream(addresses)
+	if err != nil {
+		return err
+	}
+	r.servers = addresses
+	current := r.upstreams.Load()
+	r.upstreams.Store(&upstreams{
+		resolver:     resolver,
+		routes:       current.routes,
+		subnet:       r.subnetFor(addresses[0]),
+		routeSubnets: current.routeSubnets,
+	})
+	if current.resolver != nil {
+		_ = statute.Close(current.resolver)
+	}
+	return nil
+}
+
+// AddRoute sends the lookups for domain and its subdomains to the given
+// server instead of the default one.
+func (r *Resolver) AddRoute(domain string, address string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	upstream, err := r.newUpstream(address)
+	if err != nil {
+		return err
+	}
+	domain = dns.Fqdn(strings.ToLower(domain))
+	r.routes[domain] = address
+
+	current := r.upstreams.Load()
+	routes := make(map[string]statute.IResolver, len(current.routes)+1)
+	for d, u := range current.routes {
+		routes[d] = u
+	}
+	routes[domain] = upstream
+	routeSubnets := make(map[string]*statute.ClientSubnet, len(current.routeSubnets)+1)
+	for d, s := range current.routeSubnets {
+		routeSubnets[d] = s
+	}
+	routeSubnets[domain] = r.subnetFor(address)
+	r.upstreams.Store(&upstreams{
+		resolver:     current.resolver,
+		routes:       routes,
+		subnet:       current.subnet,
+		routeSubnets: routeSubnets,
+	})
+	if old, ok := current.routes[domain]; ok {
+		_ = statute.Close(old)
+	}
+	return nil
+}
+
+// rebuild recreates every upstream with the current options and swaps them
+// in, closing the previous ones; r.mu must be held.
+func (r *Resolver) rebuild() error {
+	next := &upstreams{
+		routes:       make(map[string]statute.IResolver, len(r.routes)),
+		routeSubnets: make(map[string]*statute.ClientSubnet, len(r.routes)),
+	}
+	if len(r.servers) > 0 {
+		resolver, err := r.newDefaultUpstream(r.servers)
+		if err != nil {
+			return err
+		}
+		next.resolver = resolver
+		next.subnet = r.subnetFor(r.servers[0])
+	}
+	for domain, address := range r.routes {
+		upstream, err := r.newUpstream(address)
+		if err != nil {
+			next.close()
+			return err
+		}
+		next.routes[domain] = upstream
+		next.routeSubnets[domain] = r.subnetFor(address)
+	}
+	r.upstreams.Swap(next).close()
+	return nil
+}
+
+// Close releases the resources held by the upstreams, such as idle
+// connections. The Resolver can still be used.
+func (r *Resolver) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.upstreams.Load().close()
+}
+
+// close closes the resolvers of the snapshot, see statute.Close.
+func (u *upstreams) close() error {
 	var err error
+	if u.resolver != nil {
+		err = statute.Close(u.resolver)
+	}
+	for _, upstream := range u.routes {
+		if closeErr := statute.Close(upstream); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// upstreamFor returns the resolver responsible for fqdn, picking the route
+// with the longest matching domain.
+func (u *upstreams) upstreamFor(fqdn string) statute.IResolver {
+	if domain, ok := u.route(fqdn); ok {
+		return u.routes[domain]
+	}
+	return u.resolver
+}
+
+// subnetFor returns the client subnet policy of the resolver responsible for
+// fqdn. With several default servers, it is the one of the first.
+func (u *upstreams) subnetFor(fqdn string) *statute.ClientSubnet {
+	if domain, ok := u.route(fqdn); ok {
+		return u.routeSubnets[domain]
+	}
+	return u.subnet
+}
+
+// route returns the longest route domain matching fqdn, if any.
+func (u *upstreams) route(fqdn string) (string, bool) {
+	name := strings.ToLower(fqdn)
+	for {
+		if _, ok := u.routes[name]; ok {
+			return name, true
+		}
+		off, end := dns.NextLabel(name, 0)
+		if end {
+			return "", false
+		}
+		name = name[off:]
+	}
+}
+
+// newDefaultUpstream creates the resolver failing over between addresses.
+func (r *Resolver) newDefaultUpstream(addresses []string) (statute.IResolver, error) {
+	if len(addresses) == 1 {
+		return r.newUpstream(addresses[0])
+	}
+	upstreams := make([]statute.IResolver, 0, len(addresses))
+	for _, address := range addresses {
+		upstream, err := r.newUpstream(address)
+		if err != nil {
+			for _, u := range upstreams {
+				_ = statute.Close(u)
+			}
+			return nil, err
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	return resolvers.NewFailoverResolver(upstreams...)
+}
+
+// subnetFor returns the client subnet policy of the upstream at address.
+func (r *Resolver) subnetFor(address string) *statute.ClientSubnet {
+	if subnet, ok := r.subnets[address]; ok {
+		return subnet
+	}
+	return r.subnets[""]
+}
+
+// newUpstream creates the resolver for a server address.
+func (r *Resolver) newUpstream(address string) (statute.IResolver, error) {
+	nsSrvType := statute.GetDNSType(address)
+	opts := r.options
+	opts.ClientSubnet = r.subnetFor(address)
+	var (
+		resolver statute.IResolver
+		err      error
+	)
 	switch nsSrvType {
 	case "udp":
 		r.logger.Debug("initiating UDP resolver")
-		r.resolver, err = resolvers.NewClassicResolver(address,
+		resolver, err = resolvers.NewClassicResolver(address,
 			resolvers.ClassicResolverOpts{
 				UseTCP: false,
 				UseTLS: false,
-			}, r.options)
+			}, opts)
 	case "tcp":
 		r.logger.Debug("initiating TCP resolver")
-		r.resolver, err = resolvers.NewClassicResolver(address,
+		resolver, err = resolvers.NewClassicResolver(address,
 			resolvers.ClassicResolverOpts{
 				UseTCP: true,
 				UseTLS: false,
-			}, r.options)
+			}, opts)
 	case "dot":
 		r.logger.Debug("initiating DOT resolver")
-		r.resolver, err = resolvers.NewClassicResolver(address,
+		resolver, err = resolvers.NewClassicResolver(address,
 			resolvers.ClassicResolverOpts{
 				UseTCP: true,
 				UseTLS: true,
-			}, r.options)
+			}, opts)
 	case "doh":
 		r.logger.Debug("initiating DOH resolver")
-		r.resolver, err = resolvers.NewDOHResolver(address, r.options)
+		resolver, err = resolvers.NewDOHResolver(address, opts)
 	case "crypt":
 		r.logger.Debug("initiating DNSCrypt resolver")
-		r.resolver, err = resolvers.NewDNSCryptResolver(address,
-			resolvers.DNSCryptResolverOpts{
-				UseTCP: true,
-			}, r.options)
+		resolver, err = resolvers.NewDNSCryptResolver(address,
+			r.dnscrypt, opts)
+	case "recursive":
+		r.logger.Debug("initiating recursive resolver")
+		resolver, err = resolvers.NewRecursiveResolver(r.recursive, opts)
 	default:
 		r.logger.Debug("initiating system resolver")
-		r.resolver, err = resolvers.NewSystemResolver(r.options)
+		resolver, err = resolvers.NewSystemResolver(opts)
 		if nsSrvType == "unknown" {
 			r.logger.Error("unknown dns server type! using default system resolver as fallback")
 		}
 	}
-	return err
+	if err == nil && opts.DNSSEC {
+		resolver, err = resolvers.NewValidatingResolver(resolver, opts.TrustAnchors)
+	}
+	return resolver, err
+}
+
+// Lookup resolves a question of any type for fqdn, bypassing the hosts and
+// the cache. With WithDNSSEC, the response carries its validation status.
+func (r *Resolver) Lookup(fqdn string, qtype uint16) (statute.Response, error) {
+	question := dns.Question{
+		Name:   dns.Fqdn(fqdn),
+		Qtype:  qtype,
+		Qclass: dns.ClassINET,
+	}
+	if rsp, ok, err := r.rewrite(question); ok {
+		return rsp, err
+	}
+	if r.blocked(question.Name) {
+		return r.blockedResponse(question)
+	}
+	upstream := r.upstreams.Load().upstreamFor(question.Name)
+	if upstream == nil {
+		return statute.Response{}, ErrNoDNSServer
+	}
+	rsp, err := upstream.Lookup(question)
+	if err == nil {
+		rsp, err = r.filterAnswer(question, rsp)
+	}
+	if err == nil && !rsp.Blocked && r.rebinding != nil {
+		rsp, err = r.rebinding.FilterResponse(fqdn, rsp)
+	}
+	return rsp, err
 }
 
 // LookupIP resolves the FQDN to an IP address using the specified resolution mechanism.
 func (r *Resolver) LookupIP(fqdn string) ([]string, error) {
+	ips, _, err := r.resolveIP(fqdn)
+	return ips, err
+}
+
+// resolveIP is LookupIP, also reporting whether the answer is the one given
+// to blocked domains, which the rebinding protection lets through.
+func (r *Resolver) resolveIP(fqdn string) (ips []string, blocked bool, err error) {
 	// CheckHosts checks if a given domain exists in the local resolver's hosts file
 	// and returns the corresponding IP address if found, or an empty string if not.
-	if ips, ok := r.hosts[fqdn]; ok {
-		return ips, nil
+	if ips, ok := (*r.hosts.Load())[fqdn]; ok {
+		return ips, false, nil
 	}
 
 	// Ensure fqdn ends with a period
@@ -198,10 +900,46 @@ func (r *Resolver) LookupIP(fqdn string) ([]string, error) {
 		fqdn += "."
 	}
 
+	if rsp, ok, err := r.rewrite(dns.Question{Name: fqdn, Qtype: dns.TypeA, Qclass: dns.ClassINET}); ok {
+		if err != nil {
+			return nil, false, err
+		}
+		for _, answer := range rsp.Answers {
+			if answer.Type == "A" {
+				ips = append(ips, answer.Address)
+			}
+		}
+		if len(ips) == 0 {
+			return nil, false, errNoAnswers
+		}
+		return ips, rsp.Blocked, nil
+	}
+
+	if r.blocked(fqdn) {
+		rsp, err := r.blockedResponse(dns.Question{Name: fqdn, Qtype: dns.TypeA, Qclass: dns.ClassINET})
+		if err != nil {
+			return nil, true, err
+		}
+		return []string{rsp.Answers[0].Address}, true, nil
+	}
+
+	ips, blocked, err = r.lookupIP(fqdn)
+	if err == nil && !blocked && r.rebinding != nil {
+		ips, err = r.rebinding.FilterIPs(fqdn, ips)
+		if err == nil && len(ips) == 0 {
+			err = errNoAnswers
+		}
+	}
+	return ips, blocked, err
+}
+
+// lookupIP resolves fqdn with the cache or the upstreams. Blocked answers
+// are not cached.
+func (r *Resolver) lookupIP(fqdn string) (ips []string, blocked bool, err error) {
 	// Check the cache for fqdn
-	if cachedValue, _ := r.cache.Get(fqdn); cachedValue != nil {
+	if cachedValue, ok := r.cachedIPs(fqdn); ok {
 		r.logger.Debug("using cached value for %s", fqdn)
-		return cachedValue.([]string), nil
+		return cachedValue, false, nil
 	}
 
 	question := dns.Question{
@@ -210,28 +948,123 @@ func (r *Resolver) LookupIP(fqdn string) ([]string, error) {
 		Qclass: dns.ClassINET,
 	}
 
-	response, err := r.resolver.Lookup(question)
+	upstream := r.upstreams.Load().upstreamFor(fqdn)
+	if upstream == nil {
+		return nil, false, ErrNoDNSServer
+	}
+
+	response, err := upstream.Lookup(question)
+	if err == nil {
+		response, err = r.filterAnswer(question, response)
+	}
 	if err != nil {
-		return nil, err
+		return nil, response.Blocked, err
 	}
 
 	if len(response.Answers) == 0 {
-		return nil, errors.New("no answers found")
+		return nil, false, errNoAnswers
 	}
 
 	r.logger.Debug("resolved %s to %s", fqdn, response.Answers[0].Address)
 	if response.Answers[0].Type == "CNAME" {
-		ip, err := r.LookupIP(response.Answers[0].Address)
+		ip, blocked, err := r.resolveIP(response.Answers[0].Address)
 		if err != nil {
-			return nil, err
+			return nil, blocked, err
+		}
+		if !blocked {
+			r.cache.Set(cacheKey(fqdn, response.Msg), ip)
 		}
-		r.cache.Set(fqdn, ip)
-		return ip, nil
+		return ip, blocked, nil
 	}
-	var ips []string
 	for _, answer := range response.Answers {
 		ips = append(ips, answer.Address)
 	}
-	r.cache.Set(fqdn, ips)
-	return ips, nil
+	if !response.Blocked {
+		r.cache.Set(cacheKey(fqdn, response.Msg), ips)
+	}
+	return ips, response.Blocked, nil
+}
+
+// rewrite answers question from the rewrites. ok is false if no rewrite
+// applies.
+func (r *Resolver) rewrite(question dns.Question) (rsp statute.Response, ok bool, err error) {
+	if r.rewrites == nil {
+		return rsp, false, nil
+	}
+	rw, err := r.rewrites.Rewrite(question)
+	if err != nil || rw == nil {
+		return rsp, err != nil, err
+	}
+	r.logger.Debug("rewriting %s", question.Name)
+
+	msg := new(dns.Msg)
+	msg.Response = true
+	msg.RecursionAvailable = true
+	msg.Question = []dns.Question{question}
+	msg.Answer = rw.Answer
+	rsp = resolvers.ParseMessage(msg, 0, "rewrite")
+	rsp.Questions = []statute.Question{{
+		Name:  question.Name,
+		Class: dns.ClassToString[question.Qclass],
+		Type:  dns.TypeToString[question.Qtype],
+	}}
+	if rw.Target == "" {
+		return rsp, true, nil
+	}
+
+	target, err := r.Lookup(rw.Target, question.Qtype)
+	rsp.Answers = append(rsp.Answers, target.Answers...)
+	rsp.Authorities = target.Authorities
+	rsp.Blocked = target.Blocked
+	if target.Msg != nil {
+		msg.Answer = append(msg.Answer, target.Msg.Answer...)
+		msg.Ns = target.Msg.Ns
+		msg.Rcode = target.Msg.Rcode
+	}
+	return rsp, true, err
+}
+
+// blocked reports whether fqdn is blocked by the blocklist.
+func (r *Resolver) blocked(fqdn string) bool {
+	if r.blocklist == nil || !r.blocklist.Match(fqdn) {
+		return false
+	}
+	r.logger.Debug("blocked %s", fqdn)
+	return true
+}
+
+// filterAnswer blocks rsp if its answer matches the blocklist, such as
+// trackers cloaked behind CNAMEs.
+func (r *Resolver) filterAnswer(question dns.Question, rsp statute.Response) (statute.Response, error) {
+	if r.blocklist == nil {
+		return rsp, nil
+	}
+	action := filter.AnswerBlock
+	if r.stripAnswers {
+		action = filter.AnswerStrip
+	}
+	rsp, blocked := r.blocklist.FilterAnswer(rsp, action)
+	if !blocked {
+		return rsp, nil
+	}
+	r.logger.Debug("blocked %s by its answer", question.Name)
+	return r.blockedResponse(question)
+}
+
+// blockedResponse answers question for a blocked domain.
+func (r *Resolver) blockedResponse(question dns.Question) (statute.Response, error) {
+	rsp := resolvers.ParseMessage(r.blockMode.Reply(question), 0, "blocklist")
+	rsp.Questions = []statute.Question{{
+		Name:  question.Name,
+		Class: dns.ClassToString[question.Qclass],
+		Type:  dns.TypeToString[question.Qtype],
+	}}
+	rsp.Blocked = true
+	switch rsp.Msg.Rcode {
+	case dns.RcodeNameError:
+		return rsp, fmt.Errorf("%s: blocked: %w", question.Name, ErrNXDomain)
+	case dns.RcodeRefused:
+		return rsp, fmt.Errorf("%s: blocked: %w", question.Name, ErrRefused)
+	}
+	return rsp, nil
 }
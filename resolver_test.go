@@ -0,0 +1,967 @@
+package dnsutils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/dnsutils/internal/proxy/proxytest"
+	"github.com/bepass-org/dnsutils/internal/statute"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// nopLogger discards all log messages.
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+// startTestServer starts a UDP DNS server answering every A query with ip
+// and returns its address.
+func startTestServer(t *testing.T, ip string) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			if r.Question[0].Qtype == dns.TypeA {
+				m.Answer = append(m.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.ParseIP(ip),
+				})
+			}
+			_ = w.WriteMsg(m)
+		}),
+	}
+	go func() { _ = srv.ActivateAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+	return "udp://" + pc.LocalAddr().String()
+}
+
+// startHandlerServer starts a UDP DNS server answering with handler and
+// returns its address.
+func startHandlerServer(t *testing.T, handler dns.HandlerFunc) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: handler}
+	go func() { _ = srv.ActivateAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+	return "udp://" + pc.LocalAddr().String()
+}
+
+func TestResolverRoutes(t *testing.T) {
+	r := NewResolver(WithLogger(nopLogger{}), WithCacheDisabled(true))
+
+	_, err := r.LookupIP("example.com")
+	assert.ErrorIs(t, err, ErrNoDNSServer)
+
+	assert.Nil(t, r.SetDNSServer(startTestServer(t, "192.0.2.1")))
+	assert.Nil(t, r.AddRoute("corp.example", startTestServer(t, "192.0.2.2")))
+
+	tests := []struct {
+		fqdn string
+		exp  string
+	}{
+		{"example.com", "192.0.2.1"},
+		{"corp.example", "192.0.2.2"},
+		{"host.CORP.example.", "192.0.2.2"},
+		{"notcorp.example", "192.0.2.1"},
+	}
+	for i, test := range tests {
+		ips, err := r.LookupIP(test.fqdn)
+		assert.Nil(t, err, "test %d", i)
+		assert.Equal(t, []string{test.exp}, ips, "test %d", i)
+	}
+}
+
+// TestResolverConcurrentReconfiguration is meant to be run with -race.
+func TestResolverConcurrentReconfiguration(t *testing.T) {
+	servers := []string{startTestServer(t, "192.0.2.1"), startTestServer(t, "192.0.2.2")}
+
+	r := NewResolver(WithLogger(nopLogger{}), WithCacheDisabled(true))
+	assert.Nil(t, r.SetDNSServer(servers[0]))
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				ips, err := r.LookupIP("example.com")
+				assert.Nil(t, err)
+				if assert.Len(t, ips, 1) {
+					assert.Contains(t, []string{"192.0.2.1", "192.0.2.2"}, ips[0])
+				}
+				_, _ = r.LookupIP("static.test")
+			}
+		}()
+	}
+
+	go func() {
+		defer close(done)
+		dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		}
+		for i := 0; i < 50; i++ {
+			assert.Nil(t, r.SetDNSServer(servers[i%2]))
+			r.AddHost("static.test", []string{"192.0.2.3"})
+			r.RemoveHost("static.test")
+			assert.Nil(t, r.SetDialer(dial))
+		}
+	}()
+
+	wg.Wait()
+	<-done
+}
+
+func TestResolverIndependentDialers(t *testing.T) {
+	server := startTestServer(t, "192.0.2.1")
+
+	var dials [2]int32
+	newResolver := func(i int) *Resolver {
+		r := NewResolver(
+			WithLogger(nopLogger{}),
+			WithCacheDisabled(true),
+			WithDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+				atomic.AddInt32(&dials[i], 1)
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			}),
+		)
+		assert.Nil(t, r.SetDNSServer(server))
+		return r
+	}
+	first, second := newResolver(0), newResolver(1)
+
+	for i := 0; i < 3; i++ {
+		_, err := first.LookupIP("example.com")
+		assert.Nil(t, err)
+	}
+	_, err := second.LookupIP("example.com")
+	assert.Nil(t, err)
+
+	assert.Equal(t, int32(3), atomic.LoadInt32(&dials[0]))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&dials[1]))
+}
+
+// closingResolver is an upstream recording whether it was closed.
+type closingResolver struct {
+	closed atomic.Bool
+}
+
+func (*closingResolver) Lookup(dns.Question) (statute.Response, error) {
+	return statute.Response{}, ErrNoDNSServer
+}
+
+func (c *closingResolver) Close() error {
+	c.closed.Store(true)
+	return nil
+}
+
+func TestResolverClosesReplacedUpstreams(t *testing.T) {
+	server := startTestServer(t, "192.0.2.1")
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+
+	tests := []struct {
+		replace func(r *Resolver) error
+		// closed tells whether the default upstream and the route were
+		// closed.
+		closed [2]bool
+	}{
+		{func(r *Resolver) error { return r.SetDNSServer(server) }, [2]bool{true, false}},
+		{func(r *Resolver) error { return r.AddRoute("corp.test", server) }, [2]bool{false, true}},
+		{func(r *Resolver) error { return r.AddRoute("other.test", server) }, [2]bool{false, false}},
+		{func(r *Resolver) error { return r.SetDialer(dial) }, [2]bool{true, true}},
+		{func(r *Resolver) error { return r.Close() }, [2]bool{true, true}},
+	}
+	for i, test := range tests {
+		r := NewResolver(WithLogger(nopLogger{}))
+		assert.Nil(t, r.SetDNSServer(server), "test %d", i)
+		assert.Nil(t, r.AddRoute("corp.test", server), "test %d", i)
+		upstream, route := &closingResolver{}, &closingResolver{}
+		r.upstreams.Store(&upstreams{
+			resolver:     upstream,
+			routes:       map[string]statute.IResolver{"corp.test.": route},
+			routeSubnets: map[string]*statute.ClientSubnet{},
+		})
+
+		assert.Nil(t, test.replace(r), "test %d", i)
+		assert.Equal(t, test.closed, [2]bool{upstream.closed.Load(), route.closed.Load()}, "test %d", i)
+	}
+}
+
+// startTCPListener starts a TCP server closing every connection it accepts,
+// standing in for TLS based upstreams, and returns its address.
+func startTCPListener(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestResolverProxy(t *testing.T) {
+	udp := strings.TrimPrefix(startTestServer(t, "192.0.2.1"), "udp://")
+	tcp := startTCPListener(t)
+
+	tests := []struct {
+		scheme   string
+		start    func(testing.TB, string, string) *proxytest.Proxy
+		upstream string
+		target   string
+		ok       bool
+	}{
+		{"socks5", proxytest.NewSOCKS5, "udp://" + udp, udp, true},
+		{"socks5", proxytest.NewSOCKS5, "tls://" + tcp, tcp, false},
+		{"socks5", proxytest.NewSOCKS5, "https://" + tcp + "/dns-query", tcp, false},
+		{"http", proxytest.NewHTTP, "udp://" + udp, "", false},
+		{"http", proxytest.NewHTTP, "tls://" + tcp, tcp, false},
+		{"http", proxytest.NewHTTP, "https://" + tcp + "/dns-query", tcp, false},
+	}
+	for i, test := range tests {
+		p := test.start(t, "", "")
+		var dials int32
+		r := NewResolver(
+			WithLogger(nopLogger{}),
+			WithCacheDisabled(true),
+			WithTimeout(time.Second),
+			// The proxy is reached with the dialer given after it.
+			WithProxy(test.scheme+"://"+p.Addr),
+			WithDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+				atomic.AddInt32(&dials, 1)
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			}),
+		)
+		assert.Nil(t, r.SetDNSServer(test.upstream), "test %d", i)
+
+		// The stand-in TLS upstreams only need to be reached.
+		ips, err := r.LookupIP("example.com")
+		if test.ok {
+			assert.Nil(t, err, "test %d", i)
+			assert.Equal(t, []string{"192.0.2.1"}, ips, "test %d", i)
+		} else {
+			assert.NotNil(t, err, "test %d", i)
+		}
+		if test.target == "" {
+			assert.Empty(t, p.Targets(), "test %d", i)
+		} else {
+			assert.Contains(t, p.Targets(), test.target, "test %d", i)
+			assert.NotZero(t, atomic.LoadInt32(&dials), "test %d", i)
+		}
+	}
+
+	// Through HTTP proxies, the bootstrap servers are queried over TCP.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{Listener: ln, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if req.Question[0].Qtype == dns.TypeA {
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP("127.0.0.1"),
+			})
+		}
+		_ = w.WriteMsg(m)
+	})}
+	go func() { _ = srv.ActivateAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	p := proxytest.NewHTTP(t, "", "")
+	r := NewResolver(WithLogger(nopLogger{}), WithCacheDisabled(true), WithTimeout(time.Second),
+		WithProxy("http://"+p.Addr), WithBootstrap(ln.Addr().String()))
+	assert.Nil(t, r.SetDNSServer("tcp://dns.test:"+port))
+	ips, err := r.LookupIP("example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"127.0.0.1"}, ips)
+	assert.Equal(t, []string{ln.Addr().String(), ln.Addr().String(), ln.Addr().String()}, p.Targets())
+}
+
+func TestResolverHttpClient(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		q := new(dns.Msg)
+		if err := q.Unpack(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m := new(dns.Msg)
+		m.SetReply(q)
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("192.0.2.1"),
+		})
+		b, _ := m.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(b)
+	}))
+	t.Cleanup(ts.Close)
+	p := proxytest.NewSOCKS5(t, "", "")
+
+	// Only the client given, trusting the certificate of the server, can
+	// reach it.
+	tests := [][]Option{
+		{WithHttpClient(ts.Client()), WithProxy("socks5://" + p.Addr)},
+		{WithProxy("socks5://" + p.Addr), WithHttpClient(ts.Client())},
+		{WithHttpClient(ts.Client()), WithBootstrap("udp://127.0.0.1:53")},
+		{WithHttpClient(ts.Client()), WithDialer(statute.DefaultDialerFunc)},
+	}
+	for i, options := range tests {
+		r := NewResolver(append(options, WithLogger(nopLogger{}), WithCacheDisabled(true))...)
+		assert.Nil(t, r.SetDNSServer(ts.URL+"/dns-query"), "test %d", i)
+		ips, err := r.LookupIP("example.com")
+		assert.Nil(t, err, "test %d", i)
+		assert.Equal(t, []string{"192.0.2.1"}, ips, "test %d", i)
+
+		assert.Nil(t, r.SetDialer(statute.DefaultDialerFunc), "test %d", i)
+		ips, err = r.LookupIP("example.org")
+		assert.Nil(t, err, "test %d", i)
+		assert.Equal(t, []string{"192.0.2.1"}, ips, "test %d", i)
+	}
+	assert.Empty(t, p.Targets())
+}
+
+// startInjectedServer starts a UDP DNS server answering every query twice:
+// first with a forged response pointing at 198.51.100.1, as an on-path
+// injector would, then with the genuine one pointing at 192.0.2.1.
+func startInjectedServer(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req := new(dns.Msg)
+			if req.Unpack(buf[:n]) != nil {
+				continue
+			}
+			for _, ip := range []string{"198.51.100.1", "192.0.2.1"} {
+				m := new(dns.Msg)
+				m.SetReply(req)
+				m.RecursionAvailable = true
+				m.Answer = append(m.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.ParseIP(ip),
+				})
+				// Only the genuine resolver echoes EDNS.
+				if opt := req.IsEdns0(); opt != nil && ip == "192.0.2.1" {
+					m.SetEdns0(opt.UDPSize(), false)
+				}
+				b, _ := m.Pack()
+				_, _ = pc.WriteTo(b, addr)
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	}()
+	t.Cleanup(func() { _ = pc.Close() })
+	return "udp://" + pc.LocalAddr().String()
+}
+
+func TestResolverInjectionFilter(t *testing.T) {
+	server := startInjectedServer(t)
+
+	tests := []struct {
+		options  []Option
+		exp      string
+		poisoned bool
+	}{
+		{nil, "198.51.100.1", false},
+		{[]Option{WithInjectionFilter(100 * time.Millisecond)}, "192.0.2.1", true},
+		{[]Option{WithInjectionFilter(100*time.Millisecond, "198.51.100.0/24")}, "192.0.2.1", true},
+	}
+	for i, test := range tests {
+		r := NewResolver(append([]Option{WithLogger(nopLogger{}), WithCacheDisabled(true)}, test.options...)...)
+		assert.Nil(t, r.SetDNSServer(server), "test %d", i)
+
+		rsp, err := r.Lookup("example.com", dns.TypeA)
+		if !assert.Nil(t, err, "test %d", i) || !assert.Len(t, rsp.Answers, 1, "test %d", i) {
+			continue
+		}
+		assert.Equal(t, test.exp, rsp.Answers[0].Address, "test %d", i)
+		assert.Equal(t, test.poisoned, rsp.Poisoned, "test %d", i)
+	}
+}
+
+// startCaseServer starts a DNS server on UDP and TCP answering with the
+// question name passed through rewrite, and 192.0.2.1 over UDP or 192.0.2.2
+// over TCP. It returns the address along with a function returning the
+// networks and names of the queries received.
+func startCaseServer(t *testing.T, rewrite func(network, name string) string) (string, func() []string) {
+	var (
+		mu      sync.Mutex
+		queries []string
+	)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		network, ip := "tcp", "192.0.2.2"
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			network, ip = "udp", "192.0.2.1"
+		}
+		mu.Lock()
+		queries = append(queries, network+" "+req.Question[0].Name)
+		mu.Unlock()
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Question[0].Name = rewrite(network, req.Question[0].Name)
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP(ip),
+		})
+		_ = w.WriteMsg(m)
+	})
+	for _, server := range []*dns.Server{{PacketConn: pc, Handler: handler}, {Listener: ln, Handler: handler}} {
+		server := server
+		go func() { _ = server.ActivateAndServe() }()
+		t.Cleanup(func() { _ = server.Shutdown() })
+	}
+	return "udp://" + pc.LocalAddr().String(), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), queries...)
+	}
+}
+
+func TestResolverCaseRandomization(t *testing.T) {
+	const name = "abcdefghijklmnopqrstuvwxyz.example.com."
+
+	tests := []struct {
+		rewrite func(network, name string) string
+		// ips are the answers of the lookups, empty for a CaseMismatchError.
+		ips     []string
+		queries []string
+	}{
+		{
+			func(_, s string) string { return s },
+			[]string{"192.0.2.1", "192.0.2.1", "192.0.2.1", "192.0.2.1"},
+			[]string{"udp random", "udp random", "udp random", "udp random"},
+		},
+		// Case folding is confirmed over TCP, and upstreams confirmed to
+		// fold case get plain names.
+		{
+			func(_, s string) string { return strings.ToLower(s) },
+			[]string{"192.0.2.2", "192.0.2.2", "192.0.2.2", "192.0.2.1"},
+			[]string{"udp random", "tcp random", "udp random", "tcp random", "udp random", "tcp random", "udp plain"},
+		},
+		// Lowercased responses forged over UDP are never accepted.
+		{
+			func(network, s string) string {
+				if network == "udp" {
+					return strings.ToLower(s)
+				}
+				return s
+			},
+			[]string{"192.0.2.2", "192.0.2.2", "192.0.2.2", "192.0.2.2"},
+			[]string{"udp random", "tcp random", "udp random", "tcp random", "udp random", "tcp random", "udp random", "tcp random"},
+		},
+		{
+			func(_, s string) string { return strings.ToUpper(s) },
+			[]string{"", "", "", ""},
+			[]string{"udp random", "udp random", "udp random", "udp random"},
+		},
+	}
+	for i, test := range tests {
+		server, received := startCaseServer(t, test.rewrite)
+		r := NewResolver(WithLogger(nopLogger{}), WithCacheDisabled(true), WithCaseRandomization(true))
+		assert.Nil(t, r.SetDNSServer(server), "test %d", i)
+
+		for _, ip := range test.ips {
+			rsp, err := r.Lookup(name, dns.TypeA)
+			if ip == "" {
+				var mismatch *CaseMismatchError
+				assert.ErrorAs(t, err, &mismatch, "test %d", i)
+				assert.ErrorIs(t, err, ErrCaseMismatch, "test %d", i)
+				continue
+			}
+			if assert.Nil(t, err, "test %d", i) && assert.Len(t, rsp.Answers, 1, "test %d", i) {
+				assert.Equal(t, ip, rsp.Answers[0].Address, "test %d", i)
+			}
+		}
+
+		var queries []string
+		for _, q := range received() {
+			network, qname, _ := strings.Cut(q, " ")
+			if qname == name {
+				queries = append(queries, network+" plain")
+			} else {
+				queries = append(queries, network+" random")
+			}
+		}
+		assert.Equal(t, test.queries, queries, "test %d", i)
+	}
+}
+
+func TestResolverResponseValidation(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		a := &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("192.0.2.1"),
+		}
+		switch req.Question[0].Name {
+		case "servfail.test.":
+			m.Rcode = dns.RcodeServerFailure
+		case "nxdomain.test.":
+			m.Rcode = dns.RcodeNameError
+		case "refused.test.":
+			m.Rcode = dns.RcodeRefused
+		case "question.test.":
+			m.Question[0].Name = "other.test."
+		case "unrelated.test.":
+			a.Hdr.Name = "other.test."
+		case "cname.test.":
+			m.Answer = append(m.Answer, &dns.CNAME{
+				Hdr:    dns.RR_Header{Name: "cname.test.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+				Target: "target.test.",
+			})
+			a.Hdr.Name = "target.test."
+		}
+		if m.Rcode == dns.RcodeSuccess {
+			m.Answer = append(m.Answer, a)
+		}
+		_ = w.WriteMsg(m)
+	})}
+	go func() { _ = server.ActivateAndServe() }()
+	t.Cleanup(func() { _ = server.Shutdown() })
+
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"valid.test", nil},
+		{"cname.test", nil},
+		{"servfail.test", ErrServFail},
+		{"nxdomain.test", ErrNXDomain},
+		{"refused.test", ErrRefused},
+		{"question.test", ErrMismatch},
+		{"unrelated.test", ErrMismatch},
+	}
+	r := NewResolver(WithLogger(nopLogger{}), WithCacheDisabled(true))
+	assert.Nil(t, r.SetDNSServer("udp://"+pc.LocalAddr().String()))
+	for i, test := range tests {
+		_, err := r.Lookup(test.name, dns.TypeA)
+		if test.err == nil {
+			assert.Nil(t, err, "test %d", i)
+		} else {
+			assert.ErrorIs(t, err, test.err, "test %d", i)
+		}
+	}
+}
+
+func TestResolverRebindingProtection(t *testing.T) {
+	tests := []struct {
+		reject bool
+		fqdn   string
+		exp    []string
+		err    error
+	}{
+		{false, "evil.test", []string{"192.0.2.1"}, nil},
+		{true, "evil.test", nil, ErrRebinding},
+		{true, "printer.lan", []string{"192.168.1.9"}, nil},
+	}
+	for i, test := range tests {
+		r := NewResolver(WithLogger(nopLogger{}), WithRebindingProtection(test.reject, []string{"lan"}))
+		// Cached answers are filtered too.
+		r.cache.Set("evil.test.", []string{"127.0.0.1", "192.0.2.1"})
+		r.cache.Set("printer.lan.", []string{"192.168.1.9"})
+
+		ips, err := r.LookupIP(test.fqdn)
+		if test.err != nil {
+			assert.ErrorIs(t, err, test.err, "test %d", i)
+			continue
+		}
+		assert.Nil(t, err, "test %d", i)
+		assert.Equal(t, test.exp, ips, "test %d", i)
+	}
+}
+
+func TestResolverBlocklist(t *testing.T) {
+	tests := []struct {
+		mode BlockMode
+		exp  []string
+		err  error
+	}{
+		{BlockNXDomain, nil, ErrNXDomain},
+		{BlockZeroIP, []string{"0.0.0.0"}, nil},
+		{BlockRefused, nil, ErrRefused},
+	}
+	for i, test := range tests {
+		// No DNS server is set, so blocked lookups never reach an upstream.
+		r := NewResolver(WithLogger(nopLogger{}), WithBlocklist(test.mode, strings.NewReader("||ads.test^\n")))
+
+		ips, err := r.LookupIP("tracker.ads.test")
+		if test.err != nil {
+			assert.ErrorIs(t, err, test.err, "test %d", i)
+		} else {
+			assert.Nil(t, err, "test %d", i)
+			assert.Equal(t, test.exp, ips, "test %d", i)
+		}
+
+		rsp, _ := r.Lookup("tracker.ads.test", dns.TypeAAAA)
+		assert.True(t, rsp.Blocked, "test %d", i)
+
+		_, err = r.LookupIP("example.test")
+		assert.ErrorIs(t, err, ErrNoDNSServer, "test %d", i)
+	}
+}
+
+func TestResolverBlockZeroIPRebinding(t *testing.T) {
+	server := startHandlerServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		ip := "0.0.0.0"
+		if req.Question[0].Name == "tracked.test." {
+			ip = "203.0.113.5"
+		}
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP(ip),
+		})
+		_ = w.WriteMsg(m)
+	})
+	r := NewResolver(WithLogger(nopLogger{}), WithRebindingProtection(true, nil),
+		WithBlocklist(BlockZeroIP, strings.NewReader("203.0.113.0/24\n")))
+	assert.Nil(t, r.SetDNSServer(server))
+
+	// An upstream answering 0.0.0.0 for a name that isn't blocked reaches
+	// the local host.
+	for i := 0; i < 2; i++ {
+		_, err := r.LookupIP("zero.test")
+		assert.ErrorIs(t, err, ErrRebinding, "test %d", i)
+	}
+
+	// Blocked answers get 0.0.0.0 from the blocklist, and aren't cached.
+	for i := 0; i < 2; i++ {
+		ips, err := r.LookupIP("tracked.test")
+		assert.Nil(t, err, "test %d", i)
+		assert.Equal(t, []string{"0.0.0.0"}, ips, "test %d", i)
+		_, ok := r.cachedIPs("tracked.test.")
+		assert.False(t, ok, "test %d", i)
+	}
+}
+
+func TestResolverAnswerFiltering(t *testing.T) {
+	server := startHandlerServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		name := req.Question[0].Name
+		if name == "cloaked.test." {
+			m.Answer = append(m.Answer, &dns.CNAME{
+				Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+				Target: "metrics.tracker.test.",
+			})
+			name = "metrics.tracker.test."
+		}
+		for _, ip := range []string{"203.0.113.5", "192.0.2.1"} {
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP(ip),
+			})
+		}
+		_ = w.WriteMsg(m)
+	})
+
+	tests := []struct {
+		strip bool
+		fqdn  string
+		exp   []string
+		err   error
+	}{
+		{false, "cloaked.test", nil, ErrNXDomain},
+		{true, "cloaked.test", nil, ErrNXDomain},
+		{false, "plain.test", nil, ErrNXDomain},
+		{true, "plain.test", []string{"192.0.2.1"}, nil},
+	}
+	for i, test := range tests {
+		r := NewResolver(WithLogger(nopLogger{}), WithCacheDisabled(true), WithAnswerStripping(test.strip),
+			WithBlocklist(BlockNXDomain, strings.NewReader("||tracker.test^\n203.0.113.0/24\n")))
+		assert.Nil(t, r.SetDNSServer(server), "test %d", i)
+
+		rsp, err := r.Lookup(test.fqdn, dns.TypeA)
+		if test.err != nil {
+			assert.ErrorIs(t, err, test.err, "test %d", i)
+			assert.True(t, rsp.Blocked, "test %d", i)
+			continue
+		}
+		assert.Nil(t, err, "test %d", i)
+		var ips []string
+		for _, a := range rsp.Answers {
+			ips = append(ips, a.Address)
+		}
+		assert.Equal(t, test.exp, ips, "test %d", i)
+	}
+}
+
+func TestResolverRewrites(t *testing.T) {
+	r := NewResolver(WithLogger(nopLogger{}),
+		WithRewrite("*.lan", "192.168.1.1"),
+		WithRewrite("mail.test", "MX 10 mx.test."),
+		WithRewrite("search.test", "safe.test"),
+		WithSafeSearch(false),
+		WithBlocklist(BlockNXDomain, strings.NewReader("||lan^\n")))
+	assert.Nil(t, r.SetDNSServer(startTestServer(t, "192.0.2.1")))
+
+	tests := []struct {
+		fqdn  string
+		qtype uint16
+		exp   []string
+	}{
+		// Rewrites take precedence over the blocklist.
+		{"printer.lan", dns.TypeA, []string{"192.168.1.1"}},
+		{"mail.test", dns.TypeMX, []string{"10 mx.test."}},
+		{"search.test", dns.TypeA, []string{"safe.test.", "192.0.2.1"}},
+		{"www.google.com", dns.TypeA, []string{"forcesafesearch.google.com.", "192.0.2.1"}},
+		{"www.youtube.com", dns.TypeA, []string{"restrictmoderate.youtube.com.", "192.0.2.1"}},
+	}
+	for i, test := range tests {
+		rsp, err := r.Lookup(test.fqdn, test.qtype)
+		if !assert.Nil(t, err, "test %d", i) {
+			continue
+		}
+		var answers []string
+		for _, a := range rsp.Answers {
+			answers = append(answers, a.Address)
+		}
+		assert.Equal(t, test.exp, answers, "test %d", i)
+	}
+
+	ips, err := r.LookupIP("search.test")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"192.0.2.1"}, ips)
+}
+
+func TestResolverClientSubnet(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		queries int
+		subnets []string
+	)
+	server := startHandlerServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("192.0.2.1"),
+		})
+		mu.Lock()
+		queries++
+		subnet := ""
+		if opt := req.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if s, ok := o.(*dns.EDNS0_SUBNET); ok {
+					subnet = fmt.Sprintf("%s/%d", s.Address, s.SourceNetmask)
+					// Scope the answer to the /16.
+					m.SetEdns0(opt.UDPSize(), false)
+					m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_SUBNET{
+						Code: dns.EDNS0SUBNET, Family: s.Family, SourceNetmask: s.SourceNetmask, SourceScope: 16, Address: s.Address,
+					})
+				}
+			}
+		}
+		subnets = append(subnets, subnet)
+		mu.Unlock()
+		_ = w.WriteMsg(m)
+	})
+
+	tests := []struct {
+		options []Option
+		subnet  string
+		key     string
+	}{
+		{nil, "", "example.test."},
+		{[]Option{WithClientSubnet(ClientSubnetOverride, "198.51.100.7")}, "198.51.100.0/24", "example.test./198.51.0.0/16"},
+		{[]Option{WithClientSubnet(ClientSubnetOverride, "203.0.113.0/24", "udp://192.0.2.53:53")}, "", "example.test."},
+		{[]Option{WithClientSubnet(ClientSubnetRemove, "")}, "", "example.test."},
+	}
+	for i, test := range tests {
+		mu.Lock()
+		queries, subnets = 0, nil
+		mu.Unlock()
+
+		r := NewResolver(append([]Option{WithLogger(nopLogger{})}, test.options...)...)
+		assert.Nil(t, r.SetDNSServer(server), "test %d", i)
+		for j := 0; j < 2; j++ {
+			ips, err := r.LookupIP("example.test")
+			assert.Nil(t, err, "test %d", i)
+			assert.Equal(t, []string{"192.0.2.1"}, ips, "test %d", i)
+		}
+
+		mu.Lock()
+		assert.Equal(t, 1, queries, "test %d", i)
+		assert.Equal(t, []string{test.subnet}, subnets, "test %d", i)
+		mu.Unlock()
+		cached, _ := r.cache.Get(test.key)
+		assert.NotNil(t, cached, "test %d", i)
+	}
+}
+
+func TestResolverClientSubnetRoutes(t *testing.T) {
+	route := startTestServer(t, "192.0.2.2")
+	r := NewResolver(
+		WithLogger(nopLogger{}),
+		WithClientSubnet(ClientSubnetOverride, "198.51.100.0/24"),
+		WithClientSubnet(ClientSubnetOverride, "203.0.113.0/24", route),
+	)
+	assert.Nil(t, r.SetDNSServer(startTestServer(t, "192.0.2.1")))
+	assert.Nil(t, r.AddRoute("corp.test", route))
+
+	// Answers scoped to the subnet of the default upstream only serve it.
+	for _, name := range []string{"host.example.test.", "host.corp.test."} {
+		r.cache.Set(name+"/198.51.100.0/24", []string{"192.0.2.3"})
+	}
+	tests := []struct {
+		fqdn string
+		exp  string
+	}{
+		{"host.example.test", "192.0.2.3"},
+		{"host.corp.test", "192.0.2.2"},
+	}
+	for i, test := range tests {
+		ips, err := r.LookupIP(test.fqdn)
+		assert.Nil(t, err, "test %d", i)
+		assert.Equal(t, []string{test.exp}, ips, "test %d", i)
+	}
+}
+
+func TestResolverExchange(t *testing.T) {
+	upstream := startHandlerServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		q := req.Question[0]
+		switch {
+		case q.Name == "missing.example.":
+			m.Rcode = dns.RcodeNameError
+		case q.Qtype == dns.TypeMX:
+			m.Answer = append(m.Answer, &dns.MX{
+				Hdr:        dns.RR_Header{Name: q.Name, Rrtype: dns.TypeMX, Class: dns.ClassINET, Ttl: 60},
+				Preference: 10,
+				Mx:         "mail.example.",
+			})
+		}
+		_ = w.WriteMsg(m)
+	})
+	r := NewResolver(WithLogger(nopLogger{}), WithHost("host.example", []string{"192.0.2.1", "2001:db8::1"}))
+	assert.Nil(t, r.SetDNSServer(upstream))
+
+	tests := []struct {
+		name   string
+		qtype  uint16
+		opcode int
+		rcode  int
+		answer string
+	}{
+		{"host.example.", dns.TypeA, dns.OpcodeQuery, dns.RcodeSuccess, "192.0.2.1"},
+		{"host.example.", dns.TypeAAAA, dns.OpcodeQuery, dns.RcodeSuccess, "2001:db8::1"},
+		{"host.example.", dns.TypeMX, dns.OpcodeQuery, dns.RcodeSuccess, ""},
+		{"example.", dns.TypeMX, dns.OpcodeQuery, dns.RcodeSuccess, "mail.example."},
+		{"missing.example.", dns.TypeA, dns.OpcodeQuery, dns.RcodeNameError, ""},
+		{"example.", dns.TypeA, dns.OpcodeStatus, dns.RcodeNotImplemented, ""},
+	}
+	for i, test := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(test.name, test.qtype)
+		req.Opcode = test.opcode
+		resp, _ := r.Exchange(req)
+		assert.Equal(t, req.Id, resp.Id, "test %d", i)
+		assert.True(t, resp.Response, "test %d", i)
+		assert.Equal(t, test.rcode, resp.Rcode, "test %d", i)
+		if test.answer == "" {
+			assert.Empty(t, resp.Answer, "test %d", i)
+			continue
+		}
+		if assert.Len(t, resp.Answer, 1, "test %d", i) {
+			fields := strings.Fields(resp.Answer[0].String())
+			assert.Equal(t, test.answer, fields[len(fields)-1], "test %d", i)
+		}
+	}
+}
+
+func TestResolverDNSServersFromList(t *testing.T) {
+	entries := []ResolverListEntry{
+		{Name: "relay", Protocol: "dnscrypt-relay", Address: "192.0.2.1:443", NoLog: true},
+		{Name: "logging", Protocol: "plain", Address: startTestServer(t, "192.0.2.2")},
+		{Name: "nolog", Protocol: "plain", Address: startTestServer(t, "192.0.2.3"), NoLog: true},
+	}
+	tests := []struct {
+		criteria ResolverCriteria
+		ips      []string
+		err      bool
+	}{
+		{ResolverCriteria{}, []string{"192.0.2.2"}, false},
+		{ResolverCriteria{NoLog: true}, []string{"192.0.2.3"}, false},
+		{ResolverCriteria{Protocols: []string{"dnscrypt-relay"}}, nil, true},
+		{ResolverCriteria{DNSSEC: true}, nil, true},
+	}
+	for i, test := range tests {
+		r := NewResolver(WithLogger(nopLogger{}), WithCacheDisabled(true))
+		err := r.SetDNSServersFromList(entries, test.criteria)
+		assert.Equal(t, test.err, err != nil, "test %d", i)
+		if err != nil {
+			continue
+		}
+		ips, err := r.LookupIP("example.com")
+		assert.Nil(t, err, "test %d", i)
+		assert.Equal(t, test.ips, ips, "test %d", i)
+	}
+
+	// The hosts of DoH and DoT servers are bootstrapped to their stamp
+	// address.
+	r := NewResolver(WithLogger(nopLogger{}))
+	assert.Nil(t, r.SetDNSServersFromList([]ResolverListEntry{
+		{Name: "doh", Protocol: "doh", Address: "https://doh.test/dns-query", ServerIP: "192.0.2.4", Hashes: [][]byte{{1}}},
+		{Name: "dot", Protocol: "dot", Address: "tls://dot.test:853", ServerIP: "192.0.2.5"},
+	}, ResolverCriteria{}))
+	for host, ip := range map[string]string{"doh.test": "192.0.2.4", "dot.test": "192.0.2.5"} {
+		ips, err := r.options.Bootstrap.Resolve(context.Background(), host)
+		if assert.Nil(t, err, host) && assert.Len(t, ips, 1, host) {
+			assert.Equal(t, ip, ips[0].String(), host)
+		}
+	}
+}
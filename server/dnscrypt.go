@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/bepass-org/dnsutils/internal/dnscrypt"
+	"github.com/miekg/dns"
+)
+
+// DNSCryptConfig is the provider configuration of a DNSCrypt server: its
+// name, long-term signing key and short-term resolver key. Its CreateStamp
+// method returns the stamp clients connect with.
+type DNSCryptConfig = dnscrypt.ResolverConfig
+
+// GenerateDNSCryptConfig generates the configuration of providerName with
+// random keys. privateKey is the long-term key, generated if nil.
+func GenerateDNSCryptConfig(providerName string, privateKey ed25519.PrivateKey) (DNSCryptConfig, error) {
+	return dnscrypt.GenerateResolverConfig(providerName, privateKey)
+}
+
+// WithDNSCryptRotation makes DNSCrypt servers sign a certificate with a new
+// short-term key every interval, valid for interval plus overlap, instead
+// of using the short-term key of the configuration for the certificate
+// lifetime.
+func WithDNSCryptRotation(interval, overlap time.Duration) Option {
+	return func(s *Server) {
+		s.certRotation = interval
+		s.certOverlap = overlap
+	}
+}
+
+// ListenAndServeDNSCrypt listens on addr over UDP and TCP, and serves
+// DNSCrypt queries until Shutdown.
+func (s *Server) ListenAndServeDNSCrypt(addr string, config DNSCryptConfig) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	return s.ServeDNSCrypt(pc, l, config)
+}
+
+// ServeDNSCrypt serves DNSCrypt queries on pc and l until Shutdown. Either
+// may be nil. The certificate is signed with the long-term key of config
+// and served to clients over plain DNS.
+func (s *Server) ServeDNSCrypt(pc net.PacketConn, l net.Listener, config DNSCryptConfig) error {
+	closeAll := func() {
+		if pc != nil {
+			pc.Close()
+		}
+		if l != nil {
+			l.Close()
+		}
+	}
+	ds := &dnscrypt.Server{
+		ProviderName: config.ProviderName,
+		Handler:      exchanger{s},
+		Timeout:      s.timeout,
+		IdleTimeout:  s.idleTimeout,
+	}
+	if s.certRotation > 0 {
+		config.CertificateTTL = s.certRotation + s.certOverlap
+	}
+	cert, err := config.CreateCert()
+	if err != nil {
+		closeAll()
+		return err
+	}
+	ds.AddCert(cert)
+	if s.certRotation > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			err := ds.RotateCerts(ctx, config, s.certRotation, s.certOverlap)
+			if !errors.Is(err, context.Canceled) {
+				s.logger.Error("rotating dnscrypt certificates: %v", err)
+			}
+		}()
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		closeAll()
+		return ErrServerClosed
+	}
+	s.servers = append(s.servers, ds)
+	s.mu.Unlock()
+
+	var serves []func() error
+	if pc != nil {
+		serves = append(serves, func() error { return ds.ServeUDP(pc) })
+	}
+	if l != nil {
+		serves = append(serves, func() error { return ds.ServeTCP(l) })
+	}
+	errs := make(chan error, len(serves))
+	for _, serve := range serves {
+		serve := serve
+		go func() { errs <- serve() }()
+	}
+	var first error
+	for range serves {
+		err := <-errs
+		if errors.Is(err, dnscrypt.ErrServerClosed) {
+			err = ErrServerClosed
+		}
+		if first == nil {
+			first = err
+			// Both listeners stop when either fails.
+			closeAll()
+		}
+	}
+	return first
+}
+
+// exchanger answers the queries decrypted by a DNSCrypt server through the
+// server.
+type exchanger struct {
+	s *Server
+}
+
+func (e exchanger) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	return e.s.exchange(req), nil
+}
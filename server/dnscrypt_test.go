@@ -0,0 +1,45 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/dnsutils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerDNSCrypt(t *testing.T) {
+	config, err := GenerateDNSCryptConfig("example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := dnsutils.NewResolver(dnsutils.WithLogger(nopLogger{}), dnsutils.WithHost("host.example.", []string{"192.0.2.1"}))
+	s := New(r, WithLogger(nopLogger{}), WithDNSCryptRotation(time.Hour, time.Hour))
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.ServeDNSCrypt(pc, l, config) }()
+
+	stamp, err := config.CreateStamp(pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := dnsutils.NewResolver(dnsutils.WithLogger(nopLogger{}), dnsutils.WithCacheDisabled(true))
+	if assert.Nil(t, client.SetDNSServer(stamp.String())) {
+		ips, err := client.LookupIP("host.example")
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"192.0.2.1"}, ips)
+	}
+
+	assert.Nil(t, s.Shutdown(context.Background()))
+	assert.ErrorIs(t, <-done, ErrServerClosed)
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/bepass-org/dnsutils/internal/resolvers"
+	"github.com/miekg/dns"
+)
+
+// dohContentType is the media type of DNS messages in RFC 8484.
+const dohContentType = "application/dns-message"
+
+// ServeHTTP answers DNS-over-HTTPS queries as specified by RFC 8484, sent
+// either by POST or by GET with the base64url encoded query in the dns
+// parameter. The server may be mounted on any path of an HTTP server, by
+// convention /dns-query.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		buf []byte
+		err error
+	)
+	switch r.Method {
+	case http.MethodGet:
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			http.Error(w, "missing dns parameter", http.StatusBadRequest)
+			return
+		}
+		// Padding is not allowed, but some clients send it anyway.
+		buf, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(param, "="))
+	case http.MethodPost:
+		if ct := r.Header.Get("Content-Type"); ct != dohContentType {
+			http.Error(w, fmt.Sprintf("unsupported content type %q", ct), http.StatusUnsupportedMediaType)
+			return
+		}
+		buf, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize+1))
+		if err == nil && len(buf) > dns.MaxMsgSize {
+			http.Error(w, "query too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, "invalid query encoding", http.StatusBadRequest)
+		return
+	}
+
+	req := new(dns.Msg)
+	if err := req.Unpack(buf); err != nil {
+		http.Error(w, "invalid dns query", http.StatusBadRequest)
+		return
+	}
+	resp := s.exchange(req)
+	// The connection is encrypted, unless terminated by a proxy in front.
+	resolvers.PadResponse(req, resp)
+	out, err := resp.Pack()
+	if err != nil {
+		s.logger.Debug("packing response for %s: %v", questionName(req), err)
+		http.Error(w, "invalid dns response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", dohContentType)
+	if ttl, ok := cacheTTL(resp); ok {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	if _, err := w.Write(out); err != nil {
+		s.logger.Debug("writing response to %s: %v", r.RemoteAddr, err)
+	}
+}
+
+// cacheTTL returns how long HTTP caches may keep resp: the lowest TTL of
+// its records. Failures and responses without records aren't cached.
+func cacheTTL(resp *dns.Msg) (uint32, bool) {
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return 0, false
+	}
+	ttl, found := uint32(math.MaxUint32), false
+	for i, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if hdr.Ttl < ttl {
+				ttl = hdr.Ttl
+			}
+			// Negative answers are cached for the SOA minimum, per RFC 2308.
+			if soa, ok := rr.(*dns.SOA); ok && i == 1 && soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			found = true
+		}
+	}
+	return ttl, found
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// ttlExchanger answers A queries with two records of different TTLs and
+// fails other queries.
+type ttlExchanger struct{}
+
+func (ttlExchanger) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	q := req.Question[0]
+	if q.Qtype != dns.TypeA {
+		resp.Rcode = dns.RcodeServerFailure
+		return resp, nil
+	}
+	for i, ttl := range []uint32{300, 120} {
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   []byte{192, 0, 2, byte(i + 1)},
+		})
+	}
+	return resp, nil
+}
+
+func TestServerDoH(t *testing.T) {
+	ts := httptest.NewServer(New(ttlExchanger{}, WithLogger(nopLogger{})))
+	defer ts.Close()
+
+	query := func(qtype uint16) []byte {
+		req := new(dns.Msg)
+		req.SetQuestion("example.", qtype)
+		req.Id = 0
+		buf, _ := req.Pack()
+		return buf
+	}
+	get := func(param string) (*http.Response, error) {
+		return http.Get(ts.URL + "/dns-query?dns=" + param)
+	}
+	post := func(contentType string, body []byte) (*http.Response, error) {
+		return http.Post(ts.URL+"/dns-query", contentType, bytes.NewReader(body))
+	}
+
+	tests := []struct {
+		do           func() (*http.Response, error)
+		status       int
+		cacheControl string
+		answers      int
+	}{
+		{func() (*http.Response, error) { return get(base64.RawURLEncoding.EncodeToString(query(dns.TypeA))) }, http.StatusOK, "max-age=120", 2},
+		{func() (*http.Response, error) { return get(base64.URLEncoding.EncodeToString(query(dns.TypeA))) }, http.StatusOK, "max-age=120", 2},
+		{func() (*http.Response, error) { return post(dohContentType, query(dns.TypeA)) }, http.StatusOK, "max-age=120", 2},
+		{func() (*http.Response, error) { return post(dohContentType, query(dns.TypeAAAA)) }, http.StatusOK, "no-cache", 0},
+		{func() (*http.Response, error) { return post("text/plain", query(dns.TypeA)) }, http.StatusUnsupportedMediaType, "", 0},
+		{func() (*http.Response, error) { return post(dohContentType, []byte{1, 2, 3}) }, http.StatusBadRequest, "", 0},
+		{func() (*http.Response, error) { return get("!!!") }, http.StatusBadRequest, "", 0},
+		{func() (*http.Response, error) { return get("") }, http.StatusBadRequest, "", 0},
+		{func() (*http.Response, error) {
+			req, _ := http.NewRequest(http.MethodPut, ts.URL+"/dns-query", bytes.NewReader(query(dns.TypeA)))
+			return http.DefaultClient.Do(req)
+		}, http.StatusMethodNotAllowed, "", 0},
+	}
+	for i, test := range tests {
+		rsp, err := test.do()
+		if !assert.Nil(t, err, "test %d", i) {
+			continue
+		}
+		body, _ := io.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		assert.Equal(t, test.status, rsp.StatusCode, "test %d", i)
+		if test.status != http.StatusOK {
+			continue
+		}
+		assert.Equal(t, dohContentType, rsp.Header.Get("Content-Type"), "test %d", i)
+		assert.Equal(t, test.cacheControl, rsp.Header.Get("Cache-Control"), "test %d", i)
+		msg := new(dns.Msg)
+		if assert.Nil(t, msg.Unpack(body), "test %d", i) {
+			assert.Equal(t, uint16(0), msg.Id, "test %d", i)
+			assert.Len(t, msg.Answer, test.answers, "test %d", i)
+		}
+	}
+}
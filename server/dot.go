@@ -0,0 +1,260 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bepass-org/dnsutils/internal/resolvers"
+	"github.com/miekg/dns"
+)
+
+// maxPipelinedQueries is the number of queries of a DNS-over-TLS connection
+// answered at once. Reading stops while it is reached.
+const maxPipelinedQueries = 64
+
+// WithTLSConfig sets the TLS configuration of DNS-over-TLS listeners, such
+// as one holding the certificates.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(s *Server) {
+		s.tlsConfig = config
+	}
+}
+
+// WithClientCAs requires DNS-over-TLS clients to present a certificate
+// signed by one of cas.
+func WithClientCAs(cas *x509.CertPool) Option {
+	return func(s *Server) {
+		s.clientCAs = cas
+	}
+}
+
+// WithIdleTimeout sets how long DNS-over-TLS connections are kept open
+// without queries.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.idleTimeout = timeout
+	}
+}
+
+// ListenAndServeTLS listens on addr, such as :853, and serves
+// DNS-over-TLS queries until Shutdown. certFile and keyFile hold the
+// certificate of the server, unless it is set by WithTLSConfig.
+func (s *Server) ListenAndServeTLS(addr, certFile, keyFile string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.ServeTLS(l, certFile, keyFile)
+}
+
+// ServeTLS serves DNS-over-TLS queries on l until Shutdown. Queries
+// pipelined on a connection are answered concurrently, in the order the
+// answers come.
+func (s *Server) ServeTLS(l net.Listener, certFile, keyFile string) error {
+	config, err := s.serverTLSConfig(certFile, keyFile)
+	if err != nil {
+		l.Close()
+		return err
+	}
+	tl := &tlsListener{s: s, l: tls.NewListener(l, config), conns: map[net.Conn]struct{}{}}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.servers = append(s.servers, tl)
+	s.mu.Unlock()
+	return tl.serve()
+}
+
+// serverTLSConfig returns the TLS configuration of DNS-over-TLS listeners.
+func (s *Server) serverTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if s.tlsConfig != nil {
+		config = s.tlsConfig.Clone()
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+	if len(config.Certificates) == 0 && config.GetCertificate == nil && config.GetConfigForClient == nil {
+		return nil, errors.New("dns-over-tls server without certificate")
+	}
+	if s.clientCAs != nil {
+		config.ClientCAs = s.clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"dot"}
+	}
+	return config, nil
+}
+
+// tlsListener serves the DNS-over-TLS connections of a listener.
+type tlsListener struct {
+	s       *Server
+	l       net.Listener
+	closing atomic.Bool
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+func (tl *tlsListener) serve() error {
+	for {
+		conn, err := tl.l.Accept()
+		if err != nil {
+			if tl.closing.Load() {
+				return ErrServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		tl.mu.Lock()
+		if tl.closing.Load() {
+			tl.mu.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		tl.conns[conn] = struct{}{}
+		tl.wg.Add(1)
+		tl.mu.Unlock()
+		go tl.serveConn(conn)
+	}
+}
+
+// serveConn answers the queries of conn until it is idle, closed by the
+// client, or the listener shuts down.
+func (tl *tlsListener) serveConn(conn net.Conn) {
+	var (
+		s       = tl.s
+		r       = bufio.NewReader(conn)
+		writeMu sync.Mutex
+		queries sync.WaitGroup
+		pending = make(chan struct{}, maxPipelinedQueries)
+		timeout = s.timeout
+	)
+	defer func() {
+		queries.Wait()
+		conn.Close()
+		tl.mu.Lock()
+		delete(tl.conns, conn)
+		tl.mu.Unlock()
+		tl.wg.Done()
+	}()
+
+	for {
+		// The first read, including the handshake, uses the timeout, the
+		// rest the idle timeout. Shutdown sets the deadline to now after
+		// setting closing, so one of them stops the loop.
+		_ = conn.SetReadDeadline(time.Now().Add(timeout))
+		if tl.closing.Load() {
+			return
+		}
+		buf, err := readMsg(r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) && !errors.Is(err, os.ErrDeadlineExceeded) {
+				s.logger.Debug("reading query from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		timeout = s.idleTimeout
+
+		req := new(dns.Msg)
+		if err := req.Unpack(buf); err != nil {
+			s.logger.Debug("invalid query from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+		pending <- struct{}{}
+		queries.Add(1)
+		go func() {
+			defer func() {
+				<-pending
+				queries.Done()
+			}()
+			resp := s.exchange(req)
+			resolvers.PadResponse(req, resp)
+			out, err := resp.Pack()
+			if err != nil {
+				s.logger.Debug("packing response for %s: %v", questionName(req), err)
+				return
+			}
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			_ = conn.SetWriteDeadline(time.Now().Add(s.timeout))
+			if err := writeMsg(conn, out); err != nil {
+				s.logger.Debug("writing response to %s: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// ShutdownContext stops accepting connections and reading queries, and
+// waits for the answers to the queries read, or ctx to be done.
+func (tl *tlsListener) ShutdownContext(ctx context.Context) error {
+	tl.mu.Lock()
+	tl.closing.Store(true)
+	tl.l.Close()
+	for conn := range tl.conns {
+		_ = conn.SetReadDeadline(time.Now())
+	}
+	tl.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		tl.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		tl.mu.Lock()
+		for conn := range tl.conns {
+			conn.Close()
+		}
+		tl.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// readMsg reads a message with the two-octet length prefix of DNS over TCP.
+func readMsg(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// writeMsg writes msg with the two-octet length prefix of DNS over TCP.
+func writeMsg(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
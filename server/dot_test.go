@@ -0,0 +1,165 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestCert returns a certificate for 127.0.0.1 signed by parent, or
+// self-signed if parent is nil.
+func newTestCert(t *testing.T, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "dnsutils test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	issuer, signer := template, interface{}(key)
+	if parent != nil {
+		issuer, signer = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// slowExchanger answers queries for slow. after a delay.
+type slowExchanger struct{}
+
+func (slowExchanger) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	if req.Question[0].Name == "slow." {
+		time.Sleep(200 * time.Millisecond)
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	return resp, nil
+}
+
+// startTLSServer starts s on a local port and returns its address.
+func startTLSServer(t *testing.T, s *Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = s.ServeTLS(l, "", "") }()
+	t.Cleanup(func() { _ = s.Shutdown(context.Background()) })
+	return l.Addr().String()
+}
+
+// dialTLS connects to the DNS-over-TLS server at addr. dns.Client only
+// speaks TLS through a TLSDialer.
+func dialTLS(addr string, config *tls.Config) (*dns.Conn, error) {
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return &dns.Conn{Conn: conn}, nil
+}
+
+func TestServerTLSPipelining(t *testing.T) {
+	ca := newTestCert(t, nil)
+	s := New(slowExchanger{}, WithLogger(nopLogger{}), WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{ca}}))
+	addr := startTLSServer(t, s)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	conn, err := dialTLS(addr, &tls.Config{RootCAs: pool})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	for i, name := range []string{"slow.", "fast."} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		req.Id = uint16(i + 1)
+		assert.Nil(t, conn.WriteMsg(req), "test %d", i)
+	}
+	// The fast answer doesn't wait for the slow one.
+	for i, name := range []string{"fast.", "slow."} {
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		resp, err := conn.ReadMsg()
+		if assert.Nil(t, err, "test %d", i) {
+			assert.Equal(t, name, resp.Question[0].Name, "test %d", i)
+		}
+	}
+}
+
+func TestServerTLSIdleTimeout(t *testing.T) {
+	ca := newTestCert(t, nil)
+	s := New(slowExchanger{}, WithLogger(nopLogger{}), WithIdleTimeout(100*time.Millisecond),
+		WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{ca}}))
+	addr := startTLSServer(t, s)
+
+	conn, err := dialTLS(addr, &tls.Config{InsecureSkipVerify: true})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+	req := new(dns.Msg)
+	req.SetQuestion("fast.", dns.TypeA)
+	assert.Nil(t, conn.WriteMsg(req))
+	_, err = conn.ReadMsg()
+	assert.Nil(t, err)
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.ReadMsg()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestServerTLSClientCertificates(t *testing.T) {
+	ca := newTestCert(t, nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	s := New(slowExchanger{}, WithLogger(nopLogger{}), WithClientCAs(pool),
+		WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{newTestCert(t, &ca)}}))
+	addr := startTLSServer(t, s)
+
+	tests := []struct {
+		certs []tls.Certificate
+		ok    bool
+	}{
+		{nil, false},
+		{[]tls.Certificate{newTestCert(t, nil)}, false},
+		{[]tls.Certificate{newTestCert(t, &ca)}, true},
+	}
+	for i, test := range tests {
+		conn, err := dialTLS(addr, &tls.Config{RootCAs: pool, Certificates: test.certs})
+		if err == nil {
+			req := new(dns.Msg)
+			req.SetQuestion("fast.", dns.TypeA)
+			_ = conn.SetDeadline(time.Now().Add(time.Second))
+			// TLS 1.3 clients learn about rejected certificates on reading.
+			if err = conn.WriteMsg(req); err == nil {
+				_, err = conn.ReadMsg()
+			}
+			conn.Close()
+		}
+		assert.Equal(t, test.ok, err == nil, "test %d: %v", i, err)
+	}
+}
@@ -0,0 +1,233 @@
+// Package server answers DNS queries from clients, such as the operating
+// system pointed at a local address, through a resolver.
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/dnsutils/internal/statute"
+	"github.com/miekg/dns"
+)
+
+// ErrServerClosed is returned by the Serve methods after Shutdown.
+var ErrServerClosed = errors.New("dns server closed")
+
+// Exchanger answers DNS queries. *dnsutils.Resolver implements it.
+type Exchanger interface {
+	// Exchange returns the response to req. It must return a response
+	// matching req, with its rcode reporting failures, even along with an
+	// error.
+	Exchange(req *dns.Msg) (*dns.Msg, error)
+}
+
+// Server is a DNS server listening on UDP and TCP, and on TLS with
+// ServeTLS. It is also an http.Handler answering DNS-over-HTTPS queries.
+type Server struct {
+	resolver    Exchanger
+	logger      statute.Logger
+	timeout     time.Duration
+	idleTimeout time.Duration
+	tlsConfig   *tls.Config
+	clientCAs   *x509.CertPool
+
+	certRotation time.Duration
+	certOverlap  time.Duration
+
+	mu      sync.Mutex
+	closed  bool
+	servers []shutdowner
+	started sync.WaitGroup
+}
+
+// shutdowner is a running listener of the server.
+type shutdowner interface {
+	ShutdownContext(ctx context.Context) error
+}
+
+// Option configures a Server.
+type Option func(*Server)
+
+// New creates a server answering queries through resolver.
+func New(resolver Exchanger, options ...Option) *Server {
+	s := &Server{
+		resolver:    resolver,
+		logger:      statute.DefaultLogger{},
+		timeout:     10 * time.Second,
+		idleTimeout: 30 * time.Second,
+	}
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
+
+// WithLogger sets the logger of query failures.
+func WithLogger(logger statute.Logger) Option {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
+
+// WithTimeout sets the read and write timeout of connections.
+func WithTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.timeout = timeout
+	}
+}
+
+// ListenAndServe listens on addr, such as 127.0.0.1:53, over UDP and TCP
+// and serves queries until Shutdown.
+func (s *Server) ListenAndServe(addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	// With port 0, TCP takes the port picked for UDP.
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	return s.Serve(pc, l)
+}
+
+// Serve serves queries on pc and l until Shutdown. Either may be nil.
+func (s *Server) Serve(pc net.PacketConn, l net.Listener) error {
+	var servers []*dns.Server
+	if pc != nil {
+		servers = append(servers, &dns.Server{PacketConn: pc, Net: "udp"})
+	}
+	if l != nil {
+		servers = append(servers, &dns.Server{Listener: l, Net: "tcp"})
+	}
+	return s.serve(servers...)
+}
+
+// serve runs servers until they all stop, and returns the first error.
+func (s *Server) serve(servers ...*dns.Server) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		for _, srv := range servers {
+			closeServer(srv)
+		}
+		return ErrServerClosed
+	}
+	for _, srv := range servers {
+		s.servers = append(s.servers, srv)
+	}
+	s.started.Add(len(servers))
+	s.mu.Unlock()
+
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		srv := srv
+		var once sync.Once
+		srv.Handler = s
+		srv.ReadTimeout = s.timeout
+		srv.WriteTimeout = s.timeout
+		srv.NotifyStartedFunc = func() { once.Do(s.started.Done) }
+		go func() {
+			err := srv.ActivateAndServe()
+			// Servers failing to start never notify.
+			once.Do(s.started.Done)
+			errs <- err
+		}()
+	}
+
+	var first error
+	for range servers {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+			s.Shutdown(context.Background())
+		}
+	}
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+	if closed && (first == nil || errors.Is(first, net.ErrClosed)) {
+		return ErrServerClosed
+	}
+	return first
+}
+
+// Shutdown stops the listeners and waits for the queries in progress to be
+// answered, or ctx to be done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	servers := s.servers
+	s.mu.Unlock()
+
+	// Servers can't be shut down before they have started.
+	s.started.Wait()
+	var first error
+	for _, srv := range servers {
+		if err := srv.ShutdownContext(ctx); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// closeServer closes the listeners of a server that was never started.
+func closeServer(srv *dns.Server) {
+	if srv.PacketConn != nil {
+		srv.PacketConn.Close()
+	}
+	if srv.Listener != nil {
+		srv.Listener.Close()
+	}
+}
+
+// ServeDNS answers a query received by a listener.
+func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	resp := s.exchange(req)
+	if _, ok := w.LocalAddr().(*net.UDPAddr); ok {
+		// The client retries over TCP when the response is truncated.
+		resp.Truncate(udpSize(req))
+	}
+	if err := w.WriteMsg(resp); err != nil {
+		s.logger.Debug("writing response to %s: %v", w.RemoteAddr(), err)
+	}
+}
+
+// exchange answers req through the resolver.
+func (s *Server) exchange(req *dns.Msg) *dns.Msg {
+	resp, err := s.resolver.Exchange(req)
+	if err != nil {
+		s.logger.Debug("answering %s: %v", questionName(req), err)
+	}
+	if resp == nil {
+		resp = new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeServerFailure)
+	}
+	resp.Id = req.Id
+	return resp
+}
+
+// udpSize returns the largest response the client of req accepts over UDP.
+func udpSize(req *dns.Msg) int {
+	size := dns.MinMsgSize
+	if opt := req.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	return size
+}
+
+func questionName(req *dns.Msg) string {
+	if len(req.Question) == 0 {
+		return "query without question"
+	}
+	return req.Question[0].Name
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/dnsutils"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// nopLogger discards all log messages.
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+// bigExchanger answers every query with n A records.
+type bigExchanger int
+
+func (n bigExchanger) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	for i := 0; i < int(n); i++ {
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(192, 0, 2, byte(i)),
+		})
+	}
+	return resp, nil
+}
+
+// startServer starts s on a local port and returns its address and the
+// result of ListenAndServe.
+func startServer(t *testing.T, s *Server) (string, <-chan error) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(pc, l) }()
+	t.Cleanup(func() { _ = s.Shutdown(context.Background()) })
+	return pc.LocalAddr().String(), done
+}
+
+func TestServerResolver(t *testing.T) {
+	r := dnsutils.NewResolver(dnsutils.WithLogger(nopLogger{}), dnsutils.WithHost("host.example", []string{"192.0.2.1"}))
+	addr, _ := startServer(t, New(r, WithLogger(nopLogger{})))
+
+	for i, net := range []string{"udp", "tcp"} {
+		req := new(dns.Msg)
+		req.SetQuestion("host.example.", dns.TypeA)
+		resp, _, err := (&dns.Client{Net: net}).Exchange(req, addr)
+		if !assert.Nil(t, err, "test %d", i) {
+			continue
+		}
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode, "test %d", i)
+		if assert.Len(t, resp.Answer, 1, "test %d", i) {
+			assert.Equal(t, "192.0.2.1", resp.Answer[0].(*dns.A).A.String(), "test %d", i)
+		}
+	}
+}
+
+func TestServerTruncation(t *testing.T) {
+	addr, _ := startServer(t, New(bigExchanger(100), WithLogger(nopLogger{})))
+
+	tests := []struct {
+		net       string
+		udpSize   uint16
+		truncated bool
+	}{
+		{"udp", 0, true},
+		{"udp", 4096, false},
+		{"tcp", 0, false},
+	}
+	for i, test := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion("example.", dns.TypeA)
+		if test.udpSize > 0 {
+			req.SetEdns0(test.udpSize, false)
+		}
+		resp, _, err := (&dns.Client{Net: test.net, UDPSize: 4096}).Exchange(req, addr)
+		if !assert.Nil(t, err, "test %d", i) {
+			continue
+		}
+		assert.Equal(t, test.truncated, resp.Truncated, "test %d", i)
+		if test.truncated {
+			assert.Less(t, len(resp.Answer), 100, "test %d", i)
+		} else {
+			assert.Len(t, resp.Answer, 100, "test %d", i)
+		}
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	s := New(bigExchanger(1), WithLogger(nopLogger{}))
+	addr, done := startServer(t, s)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.", dns.TypeA)
+	_, _, err := new(dns.Client).Exchange(req, addr)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, s.Shutdown(ctx))
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, ErrServerClosed)
+	case <-time.After(time.Second):
+		t.Fatal("server still running")
+	}
+	assert.ErrorIs(t, s.ListenAndServe("127.0.0.1:0"), ErrServerClosed)
+
+	_, _, err = (&dns.Client{Net: "tcp", Timeout: 100 * time.Millisecond}).Exchange(req, addr)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,82 @@
+package dnsutils
+
+import (
+	"errors"
+	"net/url"
+
+	"github.com/bepass-org/dnsutils/internal/sources"
+)
+
+// ResolverListEntry is a server stamp of a resolver list, with the metadata
+// of the server. Its Protocol is "plain", "dnscrypt", "doh", "dot", "doq" or
+// "dnscrypt-relay".
+type ResolverListEntry = sources.Entry
+
+// ResolverCriteria select the entries of a resolver list.
+type ResolverCriteria = sources.Criteria
+
+// LoadResolverList reads a DNSCrypt-proxy style resolver list, such as
+// public-resolvers.md, after verifying its minisign signature in sigFile
+// against publicKey, in base64 or as the contents of a .pub file.
+func LoadResolverList(listFile, sigFile, publicKey string) ([]ResolverListEntry, error) {
+	key, err := sources.ParsePublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return sources.Load(listFile, sigFile, key)
+}
+
+// SetDNSServersFromList sets the servers of entries meeting criteria as the
+// upstreams, tried in order. Relays and servers of unsupported protocols are
+// left out. The hosts of DoH and DoT servers are bootstrapped to the address
+// given by their stamp, and their certificates pinned to its hashes.
+func (r *Resolver) SetDNSServersFromList(entries []ResolverListEntry, criteria ResolverCriteria) error {
+	var (
+		addresses []string
+		pinned    []ResolverListEntry
+	)
+	for _, entry := range sources.Select(entries, criteria) {
+		if entry.Address == "" || entry.Protocol == sources.ProtoDNSCryptRelay {
+			continue
+		}
+		addresses = append(addresses, entry.Address)
+		if entry.ServerIP != "" || len(entry.Hashes) > 0 {
+			pinned = append(pinned, entry)
+		}
+	}
+	if len(addresses) == 0 {
+		return errors.New("no listed server meets the criteria")
+	}
+	if len(pinned) > 0 {
+		if err := r.pinServers(pinned); err != nil {
+			return err
+		}
+	}
+	return r.SetDNSServers(addresses...)
+}
+
+// pinServers registers the stamp addresses and hashes of entries with the
+// bootstrap.
+func (r *Resolver) pinServers(entries []ResolverListEntry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b := r.bootstrap()
+	for _, entry := range entries {
+		u, err := url.Parse(entry.Address)
+		if err != nil {
+			return err
+		}
+		host := u.Hostname()
+		if entry.ServerIP != "" {
+			if err = b.AddHost(host, []string{entry.ServerIP}); err != nil {
+				return err
+			}
+		}
+		if len(entry.Hashes) > 0 {
+			b.AddPins(host, entry.Hashes)
+		}
+	}
+	r.applyDialers()
+	return nil
+}
@@ -0,0 +1,64 @@
+package dnsutils
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/bepass-org/dnsutils/internal/resolvers"
+	"github.com/miekg/dns"
+)
+
+// Prefix lengths client addresses are cut to, as recommended by RFC 7871.
+const (
+	clientSubnetIPv4Prefix = 24
+	clientSubnetIPv6Prefix = 56
+)
+
+// parseClientSubnet parses a CIDR range, or an address which is cut to the
+// recommended prefix length.
+func parseClientSubnet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		return n, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid client subnet %q", s)
+	}
+	mask := net.CIDRMask(clientSubnetIPv6Prefix, 8*net.IPv6len)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, mask = ip4, net.CIDRMask(clientSubnetIPv4Prefix, 8*net.IPv4len)
+	}
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
+}
+
+// cacheKey returns the key answers for fqdn from msg are cached under,
+// which includes the network they are valid for when upstreams scoped them
+// to the client subnet.
+func cacheKey(fqdn string, msg *dns.Msg) string {
+	if scope, ok := resolvers.ClientSubnetScope(msg); ok {
+		return fqdn + "/" + scope.String()
+	}
+	return fqdn
+}
+
+// cachedIPs looks the answer for fqdn up in the cache, preferring answers
+// scoped to the subnet sent to the upstream responsible for fqdn, from the
+// most specific scope down, over the ones valid for all clients.
+func (r *Resolver) cachedIPs(fqdn string) ([]string, bool) {
+	if policy := r.upstreams.Load().subnetFor(fqdn); policy != nil && policy.Subnet != nil {
+		ones, bits := policy.Subnet.Mask.Size()
+		for prefix := ones; prefix > 0; prefix-- {
+			mask := net.CIDRMask(prefix, bits)
+			scope := &net.IPNet{IP: policy.Subnet.IP.Mask(mask), Mask: mask}
+			if v, _ := r.cache.Get(fqdn + "/" + scope.String()); v != nil {
+				return v.([]string), true
+			}
+		}
+	}
+	if v, _ := r.cache.Get(fqdn); v != nil {
+		return v.([]string), true
+	}
+	return nil, false
+}